@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/adamroyjones/git-rebase-all/pkg/rebaseall"
+)
+
+// flagChoices maps the flags that take one of a fixed set of values to those
+// values.
+var flagChoices = map[string][]string{
+	"backend":          {"exec", "gogit"},
+	"color":            {"auto", "always", "never"},
+	"format":           {"text", "json", "github"},
+	"merges":           {"preserve", "flatten", "skip"},
+	"on-conflict":      {"abort", "abort-all", "pause", "skip"},
+	"order":            {"asc", "desc"},
+	"restore":          {"branch", "sha", "ask"},
+	"sort":             {"alpha", "commits", "recent"},
+	"strategy":         {"rebase", "merge"},
+	"sync-with-remote": {"reset", "merge", "skip"},
+}
+
+// branchFlags are the flags that take branch names (or patterns matching them).
+var branchFlags = []string{"b", "include", "exclude", "protected", "rebase-checked-out"}
+
+// subcommands are the commands that may be given before, after, or among the
+// flags.
+var subcommands = []string{"run", "plan", "continue", "undo", "status", "log", "cleanup-checkpoints", "completion"}
+
+// dynamicFlags returns the flags whose values are completed by `git-rebase-all
+// __complete <flag>`.
+func dynamicFlags() []string {
+	out := append([]string{"remote"}, branchFlags...)
+	for name := range flagChoices {
+		out = append(out, name)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// completeFlag writes the candidate values of the flag, one per line: its
+// choices, or the remotes, or the local branches preceded by any patterns that
+// the config gives it (e.g., exclude = ["wip/*"]).
+func completeFlag(w io.Writer, fset *flag.FlagSet, name string) {
+	if choices, ok := flagChoices[name]; ok {
+		fmt.Fprintln(w, strings.Join(choices, "\n"))
+		return
+	}
+	dir, err := rootDir(fset)
+	if err != nil {
+		return
+	}
+	run := func(args ...string) {
+		if bs, err := (rebaseall.ExecRunner{}).Run(context.Background(), dir, args...); err == nil {
+			fmt.Fprint(w, string(bs))
+		}
+	}
+	if name == "remote" {
+		run("remote")
+		return
+	}
+	if f := fset.Lookup(name); f != nil && name != "b" {
+		for _, p := range strings.Split(f.Value.String(), ",") {
+			if p != "" {
+				fmt.Fprintln(w, p)
+			}
+		}
+	}
+	refs := []string{"refs/heads"}
+	if name == "b" {
+		refs = append(refs, "refs/remotes", "refs/tags")
+	}
+	run(append([]string{"for-each-ref", "--format=%(refname:short)"}, refs...)...)
+}
+
+// writeCompletion writes the completion script for the shell to w.
+func writeCompletion(w io.Writer, fset *flag.FlagSet, shell string) error {
+	var valueFlags, allFlags []string
+	fset.VisitAll(func(f *flag.Flag) {
+		allFlags = append(allFlags, dashed(f.Name))
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+			valueFlags = append(valueFlags, f.Name)
+		}
+	})
+	dynamic := strings.Join(dynamicFlags(), " ")
+
+	switch shell {
+	case "bash":
+		fmt.Fprintf(w, `# bash completion for git-rebase-all; load it with
+#   source <(git-rebase-all completion bash)
+_git_rebase_all() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	local name=${prev#-}
+	name=${name#-}
+	if [[ $prev == -* && " %s " == *" $name "* ]]; then
+		if [[ " %s " == *" $name "* ]]; then
+			local IFS=$'\n'
+			COMPREPLY=($(compgen -W "$(git-rebase-all __complete "$name" 2>/dev/null)" -- "$cur"))
+		else
+			COMPREPLY=($(compgen -f -- "$cur"))
+		fi
+		return
+	fi
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+	elif [[ $prev == completion ]]; then
+		COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+	fi
+}
+complete -F _git_rebase_all git-rebase-all
+`, strings.Join(valueFlags, " "), dynamic, strings.Join(allFlags, " "), strings.Join(subcommands, " "))
+
+	case "zsh":
+		fmt.Fprintf(w, `#compdef git-rebase-all
+# zsh completion for git-rebase-all; load it with
+#   source <(git-rebase-all completion zsh)
+_git-rebase-all() {
+	local prev=${words[CURRENT-1]}
+	local name=${${prev#-}#-}
+	if [[ $prev == -* && " %s " == *" $name "* ]]; then
+		if [[ " %s " == *" $name "* ]]; then
+			local -a values
+			values=(${(f)"$(git-rebase-all __complete $name 2>/dev/null)"})
+			compadd -a values
+		else
+			_files
+		fi
+		return
+	fi
+	if [[ $PREFIX == -* ]]; then
+		compadd -- %s
+	elif [[ $prev == completion ]]; then
+		compadd bash zsh fish
+	else
+		compadd %s
+	fi
+}
+compdef _git-rebase-all git-rebase-all
+`, strings.Join(valueFlags, " "), dynamic, strings.Join(allFlags, " "), strings.Join(subcommands, " "))
+
+	case "fish":
+		fmt.Fprintln(w, "# fish completion for git-rebase-all; load it with")
+		fmt.Fprintln(w, "#   git-rebase-all completion fish | source")
+		fmt.Fprintln(w, "complete -c git-rebase-all -f")
+		fmt.Fprintf(w, "complete -c git-rebase-all -n __fish_use_subcommand -a '%s'\n", strings.Join(subcommands, " "))
+		fmt.Fprintln(w, "complete -c git-rebase-all -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'")
+		fset.VisitAll(func(f *flag.Flag) {
+			opt := "-l " + f.Name
+			if len(f.Name) == 1 {
+				opt = "-s " + f.Name
+			}
+			desc, _, _ := strings.Cut(f.Usage, "; ")
+			desc = strings.TrimSuffix(desc, ".")
+			line := fmt.Sprintf("complete -c git-rebase-all %s -d '%s'", opt, strings.ReplaceAll(desc, "'", `\'`))
+			switch {
+			case strings.Contains(" "+dynamic+" ", " "+f.Name+" "):
+				line += fmt.Sprintf(" -x -a '(git-rebase-all __complete %s 2>/dev/null)'", f.Name)
+			case slices.Contains(valueFlags, f.Name):
+				line += " -r -F"
+			}
+			fmt.Fprintln(w, line)
+		})
+
+	default:
+		return fmt.Errorf(`the shell must be "bash", "zsh", or "fish" (given: %q)`, shell)
+	}
+	return nil
+}
+
+// dashed returns the flag as it's written on the command line.
+func dashed(name string) string {
+	if len(name) == 1 {
+		return "-" + name
+	}
+	return "--" + name
+}
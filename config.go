@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/adamroyjones/git-rebase-all/pkg/rebaseall"
+)
+
+const configFileName = ".git-rebase-all.toml"
+
+// envPrefix prefixes the environment variables that set flags; e.g.,
+// GIT_REBASE_ALL_ON_CONFLICT sets --on-conflict.
+const envPrefix = "GIT_REBASE_ALL_"
+
+// configKeyAliases maps the keys that may be used in config files to the names
+// of the flags that they set. Any other key must be the name of a flag.
+var configKeyAliases = map[string]string{"target": "b"}
+
+// repoConfigFlags are the only flags that the repository's config file may set:
+// the target, the patterns of the branches to leave alone, and the conflict
+// policy. As the file is committed, and so is whatever the repository's authors
+// wrote, the flags that run commands, push, delete or reset branches, or write
+// files may only be set by the user's config, the environment, or the command
+// line.
+var repoConfigFlags = []string{"b", "exclude", "on-conflict"}
+
+// rootDir returns the directory in which to run: that of --root-dir, if it's
+// set, and the current directory otherwise.
+func rootDir(fset *flag.FlagSet) (string, error) {
+	if f := fset.Lookup("root-dir"); f != nil && f.Value.String() != "" {
+		return f.Value.String(), nil
+	}
+	return os.Getwd()
+}
+
+// setting is a key and its values from a config file. A scalar has one value;
+// an array has any number.
+type setting struct {
+	key    string
+	values []string
+	line   int
+}
+
+// applyConfig sets the flags that weren't set on the command line from the
+// environment (see applyEnv), then from the repository's config file
+// (.git-rebase-all.toml in the top-level directory), and then from the user's
+// (~/.git-rebase-all.toml). Flags take precedence over the environment, which
+// takes precedence over the repository's config, which takes precedence over
+// the user's. The repository's config can only set repoConfigFlags.
+func applyConfig(fset *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if err := applyEnv(fset, set); err != nil {
+		return err
+	}
+
+	var paths []string
+	var repoPath string
+	if dir, err := rootDir(fset); err == nil {
+		if bs, err := (rebaseall.ExecRunner{}).Run(context.Background(), dir, "rev-parse", "--show-toplevel"); err == nil {
+			repoPath = filepath.Join(strings.TrimSpace(string(bs)), configFileName)
+			paths = append(paths, repoPath)
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		if path := filepath.Join(home, configFileName); path == repoPath {
+			// The home directory is itself the repository's top level.
+			repoPath = ""
+		} else {
+			paths = append(paths, path)
+		}
+	}
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("opening the config file: %w", err)
+		}
+		settings, err := parseConfig(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("parsing the config file (path: %s): %w", path, err)
+		}
+
+		applied := make(map[string]bool)
+		for _, st := range settings {
+			name := st.key
+			if alias, ok := configKeyAliases[name]; ok {
+				name = alias
+			}
+			if fset.Lookup(name) == nil {
+				return fmt.Errorf("unknown key %q (path: %s, line: %d)", st.key, path, st.line)
+			}
+			if path == repoPath && !slices.Contains(repoConfigFlags, name) {
+				return fmt.Errorf("%q can't be set in the repository's config file, which may only set target, exclude, and on-conflict; set it in ~/%s, the environment, or a flag (path: %s, line: %d)", st.key, configFileName, path, st.line)
+			}
+			if set[name] {
+				continue
+			}
+			for _, v := range st.values {
+				if err := fset.Set(name, v); err != nil {
+					return fmt.Errorf("setting %q (path: %s, line: %d): %w", st.key, path, st.line, err)
+				}
+			}
+			applied[name] = true
+		}
+		for name := range applied {
+			set[name] = true
+		}
+	}
+	return nil
+}
+
+// applyEnv sets the flags that aren't yet set from the environment variables
+// named by envPrefix and the flag's name (or its config key's alias) in upper
+// case with underscores for dashes, such as GIT_REBASE_ALL_TARGET or
+// GIT_REBASE_ALL_EXCLUDE='wip/*,release/*'. Each variable's value is given to
+// its flag once, as it would be on the command line. It records the flags that
+// it sets in set.
+func applyEnv(fset *flag.FlagSet, set map[string]bool) error {
+	names := make(map[string]string)
+	fset.VisitAll(func(f *flag.Flag) { names[envName(f.Name)] = f.Name })
+	for key, name := range configKeyAliases {
+		names[envName(key)] = name
+	}
+
+	env := os.Environ()
+	slices.Sort(env)
+	for _, kv := range env {
+		key, v, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, envPrefix) {
+			continue
+		}
+		name, ok := names[key]
+		if !ok {
+			return fmt.Errorf("unknown environment variable %s", key)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fset.Set(name, v); err != nil {
+			return fmt.Errorf("setting %q from %s: %w", name, key, err)
+		}
+		set[name] = true
+	}
+	return nil
+}
+
+// envName returns the name of the environment variable for the flag or config
+// key.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// parseConfig parses the subset of TOML that's needed for flat settings: each
+// line is blank, a comment, or in the form `key = value`, where the value is a
+// string, a boolean, an integer, or a single-line array of strings.
+func parseConfig(r io.Reader) ([]setting, error) {
+	var out []setting
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, rest, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf(`expected a line in the form "key = value" (line: %d)`, n)
+		}
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("expected a key before the '=' (line: %d)", n)
+		}
+
+		values, err := parseConfigValue(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("parsing the value of %q (line: %d): %w", key, n, err)
+		}
+		out = append(out, setting{key: key, values: values, line: n})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading the config: %w", err)
+	}
+	return out, nil
+}
+
+func parseConfigValue(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "[") {
+		v, rest, err := parseConfigScalar(s)
+		if err != nil {
+			return nil, err
+		}
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("unexpected text after the value: %q", rest)
+		}
+		return []string{v}, nil
+	}
+
+	var values []string
+	s = strings.TrimSpace(s[1:])
+	for {
+		if rest, ok := strings.CutPrefix(s, "]"); ok {
+			if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("unexpected text after the array: %q", rest)
+			}
+			return values, nil
+		}
+		v, rest, err := parseConfigScalar(s)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		if rest, ok := strings.CutPrefix(rest, ","); ok {
+			s = strings.TrimSpace(rest)
+			continue
+		}
+		if !strings.HasPrefix(rest, "]") {
+			return nil, errors.New("expected a ',' or a ']' after an element of the array")
+		}
+		s = rest
+	}
+}
+
+// parseConfigScalar parses a string, boolean, or integer at the start of s and
+// returns it together with the trimmed remainder of s.
+func parseConfigScalar(s string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		// Find the closing quote, skipping escaped characters.
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", "", fmt.Errorf("invalid string %s: %w", s[:i+1], err)
+				}
+				return v, strings.TrimSpace(s[i+1:]), nil
+			}
+		}
+		return "", "", errors.New("unterminated string")
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], strings.TrimSpace(s[end+2:]), nil
+	}
+
+	end := strings.IndexAny(s, " \t,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	v := s[:end]
+	if v != "true" && v != "false" {
+		if _, err := strconv.Atoi(v); err != nil {
+			return "", "", fmt.Errorf("expected a string, a boolean, or an integer; given %q", v)
+		}
+	}
+	return v, strings.TrimSpace(s[end:]), nil
+}
@@ -1,31 +1,24 @@
 package main
 
 import (
-	"cmp"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path"
 	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/adamroyjones/git-rebase-all/pkg/rebaseall"
 )
 
 const version = "0.0.8"
 
-const minGitMajorVersion, minGitMinorVersion = 2, 38
-
-type worktree struct{ dir, branch string }
-
-type state struct {
-	worktrees []worktree
-	// branch -> commit SHA
-	branches         map[string]string
-	branchesToRebase []string
-	currentDir       string
-	targetBranch     string
-}
-
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stdout, `git-rebase-all: Rebase all branches across all worktrees.
@@ -36,10 +29,59 @@ Usage:
 
   Rebase onto main if it exists, else master if it exists, and otherwise error.
     git-rebase-all
+    git-rebase-all run
+
+  Print the plan without fetching or rebasing (as --dry-run does).
+    git-rebase-all plan -b foo
+
+  Continue a run that was paused on a conflict (as --continue does).
+    git-rebase-all continue
+
+  Reset every branch to where it was before the last run (as --undo does).
+    git-rebase-all undo
+
+  Print whether a run is paused, how the last run went, and what each worktree
+  has checked out.
+    git-rebase-all status
+
+  List the prior runs, each of whose journals is kept in .git/rebase-all/.
+    git-rebase-all log
+
+  Delete the tags of every checkpoint made by --checkpoint other than the most
+  recent (see --keep-checkpoints).
+    git-rebase-all cleanup-checkpoints
+
+  Print a completion script for bash, zsh, or fish (e.g., to load it with
+  source <(git-rebase-all completion bash)).
+    git-rebase-all completion bash
+
+  Run in another repository without changing into it.
+    git-rebase-all --root-dir ~/src/other-repo
 
   Print version information and exit
     git-rebase-all -v
 
+  The flags may be given before or after the command (e.g., git-rebase-all
+  plan -b foo or git-rebase-all -b foo plan).
+
+Config:
+  Any flag may instead be set in .git-rebase-all.toml in the home directory,
+  with lines such as
+
+    target = "main"
+    exclude = ["wip/*", "release/*"]
+    on-conflict = "pause"
+
+  As the repository's config, .git-rebase-all.toml in its top-level directory,
+  is committed, it may only set target, exclude, and on-conflict.
+
+  Any flag may also be set with an environment variable named after it, such
+  as GIT_REBASE_ALL_TARGET=main, GIT_REBASE_ALL_EXCLUDE='wip/*,release/*', or
+  GIT_REBASE_ALL_ON_CONFLICT=pause.
+
+  Flags take precedence over the environment, which takes precedence over the
+  repository's config, which takes precedence over the home directory's.
+
 Details:
   This program requires Git %d.%d+.
 
@@ -49,259 +91,408 @@ Details:
   with "git rebase --update-refs".
 
   See github.com/adamroyjones/git-rebase-all.
-`, minGitMajorVersion, minGitMinorVersion)
+
+Exit status:
+  0   Success.
+  1   Any other failure (with --repos, any failure).
+  2   The flags couldn't be parsed.
+  10  A worktree has uncommitted changes or an operation in progress.
+  11  A branch conflicted, whether the run was stopped, skipped it, or paused.
+  12  Fetching failed.
+  13  The version of git is unsupported.
+
+Flags:
+`, rebaseall.MinGitMajorVersion, rebaseall.MinGitMinorVersion)
+		flag.CommandLine.SetOutput(os.Stdout)
+		flag.PrintDefaults()
 	}
 
-	var targetBranch string
+	var opts rebaseall.Options
 	var v bool
 	flag.BoolVar(&v, "v", false, "Print version information and exit.")
-	flag.StringVar(&targetBranch, "b", "", "The branch onto which to rebase; defaults first to main, then to master, if unspecified.")
-	flag.Parse()
+	flag.StringVar(&opts.TargetBranch, "b", "", "The branch onto which to rebase; defaults first to the branch to which the HEAD of a remote (--remote, then the others) points, then to main, then to master, if unspecified.")
+	flag.BoolVar(&opts.PruneRemote, "prune-remote", false, "Prune stale remote-tracking references from each remote before fetching and report them.")
+	flag.StringVar(&opts.Sort, "sort", "alpha", "The key by which to order the branches to rebase: alpha (by name), commits (the fewest commits ahead of the target first), or recent (the most recently committed first).")
+	flag.StringVar(&opts.Order, "order", "asc", "The direction in which to order the branches to rebase by --sort: asc or desc (reversed).")
+	flag.StringVar(&opts.DumpPlan, "dump-plan", "", "Write the plan against the local state of the repository to the given file and exit; nothing is fetched or rebased.")
+	flag.StringVar(&opts.LoadPlan, "load-plan", "", "Replay the plan in the given file, as it was made and without fetching; the run stops if the target or any branch has moved since.")
+	flag.BoolVar(&opts.OntoUpstream, "onto-upstream", false, "Rebase onto the target branch's configured upstream (e.g., origin/main) rather than onto the target branch.")
+	flag.StringVar(&opts.Restore, "restore", "branch", "How to restore each worktree that had a branch checked out: branch (check out the branch, wherever it now points), sha (detach its HEAD at the commit it had checked out if the branch was rewritten), or ask.")
+	flag.StringVar(&opts.Strategy, "strategy", "rebase", "How to bring each branch up to date: rebase (rebase it onto the target) or merge (merge the target into it, and each branch into those stacked on it, rewriting nothing).")
+	flag.StringVar(&opts.Merges, "merges", "preserve", "What to do with a branch whose own history has merge commits, which a plain rebase flattens: preserve (rebase it with --rebase-merges), flatten (rebase it as any other), or skip (skip it with a warning).")
+	flag.BoolVar(&opts.StackAware, "stack-aware", false, "Rebase each stack of branches parents first, each branch onto its parent, so that a failure leaves the branches stacked on the failed branch untouched.")
+	flag.BoolVar(&opts.RespectUpstream, "respect-upstream", false, "Rebase each branch onto its configured upstream (branch.<name>.merge), if it has one other than its own remote counterpart, rather than onto the target branch.")
+	flag.BoolVar(&opts.Health, "health", false, "Fetch and print a summary of each branch's freshness relative to the target, then exit without rebasing.")
+	flag.BoolVar(&opts.PredictConflicts, "predict-conflicts", false, "Before rebasing, merge each branch with its base in memory (git merge-tree) and report the branches that are likely to conflict, asking whether to proceed, skip them, or stop.")
+	flag.BoolVar(&opts.Unshallow, "unshallow", false, "In a shallow clone, fetch all of the history before rebasing (git fetch --unshallow).")
+	flag.IntVar(&opts.Deepen, "deepen", 0, "In a shallow clone, deepen the history by this many commits (git fetch --deepen), as many times as it takes for each branch to share history with the target; without it or --unshallow, such a clone fails the run.")
+	flag.BoolVar(&opts.FetchAll, "fetch-all", false, "Fetch every remote rather than only the default one, pruning the tags that are gone from them (git fetch --all --prune --prune-tags).")
+	flag.BoolVar(&opts.RecurseSubmodules, "recurse-submodules", false, "Also fetch the submodules (git fetch --recurse-submodules).")
+	flag.BoolVar(&opts.TolerateFetchFailure, "tolerate-fetch-failure", false, "Warn rather than fail if fetching or pulling fails, and rebase onto the possibly-stale local target branch.")
+	flag.BoolVar(&opts.Offline, "offline", false, "Don't fetch or pull; rebase onto the target branch as it is locally (e.g., without a network).")
+	flag.BoolVar(&opts.FetchOnly, "fetch-only", false, "Fetch and update the target branch, and then stop without rebasing anything.")
+	flag.BoolVar(&opts.SkipBusyWorktrees, "skip-busy-worktrees", false, "Leave alone the worktrees with a rebase, merge, cherry-pick, revert, or bisection in progress, and the branches they're working on, rather than refusing to run.")
+	flag.BoolVar(&opts.SkipLockedWorktrees, "skip-locked-worktrees", false, "Leave alone the worktrees locked by 'git worktree lock' and the branches they have checked out.")
+	flag.BoolVar(&opts.ResetTarget, "reset-target", false, "If the target branch has diverged from its upstream, reset it to its upstream (discarding its local commits) rather than failing; it's otherwise only ever fast-forwarded.")
+	flag.BoolVar(&opts.FetchTarget, "fetch-target", false, "Fast-forward the target branch with 'git fetch <remote> <branch>:<target>' rather than by checking it out and pulling; the latter is still used if a worktree that isn't detached (e.g., with --per-worktree) has it checked out or it has to be reset.")
+	flag.BoolVar(&opts.PerWorktree, "per-worktree", false, "Rebase each branch in the worktree in which it's checked out rather than detaching every worktree's HEAD.")
+	flag.BoolVar(&opts.PerWorktree, "in-place", false, "An alias for --per-worktree; with --rebase-checked-out='*', every branch is rebased in the worktree in which it's checked out, which keeps each worktree's build caches and editor state.")
+	flag.BoolVar(&opts.Undo, "undo", false, "Reset every branch to where it was before the last run that rewrote one, as recorded under refs/rebase-all/backup, and delete the branches that run created, then exit.")
+	flag.BoolVar(&opts.Checkpoint, "checkpoint", false, "Before rewriting anything, tag each branch as rebase-all/checkpoint/<time>/<branch>, a safety net that, unlike the reflog, doesn't expire; delete old checkpoints with git-rebase-all cleanup-checkpoints.")
+	flag.IntVar(&opts.KeepCheckpoints, "keep-checkpoints", 3, "The number of the most recent checkpoints that git-rebase-all cleanup-checkpoints keeps.")
+	flag.BoolVar(&opts.ForceUnlock, "force-unlock", false, "Remove the lock file that stops runs in the same repository from overlapping before running, as one left behind by a run that was killed blocks every run.")
+	flag.BoolVar(&opts.Stats, "stats", false, "After the summary, report the number of git commands run, how long each phase of the run (e.g., fetch, plan, rebase, and restore) took, the slowest branches, and the number of commits replayed, to help find out why a run is slow.")
+	flag.BoolVar(&opts.AbortAll, "abort-all", false, "Abort any rebase, merge, cherry-pick, or revert in progress in any worktree, then exit.")
+	flag.IntVar(&opts.MaxOutputLines, "max-output-lines", 50, "The maximum number of lines of git's output to include in error messages; 0 denotes no maximum.")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "Print the plan against the local state of the repository without fetching or rebasing.")
+	flag.Var((*graphFlag)(&opts.Graph), "graph", "Print which branches contain which, where the target sits, and what a run would do with each, against the local state of the repository, without fetching or rebasing; --graph=dot prints it in Graphviz's DOT language.")
+	flag.StringVar(&opts.Format, "format", "text", "The format of the plan printed by --dry-run and of the summary printed after a run: text, json, or github (text followed by annotations for GitHub Actions of the branches that conflicted or were skipped). With json, progress is written to stderr.")
+	flag.StringVar(&opts.SummaryFile, "summary-file", "", "Write the summary of the run as JSON to this file, whatever the --format (e.g., for an editor to list the conflicted branches).")
+	flag.BoolVar(&opts.SelfTest, "self-test", false, "Check that rebasing works with the installed git by rebasing a stack and a branch checked out in another worktree in a throwaway repository in a temporary directory, and exit.")
+	flag.StringVar(&opts.Color, "color", "auto", "Whether to colour the progress and the summary: auto (if writing to a terminal and NO_COLOR is unset or empty), always, or never.")
+	flag.Var((*stringsFlag)(&opts.RebaseCheckedOut), "rebase-checked-out", "With --per-worktree, rebase the branches matching this pattern even though they're checked out in other worktrees; may be repeated.")
+	flag.BoolVar(&opts.NoHooks, "no-hooks", false, "Don't run git's hooks (e.g., post-checkout, post-rewrite, or reference-transaction) when checking out, rebasing, or merging the branches, as slow hooks can make a run take many minutes; pushing still runs them.")
+	flag.BoolVar(&opts.Rerere, "rerere", false, "Record conflict resolutions and reuse them (see git rerere), continuing the rebases whose conflicts were all resolved as before rather than failing them.")
+	flag.BoolVar(&opts.CopyNotes, "copy-notes", false, "Copy the notes attached to the rebased commits (in any ref under refs/notes) to the rewritten commits, which git otherwise leaves behind.")
+	flag.Var(&gpgSignFlag{sign: &opts.GPGSign, keyID: &opts.GPGKeyID}, "gpg-sign", "Sign the rebased commits (and, with --strategy=merge, the merge commits), with the given key ID if there's one (e.g., --gpg-sign=ABCD1234) and the default key otherwise; git also signs them if commit.gpgSign is set. The summary lists the branches left with unsigned commits.")
+	flag.StringVar(&opts.Backend, "backend", "exec", "How to run git's read-only queries: exec (run git) or, experimentally, gogit (answer the containment and merge-base queries in process with go-git, which starts far fewer processes on repositories with hundreds of branches); rebases always run git.")
+	flag.BoolVar(&opts.RefreshCommitGraph, "refresh-commit-graph", false, "Rewrite the commit-graph after fetching to speed up ancestry queries on large repositories.")
+	flag.BoolVar(&opts.NoDecapitate, "no-decapitate", false, "Don't detach the HEAD before rebasing; this requires there to be a single worktree.")
+	flag.BoolVar(&opts.Strict, "strict", false, "Refuse to run, rather than warn, if any worktree has sparse-checkout enabled.")
+	flag.BoolVar(&opts.RepeatUntilStable, "repeat-until-stable", false, "Repeat the rebasing until a pass changes no branches.")
+	flag.IntVar(&opts.MaxPasses, "max-passes", 5, "The maximum number of passes with --repeat-until-stable.")
+	flag.BoolVar(&opts.Interactive, "i", false, "List the leaf branches to rebase, with how far each is ahead of and behind the target, and choose which of them to rebase before any are.")
+	flag.Var((*patternsFlag)(&opts.Include), "include", "Only rebase branches matching one of these comma-separated glob patterns (e.g., 'feature/*,fix/*').")
+	flag.Var((*patternsFlag)(&opts.Exclude), "exclude", "Don't rebase branches matching any of these comma-separated glob patterns (e.g., 'wip/*,release/*').")
+	flag.Var((*stringsFlag)(&opts.Groups), "group", "Only rebase the branches in this group, a prefix of branch names up to a slash (e.g., 'user/alice' for 'user/alice/foo'), or in the groups nested in it; may be repeated.")
+	flag.BoolVar(&opts.GroupByPrefix, "group-by-prefix", false, "List the branches in the plan and the summary by group (their names up to their last slashes, e.g., 'feature/'), with counts for each.")
+	flag.Var((*patternsFlag)(&opts.TrackRemote), "track-remote", "After fetching, create local branches tracking the branches on --remote that match these comma-separated glob patterns (e.g., 'alice/*'), if there are none, so that they're kept up to date too; they're rebased even if they've diverged from the remote and never pushed (they're marked with branch.<name>.rebaseAllTracked, and existing branches that match are treated as any other).")
+	flag.Var((*targetMapFlag)(&opts.TargetMap), "target-map", "Rebase the branches matching a glob pattern onto another target, given as 'pattern=target' or 'pattern -> target' (e.g., 'release/*=release-base'); may be repeated, and the first matching pattern wins. Each such target is fast-forwarded to its upstream up front and isn't itself rebased.")
+	flag.Var((*patternsFlag)(&opts.Protected), "protected", "Never rewrite branches matching these comma-separated glob patterns, only fast-forwarding them (default 'main,master,release/*'); the target branch is exempt.")
+	flag.BoolVar(&opts.AllowProtected, "allow-protected", false, "Rebase protected branches (see --protected) as any other.")
+	flag.BoolVar(&opts.Mine, "mine", false, "Only rebase branches whose tip commits were authored or committed by you (that is, by user.email).")
+	flag.BoolVar(&opts.RebaseDiverged, "rebase-diverged", false, "Rebase the branches that have diverged from their upstreams (that is, are both ahead of and behind them), which are otherwise skipped as others may have pulled them.")
+	flag.StringVar(&opts.SyncWithRemote, "sync-with-remote", "", "What to do with a branch whose counterpart on the remote (its upstream) was force-pushed: 'reset' it to the remote's (unless it has commits that weren't pushed), 'merge' the remote's into it, or 'skip' it; by default, it's treated as any other diverged branch.")
+	flag.BoolVar(&opts.OnlyOpenPRs, "only-open-prs", false, "Only rebase branches that back open pull requests (through gh) or merge requests (through glab, for hosts named like gitlab) on the repository of --remote.")
+	flag.StringVar(&opts.Author, "author", "", "Only rebase branches whose tip commits were authored or committed by someone matching this regular expression, matched against \"Name <email>\".")
+	flag.Var((*ageFlag)(&opts.MaxAge), "max-age", "Skip the branches whose last commits are older than this (e.g., 30d, 2w, or 12h), as stale; 0 denotes no limit.")
+	flag.StringVar(&opts.OnConflict, "on-conflict", "abort", "What to do if a rebase conflicts: abort (abort the rebase and stop), abort-all (abort the rebase, roll back every branch to where it was before the run, and stop), pause (leave the rebase in place to be resolved and continued with --continue), or skip (abort the rebase and carry on with the other branches).")
+	flag.BoolVar(&opts.Continue, "continue", false, "Continue a run that was paused on a conflict once the conflicted rebase has been resolved.")
+	flag.IntVar(&opts.Jobs, "jobs", 1, "The number of branches to rebase concurrently, each in a temporary worktree.")
+	flag.BoolVar(&opts.Push, "push", false, "Force-push (with a lease) each rebased branch that exists on the remote; the target branch is never pushed.")
+	flag.BoolVar(&opts.SetUpstream, "set-upstream", false, "After rebasing, point the upstream of each rebased branch at its counterpart on the remote (unless it's another local branch); with --push, push the branches that aren't on the remote to create them.")
+	flag.StringVar(&opts.Remote, "remote", "origin", "The remote to which to push with --push and whose HEAD is first used to find the target branch.")
+	flag.BoolVar(&opts.PruneMerged, "prune-merged", false, "After updating the target branch, delete the branches that are merged into it.")
+	flag.BoolVar(&opts.PruneGone, "prune-gone", false, "After fetching, delete the branches whose upstream is gone (e.g., as their pull requests were merged), after listing them and asking for confirmation.")
+	flag.BoolVar(&opts.Watch, "watch", false, "After running, keep fetching the target's upstream every --watch-interval and rerun whenever it moves, once it has settled; stop with an interrupt.")
+	flag.DurationVar(&opts.WatchInterval, "watch-interval", 5*time.Minute, "How often to fetch with --watch.")
+	flag.BoolVar(&opts.Yes, "yes", false, "Answer yes to any confirmation prompt.")
+	flag.IntVar(&opts.ConfirmOver, "confirm-over", 0, "If the run would rewrite more than this many branches, print the plan and ask for confirmation before rewriting them (see --yes); 0 denotes never asking.")
+	flag.StringVar(&opts.Dir, "root-dir", "", "Run in the repository containing this directory rather than in the current directory.")
+	var repos []string
+	flag.Var((*stringsFlag)(&repos), "repos", "Run in each of these repositories, or in each repository directly within these directories, one after the other, rather than in the current directory; may be repeated.")
+	var timeout time.Duration
+	flag.DurationVar(&timeout, "timeout", 0, "Give up after this long (e.g., 10m), aborting any rebase in progress and restoring the worktrees; 0 denotes no limit.")
+	flag.StringVar(&opts.PreBranchCmd, "pre-branch-cmd", "", "A shell command to run before rebasing each branch, where it's checked out, with REBASE_ALL_BRANCH, REBASE_ALL_TARGET, REBASE_ALL_ONTO, REBASE_ALL_SHA, and REBASE_ALL_DIR set; if it fails, the run fails.")
+	flag.StringVar(&opts.Verify, "verify", "", "A shell command to run against each branch after it's rebased, in a temporary worktree and with the variables of --pre-branch-cmd set; if it fails, the branch is rolled back and the run fails once the others are rebased (e.g., 'go test ./...').")
+	flag.StringVar(&opts.PostBranchCmd, "post-branch-cmd", "", "A shell command to run after rebasing each branch successfully, as with --pre-branch-cmd (e.g., to run its tests).")
+	flag.Var((*argsFlag)(&opts.RebaseArgs), "rebase-args", "Extra whitespace-separated arguments to pass to each git rebase (e.g., '--rebase-merges --committer-date-is-author-date'); may be repeated.")
+	flag.Func("X", "Pass this strategy option to each git rebase (e.g., -X ignore-all-space), as with git rebase -X; may be repeated.", func(v string) error {
+		opts.RebaseArgs = append(opts.RebaseArgs, "--strategy-option="+v)
+		return nil
+	})
+	flag.BoolVar(&opts.ProgressBar, "progress-bar", false, "Draw the progress as a single, updating bar rather than a line per branch when stdout is a terminal.")
+	var progressFD int
+	flag.IntVar(&progressFD, "progress-fd", 0, "Also write the progress to this file descriptor (e.g., 3) as newline-delimited JSON events (started, finished, skipped, conflicted, restored, and so on) for other programs to follow; 0 denotes none.")
+	var quiet, verbose, debug bool
+	flag.BoolVar(&quiet, "q", false, "Print nothing but errors and any summary.")
+	flag.BoolVar(&quiet, "quiet", false, "The same as -q.")
+	flag.BoolVar(&verbose, "verbose", false, "Print more detail about each step.")
+	flag.BoolVar(&debug, "debug", false, "Print every git command that's run, with its directory and output, to stderr; implies --verbose.")
+	cmd := parseArgs(flag.CommandLine, os.Args[1:])
+	opts.Args = flag.Args()
+
+	if err := applyConfig(flag.CommandLine); err != nil {
+		fmt.Fprintf(os.Stderr, "Fatal error: applying the config: %v.\n", err)
+		os.Exit(1)
+	}
+
+	switch cmd {
+	case "plan":
+		// --graph is another way of printing the plan.
+		opts.DryRun = opts.Graph == ""
+	case "continue":
+		opts.Continue = true
+	case "undo":
+		opts.Undo = true
+	case "status":
+		opts.Status = true
+	case "log":
+		opts.Log = true
+	case "cleanup-checkpoints":
+		opts.CleanupCheckpoints = true
+	case "completion":
+		if len(opts.Args) != 1 {
+			fmt.Fprintln(os.Stderr, "Fatal error: usage: git-rebase-all completion bash|zsh|fish.")
+			os.Exit(1)
+		}
+		if err := writeCompletion(os.Stdout, flag.CommandLine, opts.Args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Fatal error: %v.\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "__complete":
+		// This is called by the completion scripts.
+		if len(opts.Args) == 1 {
+			completeFlag(os.Stdout, flag.CommandLine, opts.Args[0])
+		}
+		os.Exit(0)
+	}
 
 	if v {
 		fmt.Println("git-rebase-all " + version)
 		os.Exit(0)
 	}
 
-	if err := run(targetBranch); err != nil {
-		fmt.Fprintf(os.Stderr, "Fatal error: %v.\n", err)
+	switch {
+	case quiet && (verbose || debug):
+		fmt.Fprintln(os.Stderr, "Fatal error: -q cannot be used with --verbose or --debug.")
 		os.Exit(1)
+	case quiet:
+		opts.Verbosity = rebaseall.VerbosityQuiet
+	case debug:
+		opts.Verbosity = rebaseall.VerbosityDebug
+	case verbose:
+		opts.Verbosity = rebaseall.VerbosityVerbose
+	}
+
+	if progressFD > 0 {
+		f := os.NewFile(uintptr(progressFD), "progress-fd")
+		if _, err := f.Stat(); err != nil {
+			fmt.Fprintf(os.Stderr, "Fatal error: --progress-fd %d isn't an open file descriptor: %v.\n", progressFD, err)
+			os.Exit(1)
+		}
+		opts.Events = f
 	}
-}
 
-func run(targetBranch string) (err error) {
-	if err := validateGitVersion(); err != nil {
-		return fmt.Errorf("validating the version of git :%w", err)
+	// On an interrupt, the rebase in progress is aborted and the worktrees are
+	// restored before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	if bs, err := exec.Command("git", "rev-parse", "--is-inside-work-tree").CombinedOutput(); err != nil {
-		return fmt.Errorf("checking whether the program is being run from a git directory: %w (output: %s)", err, trimbs(bs))
+	if opts.Watch && len(repos) > 0 {
+		fmt.Fprintln(os.Stderr, "Fatal error: --watch cannot be used with --repos.")
+		os.Exit(1)
 	}
-
-	s, err := newState(targetBranch)
-	if err != nil {
-		return fmt.Errorf("constructing state struct: %w", err)
+	if opts.Dir != "" && len(repos) > 0 {
+		fmt.Fprintln(os.Stderr, "Fatal error: --root-dir cannot be used with --repos.")
+		os.Exit(1)
 	}
-
-	if err := s.errIfUncommittedChanges(); err != nil {
-		return fmt.Errorf("verifying that there are no uncommitted changes: %w", err)
+	if opts.SummaryFile != "" && len(repos) > 0 {
+		fmt.Fprintln(os.Stderr, "Fatal error: --summary-file cannot be used with --repos, as each repository has its own summary.")
+		os.Exit(1)
 	}
-
-	fmt.Println("Fetching and pruning...")
-	if err := fetch(s.currentDir); err != nil {
-		return fmt.Errorf("fetching and pruning: %w", err)
+	if opts.Dir != "" {
+		if fi, err := os.Stat(opts.Dir); err != nil || !fi.IsDir() {
+			fmt.Fprintf(os.Stderr, "Fatal error: --root-dir must be a directory (given: %s).\n", opts.Dir)
+			os.Exit(1)
+		}
 	}
-	defer func() { err = errors.Join(err, s.restore()) }()
-
-	// git doesn't permit a branch to be checked out in more than one worktree. By
-	// decapitating each worktree, we can work in a single directory (namely, the
-	// current directory).
-	if err := s.decapitateAll(); err != nil {
-		return fmt.Errorf("failed to detach the HEAD for each worktree: %w", err)
+	run := rebaseall.Run
+	if len(repos) > 0 {
+		run = func(ctx context.Context, opts rebaseall.Options) error { return runRepos(ctx, opts, repos) }
 	}
-
-	fmt.Printf("Updating %q...\n", s.targetBranch)
-	if err := s.updateTargetBranch(); err != nil {
-		return fmt.Errorf("updating target branch (%s): %w", s.targetBranch, err)
+	if err := run(ctx, opts); err != nil {
+		if errors.Is(err, rebaseall.ErrPaused) {
+			fmt.Fprintf(os.Stderr, "Paused: %v.\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Fatal error: %v.\n", err)
+		}
+		os.Exit(exitCode(err))
 	}
+}
 
-	fmt.Println("Updating the branches...")
-	if err := s.constructBranchesToRebase(); err != nil {
-		return fmt.Errorf("constructing the list of branches to rebase: %w", err)
-	}
+// These are the exit statuses, which are documented in the usage. The flag
+// package exits with 2 if the flags can't be parsed, so the classes of failure
+// start at 10 to be told apart from it.
+const (
+	exitFailure        = 1
+	exitDirty          = 10
+	exitConflict       = 11
+	exitFetchFailed    = 12
+	exitUnsupportedGit = 13
+)
 
-	if err := s.rebaseBranches(); err != nil {
-		return fmt.Errorf("rebasing the branches: %w", err)
-	}
+// exitCode returns the exit status for the error.
+func exitCode(err error) int {
+	var conflict *rebaseall.RebaseConflictError
+	switch {
+	case errors.Is(err, rebaseall.ErrUncommittedChanges), errors.Is(err, rebaseall.ErrWorktreeBusy):
+		return exitDirty
+	case errors.Is(err, rebaseall.ErrPaused), errors.As(err, &conflict):
+		return exitConflict
+	case errors.Is(err, rebaseall.ErrFetchFailed):
+		return exitFetchFailed
+	case errors.Is(err, rebaseall.ErrGitTooOld):
+		return exitUnsupportedGit
+	}
+	return exitFailure
+}
 
-	return nil
+// parseArgs parses the arguments, which may include a command (see
+// subcommands) before, after, or among the flags, and returns the command, if
+// any. The remaining positional arguments are left in fset.Args().
+func parseArgs(fset *flag.FlagSet, args []string) string {
+	isCommand := func(arg string) bool { return slices.Contains(subcommands, arg) || arg == "__complete" }
+	var cmd string
+	if len(args) > 0 && isCommand(args[0]) {
+		cmd, args = args[0], args[1:]
+	}
+	// The flag set exits on an error.
+	_ = fset.Parse(args)
+	if cmd == "" && fset.NArg() > 0 && isCommand(fset.Arg(0)) {
+		cmd = fset.Arg(0)
+		_ = fset.Parse(fset.Args()[1:])
+	}
+	return cmd
 }
 
-func validateGitVersion() error {
-	bs, err := exec.Command("git", "--version").CombinedOutput()
-	s := trimbs(bs)
-	if err != nil {
-		return fmt.Errorf("running `git --version`: %w (output: %s)", err, s)
-	}
+// stringsFlag is a flag.Value that collects the values of a repeated flag.
+type stringsFlag []string
 
-	var major, minor, patch int
-	if _, err := fmt.Sscanf(s, "git version %d.%d.%d", &major, &minor, &patch); err != nil {
-		return fmt.Errorf(`expected a version string in the form "git version <major>.<minor>.<patch>"; given %q`, s)
-	}
-	if major < minGitMajorVersion {
-		return fmt.Errorf("the major version of git is too low (given: %d, minimum: %d)", major, minGitMajorVersion)
-	}
-	if major == minGitMajorVersion && minor < minGitMinorVersion {
-		return fmt.Errorf("the minor version of git is too low (given: %d, minimum: %d)", minor, minGitMinorVersion)
-	}
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
 	return nil
 }
 
-func newState(targetBranch string) (*state, error) {
-	currentDir, err := os.Getwd()
-	if err != nil {
-		return nil, fmt.Errorf("fetching the current directory: %w", err)
-	}
+// ageFlag is a flag.Value for a duration that may also be given in days (e.g.,
+// 30d) or weeks (e.g., 2w).
+type ageFlag time.Duration
 
-	worktrees, err := worktrees()
-	if err != nil {
-		return nil, fmt.Errorf("fetching and parsing worktrees: %w", err)
-	}
+func (f *ageFlag) String() string { return time.Duration(*f).String() }
 
-	branches, err := branches(currentDir)
+func (f *ageFlag) Set(v string) error {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(v, suffix); ok {
+			i, err := strconv.Atoi(n)
+			if err != nil {
+				return fmt.Errorf("invalid age %q", v)
+			}
+			*f = ageFlag(time.Duration(i) * unit)
+			return nil
+		}
+	}
+	d, err := time.ParseDuration(v)
 	if err != nil {
-		return nil, fmt.Errorf("listing the local branches: %w", err)
+		return fmt.Errorf("invalid age %q", v)
 	}
+	*f = ageFlag(d)
+	return nil
+}
 
-	branchNames := sortedKeys(branches)
-	if targetBranch != "" && !contains(branchNames, targetBranch) {
-		return nil, fmt.Errorf("the specified branch %q could not be found", targetBranch)
-	}
-	if targetBranch == "" && contains(branchNames, "main") {
-		targetBranch = "main"
-	}
-	if targetBranch == "" && contains(branchNames, "master") {
-		targetBranch = "master"
-	}
-	if targetBranch == "" {
-		return nil, errors.New("no branch was specified and main and master could not be found")
-	}
+// targetMapFlag is a flag.Value that collects the mappings of --target-map.
+type targetMapFlag []rebaseall.TargetMapping
 
-	return &state{
-		worktrees:    worktrees,
-		branches:     branches,
-		currentDir:   currentDir,
-		targetBranch: targetBranch,
-	}, nil
+func (f *targetMapFlag) String() string {
+	var out []string
+	for _, m := range *f {
+		out = append(out, m.Pattern+"="+m.Target)
+	}
+	return strings.Join(out, ",")
 }
 
-func (s *state) errIfUncommittedChanges() error {
-	for _, w := range s.worktrees {
-		out, err := status(w.dir)
-		if err != nil {
-			return fmt.Errorf("checking for uncommitted changes (dir: %s): %w", w.dir, err)
-		}
-		if len(out) > 0 {
-			return fmt.Errorf("there are uncommitted changes (dir: %s)", w.dir)
-		}
+func (f *targetMapFlag) Set(v string) error {
+	pattern, target, ok := strings.Cut(v, "->")
+	if !ok {
+		pattern, target, ok = strings.Cut(v, "=")
 	}
+	pattern, target = strings.TrimSpace(pattern), strings.TrimSpace(target)
+	if !ok || pattern == "" || target == "" {
+		return fmt.Errorf("expected 'pattern=target' (given: %q)", v)
+	}
+	*f = append(*f, rebaseall.TargetMapping{Pattern: pattern, Target: target})
 	return nil
 }
 
-func (s *state) decapitateAll() error {
-	for _, w := range s.worktrees {
-		if err := decapitate(w.dir); err != nil {
-			return fmt.Errorf("failed to the detach the HEAD (dir: %s): %w", w.dir, err)
-		}
-	}
+// argsFlag is a flag.Value that collects whitespace-separated arguments.
+type argsFlag []string
+
+func (f *argsFlag) String() string { return strings.Join(*f, " ") }
+
+func (f *argsFlag) Set(v string) error {
+	*f = append(*f, strings.Fields(v)...)
 	return nil
 }
 
-// constructBranchesToRebase comprises two types of branch: "leaf" branches and
-// those branches that are "behind" the target branch and so can be
-// fast-forwarded. We'll collapse any distinction between the two categories.
-func (s *state) constructBranchesToRebase() error {
-	s.branchesToRebase = sortedKeys(s.branches)
-	targetSHA, ok := s.branches[s.targetBranch]
-	if !ok {
-		return fmt.Errorf("unable to find the branch %q in the state: this should be unreachable", s.targetBranch)
-	}
-
-	i := 0
-	for _, branch := range s.branchesToRebase {
-		// If the branch is a proper child of the target branch, then there is no
-		// need to rebase it.
-		{
-			children, err := s.branchChildren(s.currentDir, s.targetBranch)
-			if err != nil {
-				return err
-			}
-			if slices.Contains(children, branch) {
-				continue
-			}
-		}
+// graphFlag is a flag.Value for --graph, which may be given alone (as "ascii")
+// or with a value.
+type graphFlag string
 
-		children, err := s.branchChildren(s.currentDir, branch)
-		if err != nil {
-			return err
-		}
+func (f *graphFlag) String() string { return string(*f) }
 
-		// If a branch has no children, it is a "leaf" branch and should be rebased.
-		if len(children) == 0 {
-			s.branchesToRebase[i] = branch
-			i++
-			continue
-		}
+func (f *graphFlag) IsBoolFlag() bool { return true }
 
-		// If a branch has the target branch as a child, and if the branch and the
-		// target branch don't point to the same commit, then we should rebase.
-		if slices.Contains(children, s.targetBranch) {
-			branchSHA, ok := s.branches[branch]
-			if !ok {
-				return fmt.Errorf("unable to find the branch %q in the state: this should be unreachable", branch)
-			}
-			if branchSHA != targetSHA {
-				s.branchesToRebase[i] = branch
-				i++
-				continue
-			}
-		}
+func (f *graphFlag) Set(v string) error {
+	switch v {
+	case "true":
+		*f = "ascii"
+	case "false":
+		*f = ""
+	default:
+		*f = graphFlag(v)
 	}
-	s.branchesToRebase = s.branchesToRebase[:i]
 	return nil
 }
 
-func (s *state) updateTargetBranch() error {
-	if err := checkout(s.currentDir, s.targetBranch); err != nil {
-		return fmt.Errorf("checking out the target branch (dir: %s, branch: %s): %w", s.currentDir, s.targetBranch, err)
-	}
-	if err := pull(s.currentDir); err != nil {
-		return fmt.Errorf("pulling (dir: %s, branch: %s): %w", s.currentDir, s.targetBranch, err)
-	}
-
-	newSHA, err := branchToSHA(s.currentDir, s.targetBranch)
-	if err != nil {
-		return fmt.Errorf("updating the target branch (%s) commit SHA: %w", s.targetBranch, err)
-	}
-	s.branches[s.targetBranch] = newSHA
-	return nil
+// gpgSignFlag is a flag.Value for --gpg-sign, which may be given alone or with a
+// key ID.
+type gpgSignFlag struct {
+	sign  *bool
+	keyID *string
 }
 
-func (s *state) rebaseBranches() error {
-	for i, b := range s.branchesToRebase {
-		fmt.Printf("  %s [%d/%d]...\n", b, i+1, len(s.branchesToRebase))
-		if err := checkout(s.currentDir, b); err != nil {
-			return fmt.Errorf("checking out a branch (dir: %s, branch: %s): %w", s.currentDir, b, err)
-		}
-		if err := rebase(s.currentDir, s.targetBranch); err != nil {
-			return fmt.Errorf("rebasing %q onto %q (dir: %s): %w", b, s.targetBranch, s.currentDir, err)
-		}
+func (f *gpgSignFlag) String() string {
+	if f.keyID == nil {
+		return ""
 	}
-	return nil
+	return *f.keyID
 }
 
-func (s *state) restore() error {
-	for _, w := range s.worktrees {
-		if err := checkout(w.dir, w.branch); err != nil {
-			return fmt.Errorf("restoring the worktree (dir: %s, branch: %s): checking out: %w", w.dir, w.branch, err)
-		}
+func (f *gpgSignFlag) IsBoolFlag() bool { return true }
+
+func (f *gpgSignFlag) Set(v string) error {
+	switch v {
+	case "true":
+		*f.sign, *f.keyID = true, ""
+	case "false":
+		*f.sign, *f.keyID = false, ""
+	default:
+		*f.sign, *f.keyID = true, v
 	}
 	return nil
 }
 
-func trimbs(bs []byte) string { return strings.TrimSpace(string(bs)) }
+// patternsFlag is a flag.Value that collects comma-separated glob patterns.
+type patternsFlag []string
 
-func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
-	ks := make([]K, 0, len(m))
-	for k := range m {
-		ks = append(ks, k)
-	}
-	slices.Sort(ks)
-	return ks
-}
+func (f *patternsFlag) String() string { return strings.Join(*f, ",") }
 
-// contains presupposes that xs is sorted.
-func contains[K cmp.Ordered](xs []K, x K) bool {
-	_, ok := slices.BinarySearch(xs, x)
-	return ok
+func (f *patternsFlag) Set(v string) error {
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		*f = append(*f, p)
+	}
+	return nil
 }
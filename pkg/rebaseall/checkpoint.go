@@ -0,0 +1,67 @@
+package rebaseall
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// checkpointPrefix is the namespace of the lightweight tags made by
+// Options.Checkpoint, each of which is <checkpointPrefix><time>/<branch>.
+const checkpointPrefix = "refs/tags/rebase-all/checkpoint/"
+
+// checkpointTimeFormat is the format of the time in the checkpoints' tags.
+const checkpointTimeFormat = "20060102T150405Z"
+
+// checkpoint tags each branch's commit SHA before the run rewrites anything.
+// Unlike the backups, which the next run that rewrites a branch replaces, and
+// the reflogs, which expire, the tags last until they're deleted (e.g., by
+// cleanupCheckpoints).
+func (s *state) checkpoint() error {
+	stamp := s.start.UTC().Format(checkpointTimeFormat)
+	for _, b := range sortedKeys(s.originalBranches) {
+		if err := s.git.updateRef(s.currentDir, checkpointPrefix+stamp+"/"+b, s.originalBranches[b]); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(s.out, "Checkpointed %d %s as tags under %s%s/.\n", len(s.originalBranches), plural(len(s.originalBranches), "branch", "branches"), strings.TrimPrefix(checkpointPrefix, "refs/tags/"), stamp)
+	return nil
+}
+
+// cleanupCheckpoints deletes the tags of every checkpoint other than the most
+// recent Options.KeepCheckpoints.
+func cleanupCheckpoints(ctx context.Context, opts Options) error {
+	g := opts.git(ctx)
+	currentDir, err := opts.workDir()
+	if err != nil {
+		return err
+	}
+	refs, err := g.refs(currentDir, checkpointPrefix)
+	if err != nil {
+		return fmt.Errorf("listing the checkpoints: %w", err)
+	}
+
+	tags := make(map[string][]string)
+	for ref := range refs {
+		stamp, _, _ := strings.Cut(ref, "/")
+		tags[stamp] = append(tags[stamp], ref)
+	}
+	// The times sort as the checkpoints were made.
+	stamps := sortedKeys(tags)
+	slices.Reverse(stamps)
+	if len(stamps) <= opts.KeepCheckpoints {
+		fmt.Fprintf(opts.progress(), "No checkpoints were deleted, as there are %d (see --keep-checkpoints).\n", len(stamps))
+		return nil
+	}
+	for _, stamp := range stamps[opts.KeepCheckpoints:] {
+		slices.Sort(tags[stamp])
+		for _, ref := range tags[stamp] {
+			if err := g.deleteRef(currentDir, checkpointPrefix+ref); err != nil {
+				return fmt.Errorf("deleting the checkpoint %s: %w", stamp, err)
+			}
+		}
+		fmt.Fprintf(opts.progress(), "Deleted the checkpoint %s (%d %s).\n", stamp, len(tags[stamp]), plural(len(tags[stamp]), "branch", "branches"))
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package rebaseall
+
+import (
+	"io"
+	"os"
+)
+
+// These are the colours of the output as ANSI SGR parameters, so they follow
+// the terminal's theme. Each is two digits long so that coloured cells stay
+// aligned in a table.
+const (
+	colorRed     = "31"
+	colorGreen   = "32"
+	colorYellow  = "33"
+	colorDefault = "39"
+)
+
+// useColor reports whether what's written to w should be coloured under
+// Options.Color: always, never, or, with "auto", if w is a terminal, TERM isn't
+// dumb, and NO_COLOR is unset or empty.
+func (o Options) useColor(w io.Writer) bool {
+	switch o.Color {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb" && isTerminal(w)
+}
+
+// paint wraps text in the colour if on is set.
+func paint(on bool, color, text string) string {
+	if !on {
+		return text
+	}
+	return "\033[" + color + "m" + text + "\033[0m"
+}
+
+// statusColor returns the colour of a branch's status: green for a branch that
+// was updated, yellow for one that was skipped or deleted, and red for one
+// that failed.
+func statusColor(status string) string {
+	switch status {
+	case StatusRebased, StatusMerged, StatusFastForwarded:
+		return colorGreen
+	case StatusSkipped, StatusDeleted:
+		return colorYellow
+	case StatusConflicted, StatusUnverified:
+		return colorRed
+	}
+	return colorDefault
+}
@@ -0,0 +1,108 @@
+package rebaseall
+
+import (
+	"fmt"
+	"slices"
+)
+
+// collapseDuplicates removes from branchesToRebase the leaves that point at the
+// same commit as an earlier one and are to be rebased onto the same base, which
+// is rebased in their place, so that the work isn't done twice and the branches
+// don't end up at different commits; moveDuplicates then moves them to its
+// result. It's called once the bases and parents are known.
+func (s *state) collapseDuplicates() {
+	s.duplicates = make(map[string]string)
+	s.sameCommit = make(map[string]bool)
+	reps := make(map[[2]string]string)
+	kept := make(map[string][]string)
+	s.branchesToRebase = slices.DeleteFunc(s.branchesToRebase, func(b string) bool {
+		if s.actions[b] != actionLeaf {
+			return false
+		}
+		key := [2]string{s.branches[b], s.baseFor(b)}
+		rep, ok := reps[key]
+		if !ok {
+			reps[key] = b
+			kept[s.branches[b]] = append(kept[s.branches[b]], b)
+			return false
+		}
+		s.duplicates[b] = rep
+		s.filtered[b] = fmt.Sprintf("points at the same commit as %q, which is rebased in its place", rep)
+		return true
+	})
+	for _, bs := range kept {
+		if len(bs) > 1 {
+			for _, b := range bs {
+				s.sameCommit[b] = true
+			}
+		}
+	}
+}
+
+// restoreSameCommit puts the branch, and the duplicates rebased with it, back
+// at the commit at which they started if it's one of the sameCommit leaves and
+// --update-refs moved them while rebasing another of them onto a different
+// base, so that they're then rebased onto their own.
+func (s *state) restoreSameCommit(branch string) error {
+	if !s.sameCommit[branch] {
+		return nil
+	}
+	for _, b := range append([]string{branch}, s.duplicatesOf(branch)...) {
+		current, err := s.git.branchToSHA(s.currentDir, b)
+		if err != nil {
+			return fmt.Errorf("resolving %q: %w", b, err)
+		}
+		if current == s.branches[b] {
+			continue
+		}
+		if err := s.resetBranch(b, s.branches[b]); err != nil {
+			return err
+		}
+		s.verbosef("Put %q back where it was, as it was moved with a branch at the same commit with another base.", b)
+	}
+	return nil
+}
+
+// duplicatesOf returns the duplicates that are rebased in the branch's place.
+func (s *state) duplicatesOf(branch string) []string {
+	var out []string
+	for _, b := range sortedKeys(s.duplicates) {
+		if s.duplicates[b] == branch {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// moveDuplicates moves each of the branches that collapseDuplicates removed to
+// the commit to which the branch that was rebased in its place was rebased, if
+// it was, and if --update-refs didn't move it there already.
+func (s *state) moveDuplicates() error {
+	for _, b := range sortedKeys(s.duplicates) {
+		rep := s.duplicates[b]
+		if o, ok := s.outcomes[rep]; !ok || o.err != nil {
+			s.filtered[b] = fmt.Sprintf("points at the same commit as %q, which wasn't rebased", rep)
+			continue
+		}
+		sha, err := s.git.branchToSHA(s.currentDir, rep)
+		if err != nil {
+			return fmt.Errorf("resolving %q: %w", rep, err)
+		}
+		current, err := s.git.branchToSHA(s.currentDir, b)
+		if err != nil {
+			return fmt.Errorf("resolving %q: %w", b, err)
+		}
+		switch current {
+		case sha:
+		case s.branches[b]:
+			if err := s.resetBranch(b, sha); err != nil {
+				return err
+			}
+		default:
+			s.warnf("%q moved while %q was rebased in its place, so it's left alone", b, rep)
+			continue
+		}
+		s.verbosef("Moved %q with %q, which pointed at the same commit.", b, rep)
+	}
+	return nil
+}
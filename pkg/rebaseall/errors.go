@@ -0,0 +1,34 @@
+package rebaseall
+
+import (
+	"errors"
+	"fmt"
+)
+
+// These errors are wrapped by the errors that are returned so that callers can
+// distinguish the causes of failure with errors.Is.
+var (
+	ErrGitTooOld          = errors.New("the version of git is too old")
+	ErrUncommittedChanges = errors.New("there are uncommitted changes")
+	ErrTargetNotFound     = errors.New("the target branch could not be found")
+	ErrTargetDiverged     = errors.New("the target branch has diverged from its upstream")
+	ErrFetchFailed        = errors.New("the fetch failed")
+	ErrWorktreeBusy       = errors.New("a worktree has an operation in progress")
+	ErrVerificationFailed = errors.New("branches failed verification")
+	ErrShallow            = errors.New("the shallow clone lacks the history of some branches")
+	ErrLocked             = errors.New("another run holds the lock file")
+	ErrNotConfirmed       = errors.New("the run wasn't confirmed")
+)
+
+// RebaseConflictError is returned when a branch fails to rebase. The rebase will
+// have been aborted.
+type RebaseConflictError struct {
+	Branch, Onto, Dir string
+	Err               error
+}
+
+func (e *RebaseConflictError) Error() string {
+	return fmt.Sprintf("rebasing %q onto %q (dir: %s): %v", e.Branch, e.Onto, e.Dir, e.Err)
+}
+
+func (e *RebaseConflictError) Unwrap() error { return e.Err }
@@ -0,0 +1,69 @@
+package rebaseall
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// These are the kinds of Event.
+const (
+	EventStarted    = "started"
+	EventFinished   = "finished"
+	EventSkipped    = "skipped"
+	EventConflicted = "conflicted"
+	// EventFailed is for a branch that failed other than by conflicting (e.g.,
+	// as a hook failed) when rebasing in parallel.
+	EventFailed     = "failed"
+	EventUnverified = "verification-failed"
+	EventRestored   = "restored"
+)
+
+// Event is a line of the newline-delimited JSON that's written to
+// Options.Events as the run progresses, so that other programs can follow it.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// Branch is the branch that the event concerns; with EventRestored, it's
+	// what the worktree has checked out.
+	Branch string `json:"branch,omitempty"`
+	// Index counts the branches from 1 up to Total.
+	Index   int     `json:"index,omitempty"`
+	Total   int     `json:"total,omitempty"`
+	Onto    string  `json:"onto,omitempty"`
+	Dir     string  `json:"dir,omitempty"`
+	Commits int     `json:"commits,omitempty"`
+	Seconds float64 `json:"seconds,omitempty"`
+	Reason  string  `json:"reason,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// eventWriter writes the events. It's safe to use concurrently, and the zero
+// value discards them.
+type eventWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// emit writes the event, stamping it with the time. A failure to write is
+// ignored, as the events are only informative.
+func (s *state) emit(e Event) {
+	if s.opts.Events == nil {
+		return
+	}
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	if s.events.enc == nil {
+		s.events.enc = json.NewEncoder(s.opts.Events)
+	}
+	e.Time = time.Now().UTC()
+	_ = s.events.enc.Encode(e)
+}
+
+// errString returns the error's message or, if it's nil, the empty string.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,1174 @@
+package rebaseall
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Runner runs git. It's the only way in which the package touches the
+// repository other than through the files in the git directory and the user's
+// hooks (see Options.PreBranchCmd), so it can be replaced to observe or fake
+// git's behaviour.
+type Runner interface {
+	// Run runs git with the given arguments in dir (or, if dir is empty, in the
+	// current directory) and returns its combined stdout and stderr. If git exits
+	// with a non-zero status, the error should have an ExitCode method, as
+	// *exec.ExitError does. If ctx is cancelled, git should be stopped.
+	Run(ctx context.Context, dir string, args ...string) ([]byte, error)
+}
+
+// ExecRunner is a Runner that runs the git executable found on the PATH. On
+// cancellation, git is interrupted, so that it can clean up after itself, and
+// then killed if it hasn't exited within a few seconds.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Cancel = func() error {
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			return cmd.Process.Kill()
+		}
+		return nil
+	}
+	cmd.WaitDelay = 5 * time.Second
+	return cmd.CombinedOutput()
+}
+
+// git wraps a Runner with the git commands that the package needs.
+type git struct {
+	ctx    context.Context
+	runner Runner
+	// dir is the directory in which commands are run if none is given; if it's
+	// empty, then it's the current directory.
+	dir string
+	// maxOutputLines caps the number of lines of git's output that are included
+	// in errors; 0 denotes no cap.
+	maxOutputLines int
+	// log, if non-nil, is where each command is logged (see logCommand).
+	log io.Writer
+	// rebaseArgs are passed to every rebase (see Options.RebaseArgs).
+	rebaseArgs []string
+	// journal, if non-nil, is where each command is recorded for the journal.
+	journal *commandJournal
+	// noHooks denotes that git's hooks shouldn't be run (see hookCommands).
+	noHooks bool
+	// commands counts the commands run, including by the copies made by
+	// detached, for --stats.
+	commands *atomic.Int64
+	// signArg, if non-empty, is passed to every rebase and merge (see
+	// Options.signArg).
+	signArg string
+	// copyNotes denotes that rebases should copy the notes of the commits that
+	// they rewrite (see Options.CopyNotes).
+	copyNotes bool
+	// rerere denotes that rebases and merges should reuse recorded conflict
+	// resolutions (see Options.Rerere).
+	rerere bool
+}
+
+// hookCommands are the commands that run git's hooks, which Options.NoHooks
+// bypasses by pointing core.hooksPath at os.DevNull (/dev/null, or NUL on
+// Windows), which contains no hooks. git push, whose pre-push hook may guard
+// the remote, isn't among them.
+var hookCommands = []string{"checkout", "commit", "merge", "rebase", "reset", "switch", "update-ref", "worktree"}
+
+// notesRefs are the notes refs whose notes Options.CopyNotes copies.
+const notesRefs = "refs/notes/*"
+
+// pinnedSetting is a git config setting that every rebase or merge (whichever
+// its key's section names) is run with, so that the user's config can't
+// silently change what they do.
+type pinnedSetting struct {
+	key, value string
+	// isBool denotes that the key is boolean, so that its value is compared
+	// in its canonical form.
+	isBool bool
+	// why is why the setting is pinned.
+	why string
+}
+
+// pinnedSettings are the settings that the tool relies on (see checkConfig).
+var pinnedSettings = []pinnedSetting{
+	{"rebase.backend", "merge", false, "--update-refs needs the merge backend"},
+	{"rebase.updateRefs", "true", true, "branches that contain others are rebased with --update-refs"},
+	{"rebase.autoSquash", "false", true, "it would squash fixup! and squash! commits"},
+	{"rebase.rebaseMerges", "false", true, "merge commits are handled as --merges says"},
+	{"merge.ff", "true", false, "merges that can fast-forward should"},
+}
+
+// pinnedArgs returns the -c arguments that pin the settings for the command.
+func pinnedArgs(command string) []string {
+	var args []string
+	for _, p := range pinnedSettings {
+		if strings.HasPrefix(p.key, command+".") {
+			args = append(args, "-c", p.key+"="+p.value)
+		}
+	}
+	return args
+}
+
+func (g *git) run(dir string, args ...string) ([]byte, error) {
+	if dir == "" {
+		dir = g.dir
+	}
+	var command string
+	if cmd := stripConfig(args); len(cmd) > 0 {
+		command = cmd[0]
+	}
+	if command == "rebase" || command == "merge" {
+		args = append(pinnedArgs(command), args...)
+	}
+	if g.rerere && (command == "rebase" || command == "merge") {
+		args = append([]string{"-c", "rerere.enabled=true", "-c", "rerere.autoUpdate=true"}, args...)
+	}
+	if g.copyNotes && command == "rebase" {
+		// git only copies notes to the rewritten commits for the refs named
+		// by notes.rewriteRef, which has no default.
+		args = append([]string{"-c", "notes.rewrite.rebase=true", "-c", "notes.rewriteRef=" + notesRefs}, args...)
+	}
+	if g.noHooks && slices.Contains(hookCommands, command) {
+		args = append([]string{"-c", "core.hooksPath=" + os.DevNull}, args...)
+	}
+	bs, err := g.runner.Run(g.ctx, dir, args...)
+	if g.commands != nil {
+		g.commands.Add(1)
+	}
+	if g.log != nil {
+		logCommand(g.log, dir, args, bs, err)
+	}
+	if g.journal != nil {
+		g.journal.add(dir, args, err)
+	}
+	return bs, err
+}
+
+// stripConfig returns args without the leading -c options.
+func stripConfig(args []string) []string {
+	for len(args) >= 2 && args[0] == "-c" {
+		args = args[2:]
+	}
+	return args
+}
+
+// detached returns a copy of g whose commands aren't cancelled with g's
+// context, for cleaning up after a cancelled run.
+func (g *git) detached() *git {
+	d := *g
+	d.ctx = context.WithoutCancel(g.ctx)
+	return &d
+}
+
+// exitCode returns the exit status carried by err, or -1 if there's none.
+func exitCode(err error) int {
+	var coded interface{ ExitCode() int }
+	if errors.As(err, &coded) {
+		return coded.ExitCode()
+	}
+	return -1
+}
+
+// aheadBehind returns the number of commits in branch that aren't in base and
+// vice versa.
+func (g *git) aheadBehind(dir, base, branch string) (ahead, behind int, err error) {
+	bs, err := g.run(dir, "rev-list", "--left-right", "--count", branch+"..."+base)
+	if err != nil {
+		return 0, 0, fmt.Errorf("running `git rev-list`: %w (output: %s)", err, trimbs(bs))
+	}
+	if _, err := fmt.Sscanf(trimbs(bs), "%d\t%d", &ahead, &behind); err != nil {
+		return 0, 0, fmt.Errorf(`expected output from "git rev-list" in the form "<ahead>\t<behind>"; given %q`, trimbs(bs))
+	}
+	return ahead, behind, nil
+}
+
+// abortOperation runs `git <op> --abort` (e.g., `git rebase --abort`).
+func (g *git) abortOperation(dir, op string) error {
+	if bs, err := g.run(dir, op, "--abort"); err != nil {
+		return fmt.Errorf("running `git %s --abort` (dir: %s): %w (output: %s)", op, dir, err, trimbs(bs))
+	}
+	return nil
+}
+
+// truncated is like trimbs, but keeps only the last maxOutputLines lines.
+func (g *git) truncated(bs []byte) string {
+	s := trimbs(bs)
+	if g.maxOutputLines <= 0 {
+		return s
+	}
+	lines := strings.Split(s, "\n")
+	if len(lines) <= g.maxOutputLines {
+		return s
+	}
+	return "... (truncated)\n" + strings.Join(lines[len(lines)-g.maxOutputLines:], "\n")
+}
+
+// addWorktree adds a worktree at dir with a detached HEAD at rev.
+func (g *git) addWorktree(dir, path, rev string) error {
+	if bs, err := g.run(dir, "worktree", "add", "--detach", path, rev); err != nil {
+		return fmt.Errorf("running `git worktree add %s`: %w (output: %s)", path, err, g.truncated(bs))
+	}
+	return nil
+}
+
+func (g *git) branchToSHA(dir, branch string) (string, error) {
+	bs, err := g.run(dir, "rev-parse", branch)
+	if err != nil {
+		return "", fmt.Errorf("running `git rev-parse`: %w", err)
+	}
+	return trimbs(bs), nil
+}
+
+func (g *git) branches(dir string) (map[string]string, error) {
+	bs, err := g.run(dir, "branch", "--format=%(refname:short) %(objectname)")
+	if err != nil {
+		return nil, fmt.Errorf("running `git branch`: %w", err)
+	}
+
+	branches := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		branch, commitSHA, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("expected the output from `git branch` to be in the form `<branch> <commit-sha>`, but no space was found (given: %s)", line)
+		}
+		branches[branch] = commitSHA
+	}
+
+	return branches, nil
+}
+
+// branchSignatures returns the author and the committer of the tip of each
+// local branch, each in the form "Name <email>".
+func (g *git) branchSignatures(dir string) (map[string][]string, error) {
+	bs, err := g.run(dir, "for-each-ref", "--format=%(refname:short)%00%(authorname) %(authoremail)%00%(committername) %(committeremail)", "refs/heads")
+	if err != nil {
+		return nil, fmt.Errorf("running `git for-each-ref`: %w (output: %s)", err, trimbs(bs))
+	}
+
+	out := make(map[string][]string)
+	for _, line := range strings.Split(trimbs(bs), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("expected the output from `git for-each-ref` to be in the form `<branch>\\0<author>\\0<committer>` (given: %q)", line)
+		}
+		out[fields[0]] = fields[1:]
+	}
+	return out, nil
+}
+
+// branchChildren returns the set of "proper children" of the given branch; that
+// is, if two branches point to the same commit, then neither is a "proper
+// child" of the other.
+// TODO: If we relax from proper childhood to improper childhood, does that simplify things elsewhere?
+func (s *state) branchChildren(dir, branch string) ([]string, error) {
+	bs, err := s.git.run(dir, "branch", "--contains", branch, "--format=%(refname:short)")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the branches that contain the branch %q: %w", branch, err)
+	}
+
+	branchSHA, ok := s.sha(branch)
+	if !ok {
+		return nil, fmt.Errorf("unable to find the branch %q in the state: this should be unreachable", branch)
+	}
+
+	lines := strings.Split(string(bs), "\n")
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		child := strings.TrimSpace(line)
+		// The code detaches all of the HEADs and performs the git operations in
+		// that state. The command `git branch --contains master` (say) will include
+		// both master and the detached HEAD in the list. We should exclude them.
+		if child == "" || child == branch || strings.Contains(child, "HEAD detached") {
+			continue
+		}
+
+		// If the child points to the same commit SHA, then it isn't a "true" child.
+		childSHA, ok := s.branches[child]
+		if !ok {
+			return nil, fmt.Errorf("unable to find the branch %q in the state: this should be unreachable", child)
+		}
+		if childSHA == branchSHA {
+			continue
+		}
+
+		out = append(out, child)
+	}
+	return out, nil
+}
+
+func (g *git) checkout(dir, branch string) error {
+	if bs, err := g.run(dir, "checkout", branch); err != nil {
+		return fmt.Errorf("running `git checkout %s` (dir: %s): %w (output: %s)", branch, dir, err, g.truncated(bs))
+	}
+	return nil
+}
+
+// commitTime returns the committer date of the given revision.
+func (g *git) commitTime(dir, rev string) (time.Time, error) {
+	bs, err := g.run(dir, "log", "-1", "--format=%ct", rev)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("running `git log`: %w (output: %s)", err, trimbs(bs))
+	}
+	secs, err := strconv.ParseInt(trimbs(bs), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a Unix timestamp from `git log`; given %q", trimbs(bs))
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// branchCommitTimes returns the committer date of each branch's tip commit.
+func (g *git) branchCommitTimes(dir string) (map[string]time.Time, error) {
+	bs, err := g.run(dir, "for-each-ref", "--format=%(refname:short) %(committerdate:unix)", "refs/heads")
+	if err != nil {
+		return nil, fmt.Errorf("running `git for-each-ref`: %w (output: %s)", err, trimbs(bs))
+	}
+
+	out := make(map[string]time.Time)
+	for _, line := range strings.Split(trimbs(bs), "\n") {
+		branch, ts, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		secs, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a Unix timestamp from `git for-each-ref`; given %q", ts)
+		}
+		out[branch] = time.Unix(secs, 0)
+	}
+	return out, nil
+}
+
+// gitCommonDir returns the absolute path of the git directory that's shared by
+// all of the worktrees.
+func (g *git) gitCommonDir(dir string) (string, error) {
+	bs, err := g.run(dir, "rev-parse", "--path-format=absolute", "--git-common-dir")
+	if err != nil {
+		return "", fmt.Errorf("running `git rev-parse --git-common-dir`: %w (output: %s)", err, trimbs(bs))
+	}
+	return cleanPath(trimbs(bs)), nil
+}
+
+func (g *git) decapitate(dir string) error {
+	bs, err := g.run(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return fmt.Errorf("determining the commit SHA (dir: %s): %w (output: %s)", dir, err, trimbs(bs))
+	}
+
+	sha := trimbs(bs)
+	if bs, err = g.run(dir, "checkout", sha); err != nil {
+		return fmt.Errorf("detaching the HEAD (dir: %s): %w (output: %s)", dir, err, trimbs(bs))
+	}
+	return nil
+}
+
+// deleteBranch force-deletes the branch; the caller is responsible for checking
+// that nothing of value is lost.
+func (g *git) deleteBranch(dir, branch string) error {
+	if bs, err := g.run(dir, "branch", "-D", branch); err != nil {
+		return fmt.Errorf("running `git branch -D %s`: %w (output: %s)", branch, err, trimbs(bs))
+	}
+	return nil
+}
+
+func (g *git) deleteRef(dir, ref string) error {
+	if bs, err := g.run(dir, "update-ref", "-d", ref); err != nil {
+		return fmt.Errorf("running `git update-ref -d %s`: %w (output: %s)", ref, err, trimbs(bs))
+	}
+	return nil
+}
+
+// fetch runs `git fetch --prune` with the given extra arguments (see
+// Options.fetchArgs).
+func (g *git) fetch(dir string, args ...string) error {
+	if bs, err := g.run(dir, append([]string{"fetch", "--prune"}, args...)...); err != nil {
+		return fmt.Errorf("%w: running `git fetch`: %w (output: %s)", ErrFetchFailed, err, g.truncated(bs))
+	}
+	return nil
+}
+
+// fetchInto fast-forwards the branch, which mustn't be checked out, to the ref
+// src on remote with `git fetch <remote> <src>:refs/heads/<branch>`; git refuses
+// to update it if it isn't a fast-forward.
+func (g *git) fetchInto(dir, remote, src, branch string) error {
+	refspec := src + ":refs/heads/" + branch
+	if bs, err := g.run(dir, "fetch", remote, refspec); err != nil {
+		return fmt.Errorf("%w: running `git fetch %s %s`: %w (output: %s)", ErrFetchFailed, remote, refspec, err, g.truncated(bs))
+	}
+	return nil
+}
+
+// divergedBranches maps the branches that have diverged from their upstreams
+// (that is, are both ahead of and behind them) to those upstreams.
+func (g *git) divergedBranches(dir string) (map[string]string, error) {
+	bs, err := g.run(dir, "for-each-ref", "--format=%(refname:short)%00%(upstream:short)%00%(upstream:track,nobracket)", "refs/heads")
+	if err != nil {
+		return nil, fmt.Errorf("running `git for-each-ref`: %w (output: %s)", err, trimbs(bs))
+	}
+
+	diverged := make(map[string]string)
+	for _, line := range strings.Split(trimbs(bs), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) == 3 && strings.Contains(fields[2], "ahead") && strings.Contains(fields[2], "behind") {
+			diverged[fields[0]] = fields[1]
+		}
+	}
+	return diverged, nil
+}
+
+// mergeCommits returns the number of merge commits in branch that aren't in
+// base.
+func (g *git) mergeCommits(dir, base, branch string) (int, error) {
+	bs, err := g.run(dir, "rev-list", "--merges", "--count", base+".."+branch)
+	if err != nil {
+		return 0, fmt.Errorf("running `git rev-list --merges --count %s..%s`: %w (output: %s)", base, branch, err, trimbs(bs))
+	}
+	n, err := strconv.Atoi(trimbs(bs))
+	if err != nil {
+		return 0, fmt.Errorf("parsing the output of `git rev-list --merges --count %s..%s`: %w (output: %s)", base, branch, err, trimbs(bs))
+	}
+	return n, nil
+}
+
+// remoteBranches returns the remote's branches, as of its last fetch, keyed by
+// their names on the remote, with their commit SHAs.
+func (g *git) remoteBranches(dir, remote string) (map[string]string, error) {
+	prefix := "refs/remotes/" + remote + "/"
+	bs, err := g.run(dir, "for-each-ref", "--format=%(refname)%00%(objectname)", prefix)
+	if err != nil {
+		return nil, fmt.Errorf("running `git for-each-ref %s`: %w (output: %s)", prefix, err, trimbs(bs))
+	}
+
+	out := make(map[string]string)
+	for _, line := range strings.Split(trimbs(bs), "\n") {
+		ref, sha, ok := strings.Cut(line, "\x00")
+		// The remote's HEAD is a symbolic reference to one of its branches.
+		if name := strings.TrimPrefix(ref, prefix); ok && name != "HEAD" {
+			out[name] = sha
+		}
+	}
+	return out, nil
+}
+
+// trackedKey is the git config key under which trackBranch marks the branches
+// that it creates, which git removes together with the branch.
+const trackedKey = "rebaseAllTracked"
+
+// trackBranch creates the branch at remote's branch of the same name, setting
+// that as its upstream, and marks it as having been created by the tool.
+func (g *git) trackBranch(dir, remote, branch string) error {
+	ref := "refs/remotes/" + remote + "/" + branch
+	if bs, err := g.run(dir, "branch", "--track", branch, ref); err != nil {
+		return fmt.Errorf("running `git branch --track %s %s`: %w (output: %s)", branch, ref, err, trimbs(bs))
+	}
+	key := "branch." + branch + "." + trackedKey
+	if bs, err := g.run(dir, "config", key, "true"); err != nil {
+		return fmt.Errorf("running `git config %s true`: %w (output: %s)", key, err, trimbs(bs))
+	}
+	return nil
+}
+
+// trackedBranches returns the branches that trackBranch created.
+func (g *git) trackedBranches(dir string) (map[string]bool, error) {
+	// The variable's name is case-insensitive, and git prints it in lower case.
+	suffix := "." + strings.ToLower(trackedKey)
+	bs, err := g.run(dir, "config", "--type=bool", "--get-regexp", `^branch\..*\`+suffix+"$")
+	if exitCode(err) == 1 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("running `git config --get-regexp`: %w (output: %s)", err, trimbs(bs))
+	}
+	out := make(map[string]bool)
+	for _, line := range strings.Split(trimbs(bs), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		if value == "true" {
+			out[strings.TrimSuffix(strings.TrimPrefix(key, "branch."), suffix)] = true
+		}
+	}
+	return out, nil
+}
+
+// setUpstream sets the upstream of the branch (e.g., to origin/foo).
+func (g *git) setUpstream(dir, branch, upstream string) error {
+	if bs, err := g.run(dir, "branch", "--set-upstream-to="+upstream, branch); err != nil {
+		return fmt.Errorf("running `git branch --set-upstream-to=%s %s`: %w (output: %s)", upstream, branch, err, trimbs(bs))
+	}
+	return nil
+}
+
+// goneBranches returns the set of branches whose configured upstream no longer
+// exists.
+func (g *git) goneBranches(dir string) (map[string]bool, error) {
+	bs, err := g.run(dir, "for-each-ref", "--format=%(refname:short) %(upstream:track)", "refs/heads")
+	if err != nil {
+		return nil, fmt.Errorf("running `git for-each-ref`: %w (output: %s)", err, trimbs(bs))
+	}
+
+	gone := make(map[string]bool)
+	for _, line := range strings.Split(trimbs(bs), "\n") {
+		if branch, track, ok := strings.Cut(line, " "); ok && track == "[gone]" {
+			gone[branch] = true
+		}
+	}
+	return gone, nil
+}
+
+// hasMergeBase reports whether a and b have a common ancestor among the
+// commits that are present, which, in a shallow clone, they may not.
+func (g *git) hasMergeBase(dir, a, b string) (bool, error) {
+	bs, err := g.run(dir, "merge-base", a, b)
+	if exitCode(err) == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("running `git merge-base %s %s`: %w (output: %s)", a, b, err, trimbs(bs))
+	}
+	return true, nil
+}
+
+// isBare reports whether dir is in a bare repository, as opposed to in one of
+// its worktrees.
+func (g *git) isBare(dir string) (bool, error) {
+	bs, err := g.run(dir, "rev-parse", "--is-bare-repository")
+	if err != nil {
+		return false, fmt.Errorf("running `git rev-parse --is-bare-repository`: %w (output: %s)", err, trimbs(bs))
+	}
+	return trimbs(bs) == "true", nil
+}
+
+// isShallow reports whether the repository is a shallow clone.
+func (g *git) isShallow(dir string) (bool, error) {
+	bs, err := g.run(dir, "rev-parse", "--is-shallow-repository")
+	if err != nil {
+		return false, fmt.Errorf("running `git rev-parse --is-shallow-repository`: %w (output: %s)", err, trimbs(bs))
+	}
+	return trimbs(bs) == "true", nil
+}
+
+// promisorRemote returns the remote from which a partial clone (e.g., one made
+// with --filter=blob:none) fetches the objects that it lacks, or the empty
+// string if the repository isn't a partial clone.
+func (g *git) promisorRemote(dir string) (string, error) {
+	remote, err := g.configValue(dir, "extensions.partialClone")
+	if err != nil || remote != "" {
+		return remote, err
+	}
+	bs, err := g.run(dir, "config", "--get-regexp", `^remote\..*\.promisor$`)
+	if exitCode(err) == 1 {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("running `git config --get-regexp`: %w (output: %s)", err, trimbs(bs))
+	}
+	for _, line := range strings.Split(trimbs(bs), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		if value == "true" {
+			return strings.TrimSuffix(strings.TrimPrefix(key, "remote."), ".promisor"), nil
+		}
+	}
+	return "", nil
+}
+
+// missingObjects returns the objects reachable from the given revisions (e.g.,
+// main...feature) that are missing from a partial clone. Listing them doesn't
+// fetch them.
+func (g *git) missingObjects(dir string, revs ...string) ([]string, error) {
+	args := append([]string{"rev-list", "--objects", "--missing=print"}, revs...)
+	bs, err := g.run(dir, args...)
+	if err != nil {
+		return nil, fmt.Errorf("running `git rev-list --objects --missing=print`: %w (output: %s)", err, g.truncated(bs))
+	}
+	var out []string
+	for _, line := range strings.Split(trimbs(bs), "\n") {
+		if oid, ok := strings.CutPrefix(line, "?"); ok {
+			out = append(out, oid)
+		}
+	}
+	return out, nil
+}
+
+// fetchObjects fetches the given objects from the promisor remote of a partial
+// clone in one go, as git does when it prefetches the objects for a checkout.
+func (g *git) fetchObjects(dir, remote string, oids []string) error {
+	args := append([]string{"-c", "fetch.negotiationAlgorithm=noop", "fetch", remote, "--no-tags", "--no-write-fetch-head", "--recurse-submodules=no", "--filter=blob:none"}, oids...)
+	if bs, err := g.run(dir, args...); err != nil {
+		return fmt.Errorf("%w: fetching %d missing objects from %s: %w (output: %s)", ErrFetchFailed, len(oids), remote, err, g.truncated(bs))
+	}
+	return nil
+}
+
+// independent returns the set of the given commits that no other of them
+// contains.
+func (g *git) independent(dir string, shas []string) (map[string]bool, error) {
+	out := make(map[string]bool, len(shas))
+	if len(shas) == 0 {
+		return out, nil
+	}
+	bs, err := g.run(dir, append([]string{"merge-base", "--independent"}, shas...)...)
+	if err != nil {
+		return nil, fmt.Errorf("running `git merge-base --independent`: %w (output: %s)", err, g.truncated(bs))
+	}
+	for _, sha := range strings.Fields(string(bs)) {
+		out[sha] = true
+	}
+	return out, nil
+}
+
+// isAncestor reports whether ancestor is an ancestor of (or the same commit as)
+// descendant.
+func (g *git) isAncestor(dir, ancestor, descendant string) (bool, error) {
+	bs, err := g.run(dir, "merge-base", "--is-ancestor", ancestor, descendant)
+	if exitCode(err) == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("running `git merge-base --is-ancestor %s %s`: %w (output: %s)", ancestor, descendant, err, trimbs(bs))
+	}
+	return true, nil
+}
+
+// merge merges rev into the checked-out branch, handling a failure as rebase
+// does.
+func (g *git) merge(dir, rev string, abort bool) error {
+	return g.runOperation(dir, "merge", rev, abort, append(g.operationArgs("--no-edit"), rev)...)
+}
+
+// operationArgs returns args together with the arguments common to every
+// rebase and merge.
+func (g *git) operationArgs(args ...string) []string {
+	if g.signArg != "" {
+		args = append(args, g.signArg)
+	}
+	return args
+}
+
+// unsignedCommits returns the number of commits in the range given by args
+// (e.g., base..branch) that have no signature. Only the signature's presence is
+// checked, as git can't verify every signature (e.g., an SSH signature without
+// gpg.ssh.allowedSignersFile).
+func (g *git) unsignedCommits(dir string, args ...string) (int, error) {
+	bs, err := g.run(dir, append([]string{"log", "--pretty=raw"}, args...)...)
+	if err != nil {
+		return 0, fmt.Errorf("running `git log --pretty=raw %s`: %w (output: %s)", strings.Join(args, " "), err, trimbs(bs))
+	}
+
+	// Each commit starts with a "commit <sha>" line and its headers, which
+	// include gpgsig (or gpgsig-sha256) if it's signed; the message's lines are
+	// indented.
+	n, signed := 0, true
+	for _, line := range strings.Split(string(bs), "\n") {
+		switch {
+		case strings.HasPrefix(line, "commit "):
+			if !signed {
+				n++
+			}
+			signed = false
+		case strings.HasPrefix(line, "gpgsig"):
+			signed = true
+		}
+	}
+	if !signed {
+		n++
+	}
+	return n, nil
+}
+
+// mergeTreeConflicts merges branch and base in memory, touching neither the
+// index nor the work tree, and returns the files that conflict, if any.
+func (g *git) mergeTreeConflicts(dir, base, branch string) ([]string, error) {
+	bs, err := g.run(dir, "merge-tree", "--write-tree", "--name-only", "--no-messages", base, branch)
+	if exitCode(err) == 1 {
+		// The first line is the tree that was written and the rest are the
+		// conflicted files.
+		lines := strings.Split(trimbs(bs), "\n")
+		return slices.Compact(lines[1:]), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("running `git merge-tree %s %s`: %w (output: %s)", base, branch, err, trimbs(bs))
+	}
+	return nil, nil
+}
+
+// mergedBranches returns the branches whose tips are reachable from the target.
+func (g *git) mergedBranches(dir, target string) ([]string, error) {
+	bs, err := g.run(dir, "branch", "--merged", target, "--format=%(refname:short)")
+	if err != nil {
+		return nil, fmt.Errorf("running `git branch --merged %s`: %w (output: %s)", target, err, trimbs(bs))
+	}
+	return slices.DeleteFunc(strings.Split(trimbs(bs), "\n"), func(s string) bool {
+		return s == "" || strings.Contains(s, "HEAD detached")
+	}), nil
+}
+
+// branchesBetween returns the branches that tip contains and base doesn't,
+// which are those that rebasing tip onto base with --update-refs moves.
+func (g *git) branchesBetween(dir, base, tip string) ([]string, error) {
+	bs, err := g.run(dir, "branch", "--merged", tip, "--no-merged", base, "--format=%(refname:short)")
+	if err != nil {
+		return nil, fmt.Errorf("running `git branch --merged %s --no-merged %s`: %w (output: %s)", tip, base, err, trimbs(bs))
+	}
+	return slices.DeleteFunc(strings.Split(trimbs(bs), "\n"), func(s string) bool {
+		return s == "" || strings.Contains(s, "HEAD detached")
+	}), nil
+}
+
+// operations returns the operations in progress in the given worktree, as
+// inProgress does, and also any bisection, together with the branch that the
+// rebase or bisection was started on, if any.
+func (g *git) operations(dir string) (ops []string, branch string, err error) {
+	if ops, err = g.inProgress(dir); err != nil {
+		return nil, "", err
+	}
+	bs, err := g.run(dir, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return nil, "", fmt.Errorf("running `git rev-parse --absolute-git-dir` (dir: %s): %w (output: %s)", dir, err, trimbs(bs))
+	}
+	gitDir := cleanPath(trimbs(bs))
+	if _, err := os.Stat(filepath.Join(gitDir, "BISECT_LOG")); err == nil {
+		ops = append(ops, "bisect")
+	}
+	for _, file := range []string{"rebase-merge/head-name", "rebase-apply/head-name", "BISECT_START"} {
+		if bs, err := os.ReadFile(filepath.Join(gitDir, filepath.FromSlash(file))); err == nil {
+			branch = strings.TrimPrefix(trimbs(bs), "refs/heads/")
+			break
+		}
+	}
+	return ops, branch, nil
+}
+
+// fastForward fast-forwards the checked-out branch to rev, failing if that
+// isn't possible.
+func (g *git) fastForward(dir, rev string) error {
+	if bs, err := g.run(dir, "merge", "--ff-only", rev); err != nil {
+		return fmt.Errorf("running `git merge --ff-only %s`: %w (output: %s)", rev, err, g.truncated(bs))
+	}
+	return nil
+}
+
+// resetHard resets the checked-out branch, the index, and the work tree to rev.
+func (g *git) resetHard(dir, rev string) error {
+	if bs, err := g.run(dir, "reset", "--hard", rev); err != nil {
+		return fmt.Errorf("running `git reset --hard %s`: %w (output: %s)", rev, err, g.truncated(bs))
+	}
+	return nil
+}
+
+// inProgress returns the operations (rebase, merge, cherry-pick, or revert) that
+// are in progress in the given worktree.
+func (g *git) inProgress(dir string) ([]string, error) {
+	bs, err := g.run(dir, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return nil, fmt.Errorf("running `git rev-parse --absolute-git-dir` (dir: %s): %w (output: %s)", dir, err, trimbs(bs))
+	}
+
+	gitDir := cleanPath(trimbs(bs))
+	markers := []struct{ op, file string }{
+		{"rebase", "rebase-merge"},
+		{"rebase", "rebase-apply"},
+		{"merge", "MERGE_HEAD"},
+		{"cherry-pick", "CHERRY_PICK_HEAD"},
+		{"revert", "REVERT_HEAD"},
+	}
+	var ops []string
+	for _, m := range markers {
+		if _, err := os.Stat(filepath.Join(gitDir, m.file)); err == nil && !slices.Contains(ops, m.op) {
+			ops = append(ops, m.op)
+		}
+	}
+	return ops, nil
+}
+
+// push force-pushes the branch to the remote provided that the remote's branch
+// is still at expectedSHA.
+func (g *git) push(dir, remote, branch, expectedSHA string) error {
+	ref := "refs/heads/" + branch
+	if bs, err := g.run(dir, "push", "--porcelain", "--force-with-lease="+ref+":"+expectedSHA, remote, ref+":"+ref); err != nil {
+		return fmt.Errorf("running `git push %s %s`: %w (output: %s)", remote, branch, err, g.truncated(bs))
+	}
+	return nil
+}
+
+// pushNew pushes the branch to the remote, where it mustn't already exist, and
+// sets its upstream to it.
+func (g *git) pushNew(dir, remote, branch string) error {
+	ref := "refs/heads/" + branch
+	if bs, err := g.run(dir, "push", "--porcelain", "--set-upstream", "--force-with-lease="+ref+":", remote, ref+":"+ref); err != nil {
+		return fmt.Errorf("running `git push --set-upstream %s %s`: %w (output: %s)", remote, branch, err, g.truncated(bs))
+	}
+	return nil
+}
+
+// pruneRemote runs `git remote prune` for the given remote and returns the
+// remote-tracking references that were deleted.
+func (g *git) pruneRemote(dir, remote string) ([]string, error) {
+	bs, err := g.run(dir, "remote", "prune", remote)
+	if err != nil {
+		return nil, fmt.Errorf("running `git remote prune %s`: %w (output: %s)", remote, err, trimbs(bs))
+	}
+
+	// The output is in the form " * [pruned] origin/foo" for each deleted ref.
+	var out []string
+	for _, line := range strings.Split(string(bs), "\n") {
+		if _, ref, ok := strings.Cut(line, "[pruned] "); ok {
+			out = append(out, strings.TrimSpace(ref))
+		}
+	}
+	return out, nil
+}
+
+// rebase rebases the checked-out branch onto targetBranch, passing extra after
+// Options.RebaseArgs. If the rebase fails, then it's aborted if abort is true
+// and left in place otherwise.
+func (g *git) rebase(dir, targetBranch string, abort bool, extra ...string) error {
+	// The --update-refs flag permits us to restrict our interest to the leaves.
+	args := append(append(g.operationArgs("--update-refs"), g.rebaseArgs...), extra...)
+	return g.runOperation(dir, "rebase", targetBranch, abort, append(args, targetBranch)...)
+}
+
+// rebaseOnto rebases the commits of the checked-out branch that aren't in
+// upstream onto onto, handling a failure as rebase does.
+func (g *git) rebaseOnto(dir, onto, upstream string, abort bool, extra ...string) error {
+	args := append(append(g.operationArgs("--update-refs"), g.rebaseArgs...), extra...)
+	return g.runOperation(dir, "rebase", onto, abort, append(args, "--onto", onto, upstream)...)
+}
+
+// runOperation runs `git <op>` (a rebase or a merge) with the given arguments.
+// If it fails, then it's aborted if abort is true and left in place otherwise.
+func (g *git) runOperation(dir, op, onto string, abort bool, args ...string) error {
+	bs, err := g.run(dir, append([]string{op}, args...)...)
+	if err != nil && g.rerere {
+		bs, err = g.continueResolved(dir, op, bs, err)
+	}
+	if err == nil {
+		return nil
+	}
+
+	// If the above fails, we should abort the operation. A cancelled operation
+	// is always aborted.
+	output := g.truncated(bs)
+	err = fmt.Errorf("failed to %s %q (output: %s): %w", op, onto, output, err)
+	if !abort && g.ctx.Err() == nil {
+		return err
+	}
+	d := g.detached()
+	if g.ctx.Err() != nil {
+		// git may have been stopped before the operation started.
+		if ops, opsErr := d.inProgress(dir); opsErr == nil && !slices.Contains(ops, op) {
+			return err
+		}
+	}
+
+	abortBs, abortErr := d.run(dir, op, "--abort")
+	if abortErr == nil {
+		return fmt.Errorf("%w; successfully aborted", err)
+	}
+
+	abortOutput := g.truncated(abortBs)
+	abortErr = fmt.Errorf("failed to abort the %s: %w (output: %s)", op, abortErr, abortOutput)
+	return fmt.Errorf("%w; %w", err, abortErr)
+}
+
+// continueResolved continues the operation (a rebase or a merge) in dir for as
+// long as it stops on conflicts that rerere resolved in full, returning the
+// output and error of the last attempt. That's decided from the state of the
+// worktree rather than from git's output, which may be translated: the
+// operation must still be in progress with no unmerged paths, and each attempt
+// must make progress, which a stop for another reason doesn't.
+func (g *git) continueResolved(dir, op string, bs []byte, err error) ([]byte, error) {
+	for err != nil && g.ctx.Err() == nil {
+		ops, oerr := g.inProgress(dir)
+		if oerr != nil || !slices.Contains(ops, op) {
+			break
+		}
+		unmerged, uerr := g.unmergedPaths(dir)
+		if uerr != nil || len(unmerged) > 0 {
+			break
+		}
+		head, herr := g.resolve(dir, "HEAD")
+		if herr != nil {
+			break
+		}
+		// The editor would otherwise be opened for the commit message.
+		bs, err = g.run(dir, "-c", "core.editor=true", op, "--continue")
+		if err == nil {
+			break
+		}
+		if next, herr := g.resolve(dir, "HEAD"); herr != nil || next == head {
+			break
+		}
+	}
+	return bs, err
+}
+
+// unmergedPaths returns the paths with unresolved conflicts in dir.
+func (g *git) unmergedPaths(dir string) ([]string, error) {
+	bs, err := g.run(dir, "diff", "--name-only", "--diff-filter=U")
+	if err != nil {
+		return nil, fmt.Errorf("running `git diff --name-only --diff-filter=U`: %w (output: %s)", err, g.truncated(bs))
+	}
+	return strings.Fields(trimbs(bs)), nil
+}
+
+// refs returns the references under the prefix (e.g., refs/heads/), keyed by
+// their names with the prefix removed, together with their commit SHAs.
+func (g *git) refs(dir, prefix string) (map[string]string, error) {
+	bs, err := g.run(dir, "for-each-ref", "--format=%(refname) %(objectname)", prefix)
+	if err != nil {
+		return nil, fmt.Errorf("running `git for-each-ref %s`: %w (output: %s)", prefix, err, trimbs(bs))
+	}
+
+	refs := make(map[string]string)
+	for _, line := range strings.Split(trimbs(bs), "\n") {
+		if ref, sha, ok := strings.Cut(line, " "); ok {
+			refs[strings.TrimPrefix(ref, prefix)] = sha
+		}
+	}
+	return refs, nil
+}
+
+// removeWorktree removes the worktree at path, discarding any changes in it.
+func (g *git) removeWorktree(dir, path string) error {
+	if bs, err := g.run(dir, "worktree", "remove", "--force", path); err != nil {
+		return fmt.Errorf("running `git worktree remove %s`: %w (output: %s)", path, err, g.truncated(bs))
+	}
+	return nil
+}
+
+// resolve returns the commit SHA of the revision, or the empty string if the
+// revision doesn't exist.
+func (g *git) resolve(dir, rev string) (string, error) {
+	bs, err := g.run(dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if exitCode(err) == 1 {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("running `git rev-parse --verify %s`: %w (output: %s)", rev, err, trimbs(bs))
+	}
+	return trimbs(bs), nil
+}
+
+func (g *git) remotes(dir string) ([]string, error) {
+	bs, err := g.run(dir, "remote")
+	if err != nil {
+		return nil, fmt.Errorf("running `git remote`: %w (output: %s)", err, trimbs(bs))
+	}
+	return slices.DeleteFunc(strings.Split(trimbs(bs), "\n"), func(s string) bool { return s == "" }), nil
+}
+
+// remoteHead returns the remote-tracking branch to which the remote's HEAD
+// points (e.g., origin/main), or the empty string if it has none.
+func (g *git) remoteHead(dir, remote string) (string, error) {
+	bs, err := g.run(dir, "symbolic-ref", "--quiet", "--short", "refs/remotes/"+remote+"/HEAD")
+	if exitCode(err) == 1 {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("running `git symbolic-ref refs/remotes/%s/HEAD`: %w (output: %s)", remote, err, trimbs(bs))
+	}
+	return trimbs(bs), nil
+}
+
+// remoteURL returns the URL of the remote.
+func (g *git) remoteURL(dir, remote string) (string, error) {
+	bs, err := g.run(dir, "remote", "get-url", remote)
+	if err != nil {
+		return "", fmt.Errorf("running `git remote get-url %s`: %w (output: %s)", remote, err, trimbs(bs))
+	}
+	return trimbs(bs), nil
+}
+
+// updateRef points the reference at the commit SHA, creating it if need be.
+func (g *git) updateRef(dir, ref, sha string) error {
+	if bs, err := g.run(dir, "update-ref", ref, sha); err != nil {
+		return fmt.Errorf("running `git update-ref %s %s`: %w (output: %s)", ref, sha, err, trimbs(bs))
+	}
+	return nil
+}
+
+// upstream returns the upstream of the given branch (e.g., origin/main) as
+// configured by branch.<branch>.remote and branch.<branch>.merge. It returns the
+// empty string if the branch has no upstream.
+func (g *git) upstream(dir, branch string) (string, error) {
+	remote, merge, err := g.upstreamConfig(dir, branch)
+	if err != nil || remote == "" || merge == "" {
+		return "", err
+	}
+
+	name := strings.TrimPrefix(merge, "refs/heads/")
+	// A remote of "." denotes a local branch.
+	if remote == "." {
+		return name, nil
+	}
+	return remote + "/" + name, nil
+}
+
+// upstreamConfig returns branch.<branch>.remote and branch.<branch>.merge, which
+// are empty if they aren't set.
+func (g *git) upstreamConfig(dir, branch string) (remote, merge string, err error) {
+	if remote, err = g.configValue(dir, "branch."+branch+".remote"); err != nil {
+		return "", "", err
+	}
+	if merge, err = g.configValue(dir, "branch."+branch+".merge"); err != nil {
+		return "", "", err
+	}
+	return remote, merge, nil
+}
+
+// configValue returns the value of the given git config key, or the empty
+// string if it isn't set.
+func (g *git) configValue(dir, key string) (string, error) {
+	return g.getConfig(dir, "--get", key)
+}
+
+// configBool returns the value of the given boolean git config key, or false if
+// it isn't set.
+func (g *git) configBool(dir, key string) (bool, error) {
+	v, err := g.getConfig(dir, "--type=bool", "--get", key)
+	return v == "true", err
+}
+
+func (g *git) getConfig(dir string, args ...string) (string, error) {
+	bs, err := g.run(dir, append([]string{"config"}, args...)...)
+	// git config exits with status 1 if the key isn't set.
+	if exitCode(err) == 1 {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("running `git config %s`: %w (output: %s)", strings.Join(args, " "), err, trimbs(bs))
+	}
+	return trimbs(bs), nil
+}
+
+func (g *git) status(dir string) ([]string, error) {
+	bs, err := g.run(dir, "status", "--porcelain=v1")
+	if err != nil {
+		return nil, fmt.Errorf("running `git status`: %w", err)
+	}
+
+	ss := strings.Split(trimbs(bs), "\n")
+	return slices.DeleteFunc(ss, func(s string) bool { return s == "" || strings.HasPrefix(s, "??") }), nil
+}
+
+// toplevel returns the top-level directory of the worktree containing dir.
+func (g *git) toplevel(dir string) (string, error) {
+	bs, err := g.run(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", fmt.Errorf("running `git rev-parse --show-toplevel`: %w (output: %s)", err, trimbs(bs))
+	}
+	return cleanPath(trimbs(bs)), nil
+}
+
+func (g *git) writeCommitGraph(dir string) error {
+	if bs, err := g.run(dir, "commit-graph", "write", "--reachable"); err != nil {
+		return fmt.Errorf("running `git commit-graph write`: %w (output: %s)", err, g.truncated(bs))
+	}
+	return nil
+}
+
+// worktreeDirs returns the directory of every worktree, irrespective of what
+// each has checked out.
+func (g *git) worktreeDirs() ([]string, error) {
+	bs, err := g.run("", "worktree", "list", "--porcelain", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("running `git worktree list`: %w (output: %s)", err, trimbs(bs))
+	}
+
+	var out []string
+	for _, line := range strings.Split(string(bs), "\x00") {
+		if dir, ok := strings.CutPrefix(line, "worktree "); ok {
+			out = append(out, cleanPath(dir))
+		}
+	}
+	return out, nil
+}
+
+// worktrees returns the set of worktrees, each of which has either a branch or,
+// if its HEAD is detached, a commit checked out.
+//
+// With -z, each attribute of a worktree is terminated by a NUL and each
+// worktree by a further NUL, so the paths are taken verbatim, whatever they
+// contain.
+func (g *git) worktrees() ([]worktree, error) {
+	bs, err := g.run("", "worktree", "list", "--porcelain", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("running `git worktree list`: %w (output: %s)", err, trimbs(bs))
+	}
+
+	var out []worktree
+	for _, record := range strings.Split(string(bs), "\x00\x00") {
+		if record = strings.Trim(record, "\x00"); record == "" {
+			continue
+		}
+
+		var w worktree
+		var bare, detached bool
+		for _, line := range strings.Split(record, "\x00") {
+			if dir, ok := strings.CutPrefix(line, "worktree "); ok {
+				w.dir = cleanPath(dir)
+			} else if branch, ok := strings.CutPrefix(line, "branch refs/heads/"); ok {
+				w.branch = branch
+			} else if head, ok := strings.CutPrefix(line, "HEAD "); ok {
+				w.head = head
+			} else if line == "detached" {
+				detached = true
+			} else if line == "bare" {
+				bare = true
+			} else if line == "locked" || strings.HasPrefix(line, "locked ") {
+				w.locked = true
+			} else if line == "prunable" || strings.HasPrefix(line, "prunable ") {
+				w.prunable = true
+			}
+		}
+		// A bare repository is listed first but has no work tree to restore.
+		if bare {
+			continue
+		}
+		if w.dir == "" {
+			return nil, fmt.Errorf(`expected a line in the form "worktree <dir>" (output: %s)`, strings.ReplaceAll(record, "\x00", "\n"))
+		}
+		if w.branch == "" && !detached {
+			return nil, fmt.Errorf(`expected a line in the form "branch refs/heads/<branch>" or "detached" (dir: %s, output: %s)`, w.dir, strings.ReplaceAll(record, "\x00", "\n"))
+		}
+		if w.branch == "" && w.head == "" {
+			return nil, fmt.Errorf(`expected a line in the form "HEAD <sha>" (dir: %s, output: %s)`, w.dir, strings.ReplaceAll(record, "\x00", "\n"))
+		}
+		w.sha = w.head
+		if w.branch != "" {
+			// Only a detached worktree is restored to its commit by default.
+			w.head = ""
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+// cleanPath converts a path printed by git, which uses forward slashes even on
+// Windows, to the operating system's form.
+func cleanPath(p string) string { return filepath.Clean(filepath.FromSlash(p)) }
+
+// samePath reports whether the paths are the same; on Windows, paths are
+// compared case-insensitively.
+func samePath(a, b string) bool {
+	a, b = cleanPath(a), cleanPath(b)
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
@@ -0,0 +1,77 @@
+package rebaseall
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// BenchmarkBranchChildren measures the ancestry queries that a run makes, one
+// `git branch --contains` per branch, against a long history with and without
+// the commit-graph that --refresh-commit-graph writes.
+func BenchmarkBranchChildren(b *testing.B) {
+	if _, err := exec.LookPath("git"); err != nil {
+		b.Skip("git isn't installed")
+	}
+	for _, graph := range []bool{false, true} {
+		b.Run(fmt.Sprintf("commit-graph=%t", graph), func(b *testing.B) {
+			dir := longHistory(b, 10000, 20)
+			g := Options{}.withDefaults().git(context.Background())
+			branches, err := g.branches(dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			s := &state{git: g, branches: branches}
+			if graph {
+				if err := g.writeCommitGraph(dir); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, branch := range sortedKeys(s.branches) {
+					if _, err := s.branchChildren(dir, branch); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// longHistory creates a repository whose main branch has the given number of
+// commits, with the given number of branches forking from it at intervals along
+// it, each with a commit of its own, and no commit-graph.
+func longHistory(tb testing.TB, commits, branches int) string {
+	tb.Helper()
+	dir := tb.TempDir()
+	var stream strings.Builder
+	for i := 1; i <= commits; i++ {
+		fmt.Fprintf(&stream, "commit refs/heads/main\nmark :%d\ncommitter t <t@t.invalid> %d +0000\ndata 2\n%d\n", i, 1700000000+i, i%10)
+		if i > 1 {
+			fmt.Fprintf(&stream, "from :%d\n", i-1)
+		}
+	}
+	for j := 1; j <= branches; j++ {
+		fmt.Fprintf(&stream, "commit refs/heads/branch-%d\ncommitter t <t@t.invalid> %d +0000\ndata 2\nb\nfrom :%d\n", j, 1700000000+commits+j, j*commits/(branches+1))
+	}
+	for _, args := range [][]string{{"init", "--quiet", "--initial-branch=main", dir}, {"-C", dir, "fast-import", "--quiet"}} {
+		cmd := exec.Command("git", args...)
+		if args[0] == "-C" {
+			cmd.Stdin = strings.NewReader(stream.String())
+		}
+		if bs, err := cmd.CombinedOutput(); err != nil {
+			tb.Fatalf("running `git %s`: %v (output: %s)", strings.Join(args, " "), err, bs)
+		}
+	}
+	for _, path := range []string{"objects/info/commit-graph", "objects/info/commit-graphs"} {
+		if err := os.RemoveAll(filepath.Join(dir, ".git", path)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return dir
+}
@@ -0,0 +1,51 @@
+package rebaseall
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// printAnnotations prints the summary, sum, of the run as GitHub Actions
+// workflow commands, which the run of a workflow shows as annotations: an error
+// for each branch that conflicted or failed verification, for each worktree
+// that wasn't restored, and for the run's error; a warning for each branch that
+// was skipped for a reason; and a notice that counts the branches by status.
+func printAnnotations(w io.Writer, sum Summary) {
+	for _, r := range sum.Branches {
+		switch {
+		case r.Status == StatusConflicted:
+			annotate(w, "error", "Conflicted: "+r.Branch, fmt.Sprintf("%s conflicted when updating it onto %s: %s", r.Branch, sum.Onto, r.Error))
+		case r.Status == StatusUnverified:
+			annotate(w, "error", "Failed verification: "+r.Branch, fmt.Sprintf("%s failed verification and was rolled back: %s", r.Branch, r.Error))
+		case r.Status == StatusSkipped && r.Reason != "":
+			annotate(w, "warning", "Skipped: "+r.Branch, fmt.Sprintf("%s was skipped: %s", r.Branch, r.Reason))
+		}
+	}
+	for _, wt := range sum.Worktrees {
+		if !wt.Restored {
+			annotate(w, "error", "Not restored: "+wt.Dir, wt.Error)
+		}
+	}
+	if sum.Error != "" {
+		annotate(w, "error", "git-rebase-all failed", sum.Error)
+	}
+	annotate(w, "notice", "git-rebase-all", fmt.Sprintf("Updated the branches onto %s: %s.", sum.Onto, statusCounts(sum)))
+}
+
+// annotate prints a workflow command, escaping its title and message.
+func annotate(w io.Writer, level, title, message string) {
+	fmt.Fprintf(w, "::%s title=%s::%s\n", level, escapeProperty(title), escapeData(message))
+}
+
+// escapeData escapes a workflow command's message as the Actions runner
+// expects.
+func escapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeProperty escapes a workflow command's property (e.g., its title),
+// which, unlike its message, mustn't contain unescaped colons or commas.
+func escapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
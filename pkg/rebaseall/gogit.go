@@ -0,0 +1,277 @@
+package rebaseall
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	commitgraphfmt "github.com/go-git/go-git/v5/plumbing/format/commitgraph/v2"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/object/commitgraph"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// GoGitRunner is an experimental Runner that answers the read-only commands
+// that a run makes many times over (listing the branches that contain, or are
+// merged into, a commit, and finding merge bases) in process with go-git
+// rather than by starting git. Every other command, and any that go-git fails
+// to answer (e.g., in a shallow clone), is passed to Fallback.
+//
+// The repositories that it opens are dropped whenever a command is passed to
+// Fallback, as the command may have written objects or packs that go-git
+// hasn't seen.
+type GoGitRunner struct {
+	Fallback Runner
+
+	mu    sync.Mutex
+	repos map[string]*goGitRepo
+}
+
+// goGitRepo is a repository opened by GoGitRunner. Its index reads the
+// commit-graph, if there is one, so that walks can be cut short by the
+// commits' generation numbers.
+type goGitRepo struct {
+	repo  *gogit.Repository
+	graph commitgraphfmt.Index
+	index commitgraph.CommitNodeIndex
+}
+
+// goGitExitError is the error of a command answered by GoGitRunner that "exits"
+// with a non-zero status.
+type goGitExitError int
+
+func (e goGitExitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+func (e goGitExitError) ExitCode() int { return int(e) }
+
+func (r *GoGitRunner) Run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	if ctx.Err() == nil {
+		r.mu.Lock()
+		bs, status, ok := r.answer(dir, args)
+		r.mu.Unlock()
+		if ok && status != 0 {
+			return bs, goGitExitError(status)
+		}
+		if ok {
+			return bs, nil
+		}
+	}
+	r.mu.Lock()
+	for _, g := range r.repos {
+		if g.graph != nil {
+			g.graph.Close()
+		}
+	}
+	r.repos = nil
+	r.mu.Unlock()
+	return r.Fallback.Run(ctx, dir, args...)
+}
+
+// answer answers the command with go-git, returning its output and exit status,
+// or reports that it can't.
+func (r *GoGitRunner) answer(dir string, args []string) ([]byte, int, bool) {
+	var err error
+	var bs []byte
+	status := 0
+	switch {
+	case len(args) == 4 && args[0] == "merge-base" && args[1] == "--is-ancestor":
+		var ok bool
+		if ok, err = r.isAncestor(dir, args[2], args[3]); err == nil && !ok {
+			status = 1
+		}
+	case len(args) == 3 && args[0] == "merge-base" && !strings.HasPrefix(args[1], "-") && !strings.HasPrefix(args[2], "-"):
+		if bs, err = r.mergeBase(dir, args[1], args[2]); err == nil && bs == nil {
+			status = 1
+		}
+	case len(args) == 4 && args[0] == "branch" && args[1] == "--contains" && args[3] == "--format=%(refname:short)":
+		bs, err = r.branchesReaching(dir, args[2], true)
+	case len(args) == 4 && args[0] == "branch" && args[1] == "--merged" && args[3] == "--format=%(refname:short)":
+		bs, err = r.branchesReaching(dir, args[2], false)
+	default:
+		return nil, 0, false
+	}
+	if err != nil {
+		return nil, 0, false
+	}
+	return bs, status, true
+}
+
+// open returns the repository containing dir, opening it if need be.
+func (r *GoGitRunner) open(dir string) (*goGitRepo, error) {
+	if g, ok := r.repos[dir]; ok {
+		return g, nil
+	}
+	repo, err := gogit.PlainOpenWithOptions(dir, &gogit.PlainOpenOptions{DetectDotGit: true, EnableDotGitCommonDir: true})
+	if err != nil {
+		return nil, err
+	}
+	// Without a commit-graph, the walks fall back to the commits themselves.
+	var graph commitgraphfmt.Index
+	if fs, ok := repo.Storer.(*filesystem.Storage); ok {
+		graph, _ = commitgraphfmt.OpenChainOrFileIndex(fs.Filesystem())
+	}
+	g := &goGitRepo{repo: repo, graph: graph, index: commitgraph.NewGraphCommitNodeIndex(graph, repo.Storer)}
+	if r.repos == nil {
+		r.repos = make(map[string]*goGitRepo)
+	}
+	r.repos[dir] = g
+	return g, nil
+}
+
+func (r *GoGitRunner) isAncestor(dir, ancestor, descendant string) (bool, error) {
+	g, err := r.open(dir)
+	if err != nil {
+		return false, err
+	}
+	a, err := g.resolve(ancestor)
+	if err != nil {
+		return false, err
+	}
+	d, err := g.resolve(descendant)
+	if err != nil {
+		return false, err
+	}
+	return g.reaches(d, a, nil)
+}
+
+// mergeBase returns the output of `git merge-base a b`, which is nil if there's
+// no merge base.
+func (r *GoGitRunner) mergeBase(dir, a, b string) ([]byte, error) {
+	g, err := r.open(dir)
+	if err != nil {
+		return nil, err
+	}
+	var commits []*object.Commit
+	for _, rev := range []string{a, b} {
+		h, err := g.resolve(rev)
+		if err != nil {
+			return nil, err
+		}
+		c, err := g.repo.CommitObject(h)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, c)
+	}
+	bases, err := commits[0].MergeBase(commits[1])
+	if err != nil || len(bases) == 0 {
+		return nil, err
+	}
+	return []byte(bases[0].Hash.String() + "\n"), nil
+}
+
+// branchesReaching returns the output of `git branch --contains rev` if
+// contains is true, or of `git branch --merged rev` if it's false, in the form
+// given by --format=%(refname:short).
+func (r *GoGitRunner) branchesReaching(dir, rev string, contains bool) ([]byte, error) {
+	g, err := r.open(dir)
+	if err != nil {
+		return nil, err
+	}
+	h, err := g.resolve(rev)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := g.repo.Branches()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	// The walks from the branches to rev share the commits that can't reach it.
+	cannot := make(map[plumbing.Hash]bool)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		var ok bool
+		var err error
+		if contains {
+			ok, err = g.reaches(ref.Hash(), h, cannot)
+		} else {
+			ok, err = g.reaches(h, ref.Hash(), nil)
+		}
+		if ok {
+			names = append(names, ref.Name().Short())
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(name + "\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// resolve returns the commit to which rev points, peeling any tag. As with
+// git, a reference takes precedence over a commit SHA. Anything else (e.g., an
+// abbreviated SHA or main~2) is left to git.
+func (g *goGitRepo) resolve(rev string) (plumbing.Hash, error) {
+	var h plumbing.Hash
+	for _, name := range []string{rev, "refs/" + rev, "refs/tags/" + rev, "refs/heads/" + rev, "refs/remotes/" + rev, "refs/remotes/" + rev + "/HEAD"} {
+		if ref, err := g.repo.Reference(plumbing.ReferenceName(name), true); err == nil {
+			h = ref.Hash()
+			break
+		}
+	}
+	if h.IsZero() {
+		if !plumbing.IsHash(rev) {
+			return plumbing.ZeroHash, fmt.Errorf("unable to resolve %q", rev)
+		}
+		h = plumbing.NewHash(rev)
+	}
+	if tag, err := g.repo.TagObject(h); err == nil {
+		c, err := tag.Commit()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		return c.Hash, nil
+	}
+	return h, nil
+}
+
+// reaches reports whether target is from or one of its ancestors. It skips the
+// commits whose generation numbers are lower than target's, which can't reach
+// it, and the commits in cannot, to which it adds those that it finds can't.
+func (g *goGitRepo) reaches(from, target plumbing.Hash, cannot map[plumbing.Hash]bool) (bool, error) {
+	t, err := g.index.Get(target)
+	if err != nil {
+		return false, err
+	}
+	seen := make(map[plumbing.Hash]bool)
+	stack := []plumbing.Hash{from}
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if h == target {
+			return true, nil
+		}
+		if seen[h] || cannot[h] {
+			continue
+		}
+		seen[h] = true
+		n, err := g.index.Get(h)
+		if err != nil {
+			return false, err
+		}
+		// A generation of 0 was written by old versions of git, and tells
+		// nothing.
+		if gen := n.Generation(); gen != 0 && gen < t.Generation() {
+			continue
+		}
+		stack = append(stack, n.ParentHashes()...)
+	}
+	if cannot != nil {
+		for h := range seen {
+			cannot[h] = true
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,154 @@
+package rebaseall
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// graphNode is a branch in the graph printed by --graph.
+type graphNode struct {
+	name, sha string
+	// status describes what a run would do with the branch and, if nothing,
+	// why not.
+	status   string
+	children []string
+}
+
+// graph prints the branches as a forest rooted at the target, each branch
+// beneath the nearest branch that it contains, together with what a run would
+// do with it; this shows why each branch was or wasn't selected. Like
+// --dry-run, it's against the local state of the repository and nothing is
+// fetched or mutated.
+func (s *state) graph() error {
+	if err := s.buildPlan(); err != nil {
+		return err
+	}
+	nodes, err := s.graphNodes()
+	if err != nil {
+		return err
+	}
+	if s.opts.Graph == "dot" {
+		writeDOT(s.opts.Stdout, s.targetBranch, nodes)
+		return nil
+	}
+	writeASCIIGraph(s.opts.Stdout, s.targetBranch, nodes)
+	return nil
+}
+
+// graphNodes returns the nodes of the graph keyed by branch. A branch's parent
+// is the nearest branch that it contains, the target if there's none, and the
+// target for those merged into it.
+func (s *state) graphNodes() (map[string]*graphNode, error) {
+	targetSHA, _ := s.sha(s.targetBranch)
+	nodes := map[string]*graphNode{s.targetBranch: {name: s.targetBranch, sha: targetSHA, status: "target"}}
+	merged := make(map[string]bool, len(s.branches))
+	children := make(map[string][]string, len(s.branches))
+	for _, b := range sortedKeys(s.branches) {
+		if b == s.targetBranch {
+			continue
+		}
+		ok, err := s.git.isAncestor(s.currentDir, b, s.targetBranch)
+		if err != nil {
+			return nil, fmt.Errorf("checking whether %q is merged into %q: %w", b, s.targetBranch, err)
+		}
+		merged[b] = ok
+		if !ok {
+			if children[b], err = s.branchChildren(s.currentDir, b); err != nil {
+				return nil, err
+			}
+		}
+		nodes[b] = &graphNode{name: b, sha: s.branches[b]}
+	}
+
+	for _, b := range sortedKeys(merged) {
+		parent := s.targetBranch
+		if !merged[b] {
+			var candidates []string
+			for _, p := range sortedKeys(children) {
+				if slices.Contains(children[p], b) {
+					candidates = append(candidates, p)
+				}
+			}
+			// The nearest candidate is the one that contains no other.
+			for _, p := range candidates {
+				if !slices.ContainsFunc(candidates, func(q string) bool { return slices.Contains(children[p], q) }) {
+					parent = p
+					break
+				}
+			}
+		}
+		nodes[parent].children = append(nodes[parent].children, b)
+		nodes[b].status = s.graphStatus(b, merged[b], len(children[b]) == 0)
+	}
+	return nodes, nil
+}
+
+// graphStatus describes what a run would do with the branch.
+func (s *state) graphStatus(branch string, merged, leaf bool) string {
+	if reason, ok := s.filtered[branch]; ok {
+		return "skipped: " + reason
+	}
+	if slices.Contains(s.branchesToRebase, branch) {
+		switch a := s.actions[branch]; {
+		case a == actionFastForward:
+			return "fast-forward"
+		case s.parents[branch] != "":
+			return "rebase onto " + s.parents[branch]
+		case a == actionStacked:
+			return "rebase"
+		}
+		return "rebase (leaf)"
+	}
+	switch {
+	case merged:
+		return "merged into the target"
+	case leaf:
+		return "up to date with the target"
+	}
+	return "not a leaf: moved with the branches that contain it"
+}
+
+// writeASCIIGraph writes the graph as an indented tree.
+func writeASCIIGraph(w io.Writer, root string, nodes map[string]*graphNode) {
+	var walk func(name, prefix, childPrefix string)
+	walk = func(name, prefix, childPrefix string) {
+		n := nodes[name]
+		fmt.Fprintf(w, "%s%s (%s) [%s]\n", prefix, n.name, shortSHA(n.sha), n.status)
+		for i, c := range n.children {
+			if i == len(n.children)-1 {
+				walk(c, childPrefix+"`-- ", childPrefix+"    ")
+			} else {
+				walk(c, childPrefix+"|-- ", childPrefix+"|   ")
+			}
+		}
+	}
+	walk(root, "", "")
+}
+
+// writeDOT writes the graph in Graphviz's DOT language, with an edge from each
+// branch to those that contain it. The target is drawn as a box and the
+// branches that a run would update are filled.
+func writeDOT(w io.Writer, root string, nodes map[string]*graphNode) {
+	fmt.Fprintln(w, "digraph branches {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [shape=ellipse];")
+	for _, name := range sortedKeys(nodes) {
+		n := nodes[name]
+		attrs := fmt.Sprintf("label=%q", fmt.Sprintf("%s\n%s\n%s", n.name, shortSHA(n.sha), n.status))
+		switch {
+		case name == root:
+			attrs += ", shape=box"
+		case strings.HasPrefix(n.status, "rebase") || n.status == "fast-forward":
+			attrs += ", style=filled"
+		}
+		fmt.Fprintf(w, "  %q [%s];\n", name, attrs)
+	}
+	for _, name := range sortedKeys(nodes) {
+		for _, c := range nodes[name].children {
+			fmt.Fprintf(w, "  %q -> %q;\n", name, c)
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
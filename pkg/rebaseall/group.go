@@ -0,0 +1,78 @@
+package rebaseall
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// GroupResult counts the branches of a group (see Options.GroupByPrefix) by
+// their status.
+type GroupResult struct {
+	// Prefix is the group's prefix (e.g., user/alice/), which is empty for the
+	// branches without one.
+	Prefix   string         `json:"prefix"`
+	Branches int            `json:"branches"`
+	Statuses map[string]int `json:"statuses"`
+}
+
+// groupOf returns the group of the branch: its name up to and including its
+// last slash (e.g., user/alice/ for user/alice/foo), or the empty string if it
+// has none.
+func groupOf(branch string) string {
+	return branch[:strings.LastIndex(branch, "/")+1]
+}
+
+// inGroup reports whether the branch is in the named group (see Options.Groups)
+// or in a group nested in it.
+func inGroup(group, branch string) bool {
+	return strings.HasPrefix(branch, strings.TrimSuffix(group, "/")+"/")
+}
+
+// groupLabel returns how the group with the prefix is printed.
+func groupLabel(prefix string) string {
+	if prefix == "" {
+		return "(no prefix)"
+	}
+	return prefix
+}
+
+// groupBy returns the groups of the items, whose branches are given by name,
+// in sorted order, together with the items in each of them, in their original
+// order.
+func groupBy[T any](items []T, name func(T) string) ([]string, map[string][]T) {
+	grouped := make(map[string][]T)
+	for _, item := range items {
+		g := groupOf(name(item))
+		grouped[g] = append(grouped[g], item)
+	}
+	return sortedKeys(grouped), grouped
+}
+
+// groupResults counts the branches of each group by their status.
+func groupResults(branches []BranchResult) []GroupResult {
+	prefixes, grouped := groupBy(branches, func(r BranchResult) string { return r.Branch })
+	gs := make([]GroupResult, 0, len(prefixes))
+	for _, p := range prefixes {
+		g := GroupResult{Prefix: p, Branches: len(grouped[p]), Statuses: make(map[string]int)}
+		for _, r := range grouped[p] {
+			g.Statuses[r.Status]++
+		}
+		gs = append(gs, g)
+	}
+	return gs
+}
+
+// printGroupHeader prints the line that introduces a group of n branches, with
+// their counts by status, if any.
+func printGroupHeader(w io.Writer, prefix string, n int, statuses map[string]int) {
+	counts := make([]string, 0, len(statuses))
+	for _, st := range sortedKeys(statuses) {
+		counts = append(counts, fmt.Sprintf("%d %s", statuses[st], st))
+	}
+	line := fmt.Sprintf("  %s: %d %s", groupLabel(prefix), n, plural(n, "branch", "branches"))
+	if len(counts) > 0 {
+		line += " (" + strings.Join(counts, ", ") + ")"
+	}
+	fmt.Fprintln(w, line)
+}
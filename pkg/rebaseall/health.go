@@ -0,0 +1,62 @@
+package rebaseall
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+)
+
+// health prints, for each branch, how far it is ahead of and behind the target,
+// the age of its last commit, whether its upstream is gone, and whether it's a
+// leaf. It performs no writes beyond fetching.
+func (s *state) health() error {
+	// The upstream is the freshest view of the target as we don't pull.
+	base := s.targetBranch
+	if s.targetUpstream != "" {
+		base = s.targetUpstream
+	}
+
+	gone, err := s.git.goneBranches(s.currentDir)
+	if err != nil {
+		return fmt.Errorf("listing the branches whose upstream is gone: %w", err)
+	}
+
+	now := time.Now()
+	fmt.Fprintf(s.opts.Stdout, "Compared against %s.\n\n", base)
+	tw := tabwriter.NewWriter(s.opts.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BRANCH\tAHEAD\tBEHIND\tAGE\tUPSTREAM GONE\tLEAF")
+	for _, b := range sortedKeys(s.branches) {
+		ahead, behind, err := s.git.aheadBehind(s.currentDir, base, b)
+		if err != nil {
+			return fmt.Errorf("counting the commits between %q and %q: %w", base, b, err)
+		}
+		t, err := s.git.commitTime(s.currentDir, b)
+		if err != nil {
+			return fmt.Errorf("determining the time of the last commit (branch: %s): %w", b, err)
+		}
+		children, err := s.branchChildren(s.currentDir, b)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\n", b, ahead, behind, formatAge(now.Sub(t)), yesNo(gone[b]), yesNo(len(children) == 0))
+	}
+	return tw.Flush()
+}
+
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
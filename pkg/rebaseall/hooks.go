@@ -0,0 +1,55 @@
+package rebaseall
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// runHook runs the shell command, if there is one, in dir, where the branch is
+// checked out. The command's environment describes the branch with these
+// variables:
+//
+//   - REBASE_ALL_BRANCH: the branch
+//   - REBASE_ALL_TARGET: the target branch
+//   - REBASE_ALL_ONTO: what the branch is (or was) rebased onto
+//   - REBASE_ALL_SHA: the branch's commit SHA
+//   - REBASE_ALL_DIR: dir
+//
+// The command's output is written as progress is.
+func (s *state) runHook(name, command, dir, branch, onto string) error {
+	if command == "" {
+		return nil
+	}
+	sha, err := s.git.resolve(dir, branch)
+	if err != nil {
+		return fmt.Errorf("resolving %q for the %s command: %w", branch, name, err)
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(s.git.ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(s.git.ctx, "sh", "-c", command)
+	}
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"REBASE_ALL_BRANCH="+branch,
+		"REBASE_ALL_TARGET="+s.targetBranch,
+		"REBASE_ALL_ONTO="+onto,
+		"REBASE_ALL_SHA="+sha,
+		"REBASE_ALL_DIR="+dir,
+	)
+	cmd.Stdout = s.out
+	cmd.Stderr = s.out
+	if s.out == io.Discard {
+		cmd.Stderr = s.opts.Stderr
+	}
+	s.verbosef("  %s: running the %s command.", branch, name)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running the %s command for %q (dir: %s): %w", name, branch, dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package rebaseall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Journal is the record of a run that's kept in the git directory, under
+// rebase-all/, so that the runs can be audited (see Options.Log). Its summary
+// gives each branch's old and new commit SHAs and what was done to it.
+type Journal struct {
+	Start    time.Time        `json:"start"`
+	Dir      string           `json:"dir"`
+	Summary  Summary          `json:"summary"`
+	Commands []JournalCommand `json:"commands"`
+}
+
+// JournalCommand is a git command that a run ran.
+type JournalCommand struct {
+	Dir   string   `json:"dir"`
+	Args  []string `json:"args"`
+	Error string   `json:"error,omitempty"`
+}
+
+// commandJournal collects the git commands that are run. It's safe to use
+// concurrently.
+type commandJournal struct {
+	mu       sync.Mutex
+	commands []JournalCommand
+}
+
+func (j *commandJournal) add(dir string, args []string, err error) {
+	c := JournalCommand{Dir: dir, Args: args}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.commands = append(j.commands, c)
+}
+
+// journalDir returns the directory in which the journals are kept.
+func journalDir(g *git, dir string) (string, error) {
+	commonDir, err := g.gitCommonDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("locating the git directory: %w", err)
+	}
+	return filepath.Join(commonDir, "rebase-all"), nil
+}
+
+// writeJournal writes the journal of the run, whose summary is sum, to
+// journal-<start>.json. A failure to write it is only warned about.
+func (s *state) writeJournal(sum Summary) {
+	dir, err := journalDir(s.git.detached(), s.currentDir)
+	if err != nil {
+		s.warnf("writing the journal: %v", err)
+		return
+	}
+	j := Journal{Start: s.start, Dir: s.currentDir, Summary: sum}
+	s.git.journal.mu.Lock()
+	j.Commands = slices.Clone(s.git.journal.commands)
+	s.git.journal.mu.Unlock()
+
+	bs, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		s.warnf("encoding the journal: %v", err)
+		return
+	}
+	path := filepath.Join(dir, "journal-"+s.start.UTC().Format("20060102T150405.000Z")+".json")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		s.warnf("writing the journal: %v", err)
+		return
+	}
+	if err := os.WriteFile(path, append(bs, '\n'), 0o644); err != nil {
+		s.warnf("writing the journal: %v", err)
+		return
+	}
+	s.verbosef("Wrote the journal to %s.", path)
+}
+
+// printLog prints a line for each prior run, oldest first, from its journal.
+func printLog(ctx context.Context, opts Options) error {
+	g := opts.git(ctx)
+	dir, err := journalDir(g, "")
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return errors.New("there are no journals; they're written by each run")
+	}
+	if err != nil {
+		return fmt.Errorf("listing the journals (dir: %s): %w", dir, err)
+	}
+
+	tw := tabwriter.NewWriter(opts.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "START\tSECONDS\tTARGET\tRESULT\tBRANCHES\tJOURNAL")
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "journal-") || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading the journal: %w", err)
+		}
+		var j Journal
+		if err := json.Unmarshal(bs, &j); err != nil {
+			return fmt.Errorf("parsing the journal (path: %s): %w", path, err)
+		}
+		result := "ok"
+		if j.Summary.Error != "" {
+			result = "failed"
+		}
+		fmt.Fprintf(tw, "%s\t%.1f\t%s\t%s\t%s\t%s\n", j.Start.Local().Format(time.DateTime), j.Summary.Seconds, j.Summary.Target, result, statusCounts(j.Summary), path)
+	}
+	return tw.Flush()
+}
+
+// lastJournal returns the journal of the latest run, or nil if there's none.
+func lastJournal(dir string) (*Journal, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing the journals (dir: %s): %w", dir, err)
+	}
+	// The names sort by the runs' start times.
+	for i := len(entries) - 1; i >= 0; i-- {
+		name := entries[i].Name()
+		if !strings.HasPrefix(name, "journal-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading the journal: %w", err)
+		}
+		var j Journal
+		if err := json.Unmarshal(bs, &j); err != nil {
+			return nil, fmt.Errorf("parsing the journal (path: %s): %w", path, err)
+		}
+		return &j, nil
+	}
+	return nil, nil
+}
+
+// statusCounts describes how many branches had each status (e.g., "2 rebased,
+// 1 conflicted"), leaving out those that were skipped or unchanged.
+func statusCounts(sum Summary) string {
+	counts := make(map[string]int)
+	for _, r := range sum.Branches {
+		if r.Status != StatusSkipped && r.Status != StatusUnchanged && r.Status != StatusUpToDate {
+			counts[r.Status]++
+		}
+	}
+	if len(counts) == 0 {
+		return "-"
+	}
+	var parts []string
+	for _, status := range sortedKeys(counts) {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[status], status))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,129 @@
+package rebaseall
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockFileName is the name of the lock file in the journals' directory.
+const lockFileName = "run.lock"
+
+// lockHolder is the process recorded in the lock file.
+type lockHolder struct {
+	pid   int
+	since time.Time
+}
+
+func (h lockHolder) String() string {
+	if h.since.IsZero() {
+		return fmt.Sprintf("pid: %d", h.pid)
+	}
+	return fmt.Sprintf("pid: %d, since: %s", h.pid, h.since.Local().Format(time.DateTime))
+}
+
+// stale reports whether the process that holds the lock has exited, which can
+// only be told on Unix.
+func (h lockHolder) stale() bool {
+	if runtime.GOOS == "windows" || h.pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(h.pid)
+	if err != nil {
+		return true
+	}
+	// Signal 0 checks that the process exists without signalling it.
+	err = p.Signal(syscall.Signal(0))
+	return errors.Is(err, os.ErrProcessDone) || errors.Is(err, syscall.ESRCH)
+}
+
+// lockPath returns the path of the lock file, rebase-all/run.lock in the git
+// directory, which is shared by the worktrees.
+func lockPath(g *git) (string, error) {
+	dir, err := journalDir(g, "")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, lockFileName), nil
+}
+
+// lock takes the lock file, which records the process that holds it and when it
+// took it, so that runs in the same repository don't race on checkouts. It
+// returns ErrLocked if another process holds it, and otherwise a function that
+// releases it.
+func lock(g *git) (unlock func() error, err error) {
+	path, err := lockPath(g)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("creating the directory for the lock file: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		h, _ := readLock(path)
+		hint := "if no run is active, rerun with --force-unlock"
+		if h.stale() {
+			hint = "the process has exited, so the lock is stale; rerun with --force-unlock"
+		}
+		return nil, fmt.Errorf("%w (path: %s, %s); %s", ErrLocked, path, h, hint)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating the lock file: %w", err)
+	}
+	_, err = fmt.Fprintf(f, "%d\n%s\n", os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+	if err = errors.Join(err, f.Close()); err != nil {
+		return nil, errors.Join(fmt.Errorf("writing the lock file: %w", err), os.Remove(path))
+	}
+	return func() error { return os.Remove(path) }, nil
+}
+
+// locked calls f while holding the lock file.
+func locked(g *git, f func() error) (err error) {
+	unlock, err := lock(g)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.Join(err, unlock()) }()
+	return f()
+}
+
+// readLock reads the process recorded in the lock file at path. A lock file
+// written by an older version records only the pid.
+func readLock(path string) (lockHolder, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return lockHolder{}, err
+	}
+	pid, since, _ := strings.Cut(strings.TrimSpace(string(bs)), "\n")
+	var h lockHolder
+	if h.pid, err = strconv.Atoi(strings.TrimSpace(pid)); err != nil {
+		return lockHolder{}, fmt.Errorf("parsing the lock file (path: %s): %w", path, err)
+	}
+	h.since, _ = time.Parse(time.RFC3339, strings.TrimSpace(since))
+	return h, nil
+}
+
+// forceUnlock removes the lock file, if there is one, as --force-unlock does
+// for a lock left behind by a run that was killed.
+func forceUnlock(g *git) (removed bool, err error) {
+	path, err := lockPath(g)
+	if err != nil {
+		return false, err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("removing the lock file: %w", err)
+	}
+	return true, nil
+}
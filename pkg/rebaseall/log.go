@@ -0,0 +1,51 @@
+package rebaseall
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Verbosity is how much a run prints as it goes.
+type Verbosity int
+
+// These are the levels of verbosity. Quiet prints nothing but errors and any
+// summary; Debug also prints every git command together with its directory and
+// output.
+const (
+	VerbosityQuiet Verbosity = iota - 1
+	VerbosityNormal
+	VerbosityVerbose
+	VerbosityDebug
+)
+
+// verbosef writes to s.out if the verbosity is at least VerbosityVerbose.
+func (s *state) verbosef(format string, args ...any) {
+	if s.opts.Verbosity >= VerbosityVerbose {
+		fmt.Fprintf(s.out, format+"\n", args...)
+	}
+}
+
+// logCommand writes the git command, the directory in which it was run, and
+// its output to w.
+func logCommand(w io.Writer, dir string, args []string, bs []byte, err error) {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = a
+		if a == "" || strings.ContainsAny(a, " \t\n\"'\\") {
+			quoted[i] = strconv.Quote(a)
+		}
+	}
+	if dir == "" {
+		dir = "."
+	}
+	fmt.Fprintf(w, "+ git %s (dir: %s)\n", strings.Join(quoted, " "), dir)
+	// The output of commands run with -z is NUL-separated.
+	if s := strings.TrimSpace(strings.ReplaceAll(string(bs), "\x00", "\n")); s != "" {
+		fmt.Fprintf(w, "  %s\n", strings.ReplaceAll(s, "\n", "\n  "))
+	}
+	if err != nil {
+		fmt.Fprintf(w, "  (error: %v)\n", err)
+	}
+}
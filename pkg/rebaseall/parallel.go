@@ -0,0 +1,246 @@
+package rebaseall
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rebaseBranchesInParallel rebases the branches concurrently, each in one of
+// s.opts.Jobs temporary worktrees. Branches that could interfere with one
+// another are rebased one after the other (see interferenceGroups). A conflict
+// is handled as Options.OnConflict says, as in the sequential run, other than
+// that a group stops at its first failure.
+func (s *state) rebaseBranchesInParallel() (err error) {
+	groups, err := s.interferenceGroups()
+	if err != nil {
+		return fmt.Errorf("partitioning the branches: %w", err)
+	}
+
+	// The target branch is checked out in the current directory after being
+	// updated; no branch may remain checked out if the temporary worktrees are to
+	// check them out.
+	if err := s.git.decapitate(s.currentDir); err != nil {
+		return fmt.Errorf("detaching the HEAD (dir: %s): %w", s.currentDir, err)
+	}
+
+	base := s.base()
+	dirs := make([]string, 0, s.opts.Jobs)
+	defer func() {
+		for _, dir := range dirs {
+			err = errors.Join(err, s.git.detached().removeWorktree(s.currentDir, dir))
+		}
+	}()
+	for i := 0; i < min(s.opts.Jobs, len(groups)); i++ {
+		dir, err := os.MkdirTemp("", "git-rebase-all-")
+		if err != nil {
+			return fmt.Errorf("creating a temporary directory: %w", err)
+		}
+		if err := s.git.addWorktree(s.currentDir, dir, base); err != nil {
+			return errors.Join(fmt.Errorf("adding a temporary worktree: %w", err), os.Remove(dir))
+		}
+		dirs = append(dirs, dir)
+	}
+
+	queue := make(chan []string, len(groups))
+	for _, g := range groups {
+		queue <- g
+	}
+	close(queue)
+
+	// mu guards errs, stopped, s.skipped, s.filtered, and the progress. A
+	// failure that isn't skipped under --on-conflict=skip sets stopped, after
+	// which no worker starts another branch, as the sequential run would stop.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	var stopped bool
+	p := s.newProgress()
+	for _, dir := range dirs {
+		wg.Add(1)
+		go func(dir string) {
+			defer wg.Done()
+			for g := range queue {
+				// The branches of a group after one that fails are left alone, as
+				// they share the branches that its --update-refs rebase would
+				// have moved.
+				var failed string
+				for _, b := range g {
+					mu.Lock()
+					stop := stopped
+					mu.Unlock()
+					if stop || s.git.ctx.Err() != nil {
+						break
+					}
+					base := s.baseFor(b)
+					if failed != "" {
+						reason := fmt.Sprintf("it shares a branch with %s, which failed to rebase", failed)
+						mu.Lock()
+						p.colorf(colorYellow, "  %s: skipping as %s.", b, reason)
+						p.skip()
+						s.filtered[b] = reason
+						s.emit(Event{Event: EventSkipped, Branch: b, Index: p.done, Total: p.total, Reason: reason})
+						mu.Unlock()
+						continue
+					}
+					s.emit(Event{Event: EventStarted, Branch: b, Total: p.total, Onto: base, Dir: dir})
+					err := s.restoreSameCommit(b)
+					var upToDate, ff bool
+					if err == nil {
+						upToDate, err = s.upToDate(b, base)
+					}
+					if err == nil && !upToDate {
+						ff, err = s.fastForwardable(b, base)
+					}
+					var commits int
+					if err == nil && !upToDate && !ff {
+						commits, err = s.commitsToUpdate(dir, b, base)
+					}
+					start := time.Now()
+					switch {
+					case err != nil || upToDate:
+					case ff:
+						commits, err = s.fastForwardRef(b, base)
+					default:
+						err = s.rebaseIn(dir, b, base)
+					}
+					d := time.Since(start)
+					mu.Lock()
+					label := fmt.Sprintf("%s [%d/%d]", b, p.done+1, p.total)
+					switch {
+					case err != nil:
+						failed = b
+						event := EventFailed
+						conflict := (*RebaseConflictError)(nil)
+						if errors.As(err, &conflict) {
+							event = EventConflicted
+						}
+						if conflict != nil && s.opts.OnConflict == "skip" {
+							p.colorf(colorRed, "  %s conflicted; skipping.", label)
+							s.skipped = append(s.skipped, err)
+						} else {
+							p.colorf(colorRed, "  %s: failed.", label)
+							errs = append(errs, err)
+							stopped = true
+						}
+						p.skip()
+						s.emit(Event{Event: event, Branch: b, Index: p.done, Total: p.total, Onto: base, Dir: dir, Error: err.Error()})
+					case upToDate:
+						p.printf("  %s: up to date.", label)
+						p.skip()
+						s.emit(Event{Event: EventSkipped, Branch: b, Index: p.done, Total: p.total, Reason: "up to date"})
+					case ff:
+						p.finishAs(StatusFastForwarded, label, commits, d)
+						s.emit(Event{Event: EventFinished, Branch: b, Index: p.done, Total: p.total, Onto: base, Dir: s.currentDir, Commits: commits, Seconds: d.Seconds()})
+					default:
+						p.finish(label, commits, d)
+						s.emit(Event{Event: EventFinished, Branch: b, Index: p.done, Total: p.total, Onto: base, Dir: dir, Commits: commits, Seconds: d.Seconds()})
+					}
+					mu.Unlock()
+				}
+			}
+		}(dir)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// rebaseIn rebases the branch in dir and then detaches the HEAD so that the
+// branch is free to be checked out elsewhere.
+func (s *state) rebaseIn(dir, branch, base string) error {
+	if err := s.git.checkout(dir, branch); err != nil {
+		return fmt.Errorf("checking out a branch (dir: %s, branch: %s): %w", dir, branch, err)
+	}
+	if err := s.runHook("pre-branch", s.opts.PreBranchCmd, dir, branch, base); err != nil {
+		return err
+	}
+	if err := s.backup(); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := s.git.rebase(dir, base, true, s.rebaseArgsFor(branch)...)
+	s.record(branch, err, time.Since(start))
+	if err != nil {
+		// The rebase was aborted; the branch is let go of so that the worktree
+		// is free for the next.
+		err = &RebaseConflictError{Branch: branch, Onto: base, Dir: dir, Err: err}
+		if derr := s.git.decapitate(dir); derr != nil {
+			return errors.Join(err, fmt.Errorf("detaching the HEAD (dir: %s): %w", dir, derr))
+		}
+		return err
+	}
+	if err := s.runHook("post-branch", s.opts.PostBranchCmd, dir, branch, base); err != nil {
+		return err
+	}
+	if err := s.git.decapitate(dir); err != nil {
+		return fmt.Errorf("detaching the HEAD (dir: %s): %w", dir, err)
+	}
+	return nil
+}
+
+// interferenceGroups partitions the branches to rebase into groups that can be
+// rebased concurrently with one another.
+//
+// Rebasing a branch with --update-refs also moves every branch that it contains
+// that isn't already reachable from the target. Two such rebases interfere if
+// they could move the same branch. For each branch X that isn't reachable from
+// the target, the branches to rebase that contain X (and X itself) are merged
+// into a single group. The groups are then the connected components, and the
+// branches within each group keep their relative order.
+func (s *state) interferenceGroups() ([][]string, error) {
+	parent := make(map[string]string, len(s.branchesToRebase))
+	for _, b := range s.branchesToRebase {
+		parent[b] = b
+	}
+	var find func(string) string
+	find = func(b string) string {
+		if parent[b] != b {
+			parent[b] = find(parent[b])
+		}
+		return parent[b]
+	}
+
+	targetSHA, _ := s.sha(s.targetBranch)
+	for _, x := range sortedKeys(s.branches) {
+		if x == s.targetBranch || s.branches[x] == targetSHA {
+			continue
+		}
+		children, err := s.branchChildren(s.currentDir, x)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(children, s.targetBranch) {
+			continue
+		}
+
+		var members []string
+		if _, ok := parent[x]; ok {
+			members = append(members, x)
+		}
+		for _, c := range children {
+			if _, ok := parent[c]; ok {
+				members = append(members, c)
+			}
+		}
+		for _, m := range members[min(1, len(members)):] {
+			parent[find(m)] = find(members[0])
+		}
+	}
+
+	var groups [][]string
+	index := make(map[string]int)
+	for _, b := range s.branchesToRebase {
+		root := find(b)
+		i, ok := index[root]
+		if !ok {
+			i = len(groups)
+			index[root] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], b)
+	}
+	return groups, nil
+}
@@ -0,0 +1,93 @@
+package rebaseall
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestInterferenceGroups(t *testing.T) {
+	f := newTestFixture(t)
+	// a and b share the intermediate branch x, so rebasing either moves x; c
+	// shares nothing with them.
+	if err := errors.Join(
+		f.branch("x", "main", "x"),
+		f.branch("a", "x", "a"),
+		f.branch("b", "x", "b"),
+		f.branch("c", "main", "c"),
+	); err != nil {
+		t.Fatalf("creating the branches: %v", err)
+	}
+	s, err := newState(context.Background(), Options{Dir: f.work, Runner: f.runner, TargetBranch: "main"}.withDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.branchesToRebase = []string{"a", "c", "b"}
+	groups, err := s.interferenceGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"a", "b"}, {"c"}}; !reflect.DeepEqual(groups, want) {
+		t.Fatalf("expected the groups %v, got %v", want, groups)
+	}
+}
+
+func TestRebaseBranchesInParallelConflict(t *testing.T) {
+	// a conflicts with main and shares x with b, so b is in its group; c is in
+	// a group of its own.
+	build := func(f *fixture) error {
+		return errors.Join(
+			f.branch("x", "main", "x"),
+			f.branch("a", "x", "upstream"),
+			f.branch("b", "x", "b"),
+			f.branch("c", "main", "c"),
+			f.advance("upstream", "upstream\n"),
+		)
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		f := newTestFixture(t)
+		if err := build(f); err != nil {
+			t.Fatalf("creating the branches: %v", err)
+		}
+		x, _ := f.output(f.work, "rev-parse", "x")
+		sum, err := Execute(context.Background(), Options{Dir: f.work, Runner: f.runner, Jobs: 2, OnConflict: "skip", Stdout: io.Discard, Stderr: io.Discard, Yes: true})
+		var conflict *RebaseConflictError
+		if !errors.As(err, &conflict) || conflict.Branch != "a" {
+			t.Fatalf("expected a to conflict, but the run returned %v", err)
+		}
+		if err := wantStatuses(sum, map[string]string{"a": StatusConflicted, "b": StatusSkipped, "c": StatusRebased}); err != nil {
+			t.Fatal(err)
+		}
+		if after, _ := f.output(f.work, "rev-parse", "x"); after != x {
+			t.Fatalf("x, which a and b share, was moved (before: %s, after: %s)", x, after)
+		}
+		if err := f.restored(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		f := newTestFixture(t)
+		if err := build(f); err != nil {
+			t.Fatalf("creating the branches: %v", err)
+		}
+		b, _ := f.output(f.work, "rev-parse", "b")
+		sum, err := Execute(context.Background(), Options{Dir: f.work, Runner: f.runner, Jobs: 2, Stdout: io.Discard, Stderr: io.Discard, Yes: true})
+		var conflict *RebaseConflictError
+		if !errors.As(err, &conflict) || conflict.Branch != "a" {
+			t.Fatalf("expected a to conflict, but the run returned %v", err)
+		}
+		if err := wantStatuses(sum, map[string]string{"a": StatusConflicted, "b": StatusSkipped}); err != nil {
+			t.Fatal(err)
+		}
+		if after, _ := f.output(f.work, "rev-parse", "b"); after != b {
+			t.Fatalf("b was rebased after a conflicted (before: %s, after: %s)", b, after)
+		}
+		if err := f.restored(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
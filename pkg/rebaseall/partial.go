@@ -0,0 +1,60 @@
+package rebaseall
+
+import (
+	"fmt"
+	"time"
+)
+
+// prefetchBatch caps the number of objects fetched by each command when
+// prefetching, to keep the command lines short.
+const prefetchBatch = 1000
+
+// prefetch fetches, in a partial clone, the objects missing from the history
+// that the planned rebases replay and the history of their bases since the
+// branches forked from them, in batches. Otherwise, each rebase would fetch the
+// blobs that it needs one at a time, which can make a run appear to hang. It
+// does nothing with --offline.
+func (s *state) prefetch() error {
+	if s.opts.Offline {
+		return nil
+	}
+	remote, err := s.git.promisorRemote(s.currentDir)
+	if err != nil {
+		return err
+	}
+	if remote == "" {
+		return nil
+	}
+
+	var revs []string
+	for _, b := range s.branchesToRebase {
+		if b != s.targetBranch && s.actions[b] != actionFastForward {
+			revs = append(revs, s.baseFor(b)+"..."+b)
+		}
+	}
+	if len(revs) == 0 {
+		return nil
+	}
+	missing, err := s.git.missingObjects(s.currentDir, revs...)
+	if err != nil {
+		return fmt.Errorf("listing the missing objects: %w", err)
+	}
+	if len(missing) == 0 {
+		s.verbosef("The partial clone has every object that the rebases need.")
+		return nil
+	}
+
+	fmt.Fprintf(s.out, "Prefetching %d missing %s from %s for the partial clone...\n", len(missing), plural(len(missing), "object", "objects"), remote)
+	start := time.Now()
+	for i := 0; i < len(missing); i += prefetchBatch {
+		batch := missing[i:min(i+prefetchBatch, len(missing))]
+		if err := s.git.fetchObjects(s.currentDir, remote, batch); err != nil {
+			return err
+		}
+		if len(missing) > prefetchBatch {
+			fmt.Fprintf(s.out, "  %d/%d.\n", i+len(batch), len(missing))
+		}
+	}
+	s.verbosef("Prefetched in %s.", time.Since(start).Round(time.Millisecond))
+	return nil
+}
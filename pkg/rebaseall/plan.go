@@ -0,0 +1,373 @@
+package rebaseall
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// PlanResult records the target and the branches to rebase onto it, together
+// with the commit SHAs of the branches at the time at which the plan was made.
+// It's what --dump-plan writes and --load-plan reads.
+type PlanResult struct {
+	Target    string `json:"target"`
+	TargetSHA string `json:"target_sha"`
+	Upstream  string `json:"upstream,omitempty"`
+	Onto      string `json:"onto"`
+	// Detach lists the worktrees whose HEADs are to be detached.
+	Detach   []string        `json:"detach,omitempty"`
+	Branches []PlannedBranch `json:"branches"`
+	Skipped  []PlannedBranch `json:"skipped,omitempty"`
+}
+
+// PlannedBranch is a branch in a plan.
+type PlannedBranch struct {
+	Name   string `json:"name"`
+	SHA    string `json:"sha"`
+	Action string `json:"action,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Dir is the directory in which the branch is to be rebased.
+	Dir string `json:"dir,omitempty"`
+	// Onto is the revision onto which the branch is to be rebased if it isn't
+	// the plan's.
+	Onto string `json:"onto,omitempty"`
+	// Parent is the branch onto which the branch is to be rebased with
+	// --stack-aware, if any.
+	Parent string `json:"parent,omitempty"`
+	// DuplicateOf is the branch that's rebased in the skipped branch's place,
+	// as they point at the same commit, if any.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+func (s *state) plan() PlanResult {
+	targetSHA, _ := s.sha(s.targetBranch)
+	p := PlanResult{
+		Target:    s.targetBranch,
+		TargetSHA: targetSHA,
+		Upstream:  s.targetUpstream,
+		Onto:      s.base(),
+		Branches:  make([]PlannedBranch, 0, len(s.branchesToRebase)),
+	}
+	if s.decapitates() {
+		for _, w := range s.worktrees {
+			p.Detach = append(p.Detach, w.dir)
+		}
+	}
+	for _, b := range s.branchesToRebase {
+		p.Branches = append(p.Branches, PlannedBranch{Name: b, SHA: s.branches[b], Action: s.actions[b], Dir: s.dirFor(b), Onto: s.bases[b], Parent: s.parents[b]})
+	}
+	for _, b := range sortedKeys(s.actions) {
+		if s.actions[b] == actionSkip {
+			p.Skipped = append(p.Skipped, PlannedBranch{Name: b, SHA: s.branches[b], Action: actionSkip})
+		}
+	}
+	for _, b := range sortedKeys(s.filtered) {
+		p.Skipped = append(p.Skipped, PlannedBranch{Name: b, SHA: s.branches[b], Action: s.actions[b], Reason: s.filtered[b], DuplicateOf: s.duplicates[b]})
+	}
+	return p
+}
+
+// dryRun prints the plan against the local state of the repository; nothing is
+// fetched, detached, or rebased.
+func (s *state) dryRun() error {
+	if err := s.buildPlan(); err != nil {
+		return err
+	}
+
+	p := s.plan()
+	if s.opts.Format == "json" {
+		bs, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encoding the plan: %w", err)
+		}
+		fmt.Fprintln(s.opts.Stdout, string(bs))
+		return nil
+	}
+
+	fmt.Fprintln(s.opts.Stdout, "Dry run: the plan is against the local state of the repository, which hasn't been fetched.")
+	printPlan(s.opts.Stdout, p, s.opts.GroupByPrefix)
+	return nil
+}
+
+// dumpPlan writes the plan against the local state of the repository to
+// Options.DumpPlan. As with dryRun, nothing is fetched or mutated, so the plan
+// can be reviewed before --load-plan replays it.
+func (s *state) dumpPlan() error {
+	if err := s.buildPlan(); err != nil {
+		return err
+	}
+	if s.opts.Interactive {
+		if err := s.selectBranches(); err != nil {
+			return fmt.Errorf("selecting the branches to rebase: %w", err)
+		}
+	}
+	if s.opts.PredictConflicts {
+		fmt.Fprintln(s.out, "Predicting conflicts...")
+		if err := s.predictConflicts(); err != nil {
+			return err
+		}
+	}
+	if err := writePlan(s.opts.DumpPlan, s.plan()); err != nil {
+		return fmt.Errorf("dumping the plan (path: %s): %w", s.opts.DumpPlan, err)
+	}
+	fmt.Fprintf(s.out, "Wrote the plan to %s.\n", s.opts.DumpPlan)
+	return nil
+}
+
+// printPlan prints the plan as text. If grouped, then the branches are listed
+// by group (see Options.GroupByPrefix), each with a count.
+func printPlan(w io.Writer, p PlanResult, grouped bool) {
+	fmt.Fprintf(w, "Target: %s (%s)\n", p.Target, p.TargetSHA)
+	if p.Upstream != "" {
+		fmt.Fprintf(w, "Upstream: %s\n", p.Upstream)
+	}
+	fmt.Fprintf(w, "Onto: %s\n", p.Onto)
+	fmt.Fprintln(w, "Worktrees to detach:")
+	if len(p.Detach) == 0 {
+		fmt.Fprintln(w, "  (none)")
+	}
+	for _, dir := range p.Detach {
+		fmt.Fprintf(w, "  %s\n", dir)
+	}
+	fmt.Fprintln(w, "Branches to update:")
+	printPlanned(w, p.Branches, grouped, func(b PlannedBranch) string {
+		verb := "rebase"
+		if b.Action == actionFastForward {
+			verb = "fast-forward"
+		}
+		switch {
+		case b.Parent != "":
+			verb += " onto " + b.Parent
+		case b.Onto != "":
+			verb += " onto " + b.Onto
+		}
+		return fmt.Sprintf("%s (%s): %s in %s", b.Name, b.SHA, verb, b.Dir)
+	})
+	fmt.Fprintln(w, "Skipped:")
+	printPlanned(w, p.Skipped, grouped, func(b PlannedBranch) string {
+		if b.Reason != "" {
+			return fmt.Sprintf("%s (%s): %s", b.Name, b.SHA, b.Reason)
+		}
+		return fmt.Sprintf("%s (%s)", b.Name, b.SHA)
+	})
+}
+
+// printPlanned prints a line for each of the planned branches, under the header
+// of its group if grouped.
+func printPlanned(w io.Writer, bs []PlannedBranch, grouped bool, line func(PlannedBranch) string) {
+	if len(bs) == 0 {
+		fmt.Fprintln(w, "  (none)")
+		return
+	}
+	if !grouped {
+		for _, b := range bs {
+			fmt.Fprintf(w, "  %s\n", line(b))
+		}
+		return
+	}
+	prefixes, byGroup := groupBy(bs, func(b PlannedBranch) string { return b.Name })
+	for _, p := range prefixes {
+		printGroupHeader(w, p, len(byGroup[p]), nil)
+		for _, b := range byGroup[p] {
+			fmt.Fprintf(w, "    %s\n", line(b))
+		}
+	}
+}
+
+// confirmPlan asks for confirmation, having printed the plan, if the run would
+// rewrite more branches than Options.ConfirmOver, and returns ErrNotConfirmed if
+// it isn't given.
+func (s *state) confirmPlan() error {
+	if s.opts.ConfirmOver <= 0 {
+		return nil
+	}
+	rewritten, err := s.rewrittenBranches()
+	if err != nil {
+		return err
+	}
+	if len(rewritten) <= s.opts.ConfirmOver {
+		return nil
+	}
+	printPlan(s.out, s.plan(), s.opts.GroupByPrefix)
+	ok, err := s.confirm(fmt.Sprintf("The run would rewrite %d branches (more than %d). Continue?", len(rewritten), s.opts.ConfirmOver))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: it would rewrite %d branches (see --confirm-over and --yes)", ErrNotConfirmed, len(rewritten))
+	}
+	return nil
+}
+
+// rewrittenBranches returns the branches that the plan would rewrite: those to
+// rebase, other than by fast-forwarding, and those that they contain, which
+// --update-refs moves with them.
+func (s *state) rewrittenBranches() ([]string, error) {
+	var out []string
+	for _, b := range s.branchesToRebase {
+		if b == s.targetBranch || s.actions[b] == actionFastForward {
+			continue
+		}
+		between, err := s.git.branchesBetween(s.currentDir, s.baseFor(b), b)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range append(between, b) {
+			if !slices.Contains(out, c) {
+				out = append(out, c)
+			}
+		}
+	}
+	return out, nil
+}
+
+// buildPlan constructs the branches to rebase and arranges them, unless a plan
+// was loaded, which was filtered and arranged when it was made and is kept as it
+// is. It runs no mutating git commands.
+func (s *state) buildPlan() error {
+	if s.opts.LoadPlan != "" {
+		return nil
+	}
+	if err := s.constructBranchesToRebase(); err != nil {
+		return fmt.Errorf("constructing the list of branches to rebase: %w", err)
+	}
+	return s.arrangeBranches()
+}
+
+// arrangeBranches filters and orders the branches to rebase and determines onto
+// what each is to be rebased.
+func (s *state) arrangeBranches() error {
+	if err := s.filterBranches(); err != nil {
+		return fmt.Errorf("filtering the branches: %w", err)
+	}
+	if err := s.orderBranches(); err != nil {
+		return fmt.Errorf("ordering the branches: %w", err)
+	}
+	if len(s.opts.TargetMap) > 0 {
+		s.mapTargets()
+	}
+	if s.stackAware() && s.parents == nil {
+		if err := s.stackBranches(); err != nil {
+			return fmt.Errorf("determining the stacks: %w", err)
+		}
+	}
+	if s.opts.RespectUpstream {
+		if err := s.resolveBases(); err != nil {
+			return err
+		}
+	}
+	s.collapseDuplicates()
+	if s.opts.PerWorktree && s.opts.Strategy == "rebase" {
+		if err := s.checkPinnedBranches(); err != nil {
+			return fmt.Errorf("checking for branches checked out in other worktrees: %w", err)
+		}
+	}
+	if s.opts.Strategy == "rebase" && s.opts.Merges != "flatten" {
+		if err := s.checkMerges(); err != nil {
+			return fmt.Errorf("checking for merge commits: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadPlan replaces the branches to rebase, their actions and bases, and the
+// skipped branches with those of the plan. It errors if the target or any
+// branch has moved since the plan was made, as the plan may then be stale.
+func (s *state) loadPlan(p PlanResult) error {
+	if p.Target != s.targetBranch {
+		return fmt.Errorf("the plan's target branch (%s) differs from the target branch (%s)", p.Target, s.targetBranch)
+	}
+	if sha := s.branches[s.targetBranch]; sha != p.TargetSHA {
+		return fmt.Errorf("the target branch %q has moved since the plan was made (planned: %s, current: %s)", s.targetBranch, p.TargetSHA, sha)
+	}
+
+	s.branchesToRebase = make([]string, 0, len(p.Branches))
+	s.actions = make(map[string]string, len(p.Branches)+len(p.Skipped))
+	s.filtered = make(map[string]string)
+	s.boundaries = make(map[string]string)
+	s.duplicates = make(map[string]string)
+	s.sameCommit = make(map[string]bool)
+	leaves := make(map[string][]string)
+	for _, b := range p.Branches {
+		sha, ok := s.branches[b.Name]
+		if !ok {
+			return fmt.Errorf("the branch %q in the plan could not be found", b.Name)
+		}
+		if sha != b.SHA {
+			return fmt.Errorf("the branch %q has moved since the plan was made (planned: %s, current: %s)", b.Name, b.SHA, sha)
+		}
+		s.branchesToRebase = append(s.branchesToRebase, b.Name)
+		s.actions[b.Name] = b.Action
+		if b.Action == actionLeaf {
+			leaves[sha] = append(leaves[sha], b.Name)
+		}
+		if b.Onto != "" {
+			if s.bases == nil {
+				s.bases = make(map[string]string)
+			}
+			s.bases[b.Name] = b.Onto
+		}
+		if b.Parent != "" {
+			if s.parents == nil {
+				s.parents, s.parentSHAs = make(map[string]string), make(map[string]string)
+			}
+			s.parents[b.Name], s.parentSHAs[b.Name] = b.Parent, s.branches[b.Parent]
+		}
+	}
+	for _, b := range p.Skipped {
+		// A skipped branch that has since been deleted has nothing to skip.
+		sha, ok := s.branches[b.Name]
+		if !ok {
+			continue
+		}
+		if sha != b.SHA {
+			return fmt.Errorf("the branch %q has moved since the plan was made (planned: %s, current: %s)", b.Name, b.SHA, sha)
+		}
+		s.actions[b.Name] = b.Action
+		if b.Reason != "" {
+			s.filtered[b.Name] = b.Reason
+		}
+		if b.DuplicateOf != "" {
+			s.duplicates[b.Name] = b.DuplicateOf
+		}
+	}
+	// As in collapseDuplicates, the leaves that remain at the same commit are
+	// rebased onto different bases.
+	for _, bs := range leaves {
+		if len(bs) > 1 {
+			for _, b := range bs {
+				s.sameCommit[b] = true
+			}
+		}
+	}
+	return nil
+}
+
+func readPlan(path string) (PlanResult, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return PlanResult{}, fmt.Errorf("reading the plan: %w", err)
+	}
+
+	var p PlanResult
+	if err := json.Unmarshal(bs, &p); err != nil {
+		return PlanResult{}, fmt.Errorf("parsing the plan (path: %s): %w", path, err)
+	}
+	if p.Target == "" {
+		return PlanResult{}, fmt.Errorf("the plan has no target branch (path: %s)", path)
+	}
+	return p, nil
+}
+
+func writePlan(path string, p PlanResult) error {
+	bs, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding the plan: %w", err)
+	}
+	if err := os.WriteFile(path, append(bs, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing the plan: %w", err)
+	}
+	return nil
+}
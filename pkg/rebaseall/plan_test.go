@@ -0,0 +1,83 @@
+package rebaseall
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDumpAndLoadPlan(t *testing.T) {
+	f := newTestFixture(t)
+	if err := errors.Join(
+		f.branch("a", "main", "a"),
+		f.branch("b", "main", "b"),
+		f.commit(f.work, "local", "local\n"),
+		f.advance("upstream", "upstream\n"),
+	); err != nil {
+		t.Fatalf("creating the branches: %v", err)
+	}
+	remoteBefore, err := f.output(f.work, "rev-parse", "origin/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "plan.json")
+	opts := Options{Dir: f.work, Runner: f.runner, Stdout: io.Discard, Stderr: io.Discard, Yes: true}
+
+	// The plan is written before anything is fetched or rewritten.
+	dump := opts
+	dump.DumpPlan = path
+	if _, err := Execute(context.Background(), dump); err != nil {
+		t.Fatal(err)
+	}
+	if remoteAfter, _ := f.output(f.work, "rev-parse", "origin/main"); remoteAfter != remoteBefore {
+		t.Fatalf("--dump-plan fetched (origin/main before: %s, after: %s)", remoteBefore, remoteAfter)
+	}
+	if refs, _ := f.output(f.work, "for-each-ref", "refs/rebase-all"); refs != "" {
+		t.Fatalf("--dump-plan wrote refs:\n%s", refs)
+	}
+
+	// The plan is replayed as it was written, without b, which is dropped from
+	// it, and without fetching.
+	p, err := readPlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(p.Branches, func(b PlannedBranch) bool { return b.Name == "b" })
+	if i < 0 || !slices.ContainsFunc(p.Branches, func(b PlannedBranch) bool { return b.Name == "a" }) {
+		t.Fatalf("expected a and b to be planned, got %+v", p.Branches)
+	}
+	p.Branches = slices.Delete(p.Branches, i, i+1)
+	if err := writePlan(path, p); err != nil {
+		t.Fatal(err)
+	}
+	bBefore, _ := f.output(f.work, "rev-parse", "b")
+	load := opts
+	load.LoadPlan = path
+	if _, err := Execute(context.Background(), load); err != nil {
+		t.Fatal(err)
+	}
+	if !f.contains("a", "main") {
+		t.Fatal("a wasn't rebased onto main")
+	}
+	if bAfter, _ := f.output(f.work, "rev-parse", "b"); bAfter != bBefore {
+		t.Fatalf("b, which isn't in the plan, was rewritten (before: %s, after: %s)", bBefore, bAfter)
+	}
+	if remoteAfter, _ := f.output(f.work, "rev-parse", "origin/main"); remoteAfter != remoteBefore {
+		t.Fatalf("--load-plan fetched (origin/main before: %s, after: %s)", remoteBefore, remoteAfter)
+	}
+
+	// A plan whose target has since moved is refused.
+	if _, err := Execute(context.Background(), dump); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.commit(f.work, "later", "later\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Execute(context.Background(), load); err == nil || !strings.Contains(err.Error(), "the target branch \"main\" has moved") {
+		t.Fatalf("expected the stale plan to be refused, but the run returned %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package rebaseall
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// predictConflicts merges each branch to be rebased with its base in memory,
+// with `git merge-tree`, and reports those that are likely to conflict. Then,
+// unless --yes was given, it asks whether to proceed with them, to skip them,
+// or to stop. A merge is only a proxy for a rebase, which replays each commit
+// in turn, so the prediction can be wrong either way.
+func (s *state) predictConflicts() error {
+	conflicts := make(map[string][]string)
+	for _, b := range s.branchesToRebase {
+		if s.actions[b] == actionFastForward || b == s.targetBranch {
+			continue
+		}
+		files, err := s.git.mergeTreeConflicts(s.currentDir, s.baseFor(b), b)
+		if err != nil {
+			return fmt.Errorf("predicting the conflicts of %q: %w", b, err)
+		}
+		if len(files) > 0 {
+			conflicts[b] = files
+		}
+	}
+	if len(conflicts) == 0 {
+		fmt.Fprintln(s.out, "No conflicts are predicted.")
+		return nil
+	}
+
+	fmt.Fprintln(s.out, "These branches are likely to conflict:")
+	for _, b := range sortedKeys(conflicts) {
+		fmt.Fprintf(s.out, "  %s (onto %s): %s\n", b, s.baseFor(b), strings.Join(conflicts[b], ", "))
+	}
+	if s.opts.Yes {
+		return nil
+	}
+	fmt.Fprint(s.out, "Proceed with them (p), skip them (s), or stop (q)? (To resolve the conflicts as they come, proceed with --on-conflict=pause.) [p/s/Q] ")
+	line, err := bufio.NewReader(s.opts.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("reading the answer: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "p", "proceed":
+		return nil
+	case "s", "skip":
+		s.branchesToRebase = slices.DeleteFunc(s.branchesToRebase, func(b string) bool {
+			if _, ok := conflicts[b]; ok {
+				s.filtered[b] = "predicted to conflict"
+				return true
+			}
+			return false
+		})
+		return nil
+	}
+	return fmt.Errorf("stopped as conflicts were predicted (branches: %s)", strings.Join(sortedKeys(conflicts), ", "))
+}
@@ -0,0 +1,124 @@
+package rebaseall
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// progress reports the progress of rebasing the branches, either as a line or
+// two per branch or, with Options.ProgressBar, a terminal, and a single job, as
+// a single line that's redrawn as each branch starts.
+type progress struct {
+	out io.Writer
+	bar bool
+	// verb is what's done to each branch (e.g., "rebased").
+	verb  string
+	total int
+	done  int
+	start time.Time
+	// drawn denotes that the bar is on screen and must be cleared before anything
+	// else is written.
+	drawn bool
+	color bool
+}
+
+func (s *state) newProgress() *progress {
+	return &progress{
+		out:   s.out,
+		bar:   s.opts.ProgressBar && s.opts.Jobs == 1 && isTerminal(s.out),
+		verb:  s.opts.Strategy + "d",
+		total: len(s.branchesToRebase),
+		start: time.Now(),
+		color: s.opts.useColor(s.out),
+	}
+}
+
+// begin reports that the rebase of the branch, the i'th of the total (counting
+// from 1), has begun.
+func (p *progress) begin(branch string, i int) {
+	if !p.bar {
+		fmt.Fprintf(p.out, "  %s [%d/%d]...\n", branch, i, p.total)
+		return
+	}
+
+	const width = 20
+	filled := width * p.done / max(p.total, 1)
+	fmt.Fprintf(p.out, "\r\033[K  [%s%s] %d/%d %s", strings.Repeat("=", filled), strings.Repeat(" ", width-filled), i, p.total, branch)
+	if eta := p.eta(); eta > 0 {
+		fmt.Fprintf(p.out, " (about %s left)", eta)
+	}
+	p.drawn = true
+}
+
+// finish reports that the branch, described by label, was rebased (or merged)
+// in d, replaying (or merging) the given number of commits.
+func (p *progress) finish(label string, commits int, d time.Duration) {
+	p.finishAs(p.verb, label, commits, d)
+}
+
+// finishAs is finish for a branch that was updated in another way (e.g.,
+// fast-forwarded), which verb describes.
+func (p *progress) finishAs(verb, label string, commits int, d time.Duration) {
+	p.done++
+	if p.bar {
+		return
+	}
+	msg := fmt.Sprintf("  %s: %s %d %s in %s", label, verb, commits, plural(commits, "commit", "commits"), d.Round(time.Millisecond))
+	if eta := p.eta(); eta > 0 {
+		msg += fmt.Sprintf("; about %s left", eta)
+	}
+	fmt.Fprintln(p.out, paint(p.color, colorGreen, msg+"."))
+}
+
+// skip counts a branch to which nothing was done (e.g., as it was up to date)
+// towards those that are done.
+func (p *progress) skip() { p.done++ }
+
+// printf clears the bar, if it's drawn, and writes a line.
+func (p *progress) printf(format string, args ...any) {
+	p.clear()
+	fmt.Fprintf(p.out, format+"\n", args...)
+}
+
+// colorf is printf in the colour, if colouring is on.
+func (p *progress) colorf(color, format string, args ...any) {
+	p.printf("%s", paint(p.color, color, fmt.Sprintf(format, args...)))
+}
+
+// clear clears the bar, if it's drawn.
+func (p *progress) clear() {
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// eta estimates the time left from the average time taken by the branches so
+// far, or returns 0 if there's no estimate.
+func (p *progress) eta() time.Duration {
+	if p.done == 0 || p.done >= p.total {
+		return 0
+	}
+	perBranch := time.Since(p.start) / time.Duration(p.done)
+	return (perBranch * time.Duration(p.total-p.done)).Round(time.Second)
+}
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
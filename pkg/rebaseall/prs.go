@@ -0,0 +1,107 @@
+package rebaseall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// openPRBranches returns the branches of the remote's repository that back open
+// pull requests (on GitHub, through gh) or merge requests (on GitLab, through
+// glab). The hosting provider is inferred from the remote's URL: hosts whose
+// names contain "gitlab" are taken to be GitLab, and all others GitHub. Each
+// CLI authenticates as it usually does (e.g., with GH_TOKEN or GITLAB_TOKEN).
+func (s *state) openPRBranches() (map[string]bool, error) {
+	rawURL, err := s.git.remoteURL(s.currentDir, s.opts.Remote)
+	if err != nil {
+		return nil, err
+	}
+	host, repo, err := parseRemoteURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the URL of the remote %q: %w", s.opts.Remote, err)
+	}
+
+	if strings.Contains(host, "gitlab") {
+		return s.openMergeRequestBranches(host, repo)
+	}
+	var prs []struct {
+		HeadRefName string `json:"headRefName"`
+	}
+	if err := s.runJSON(&prs, "gh", "pr", "list", "--repo", host+"/"+repo, "--state", "open", "--limit", "1000", "--json", "headRefName"); err != nil {
+		return nil, err
+	}
+	out := make(map[string]bool, len(prs))
+	for _, pr := range prs {
+		out[pr.HeadRefName] = true
+	}
+	return out, nil
+}
+
+// openMergeRequestBranches is openPRBranches for GitLab. glab is paged through,
+// as it can't list more than 100 merge requests at a time.
+func (s *state) openMergeRequestBranches(host, repo string) (map[string]bool, error) {
+	const perPage = 100
+	out := make(map[string]bool)
+	for page := 1; ; page++ {
+		var mrs []struct {
+			SourceBranch string `json:"source_branch"`
+		}
+		if err := s.runJSON(&mrs, "glab", "mr", "list", "--repo", "https://"+host+"/"+repo, "--output", "json", "--page", strconv.Itoa(page), "--per-page", strconv.Itoa(perPage)); err != nil {
+			return nil, err
+		}
+		for _, mr := range mrs {
+			out[mr.SourceBranch] = true
+		}
+		if len(mrs) < perPage {
+			return out, nil
+		}
+	}
+}
+
+// runJSON runs the command in the current directory and decodes its stdout, as
+// JSON, into v.
+func (s *state) runJSON(v any, name string, args ...string) error {
+	cmd := exec.CommandContext(s.git.ctx, name, args...)
+	cmd.Dir = s.currentDir
+	bs, err := cmd.Output()
+	if err != nil {
+		var stderr string
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = trimbs(exitErr.Stderr)
+		}
+		return fmt.Errorf("running `%s %s`: %w (output: %s)", name, strings.Join(args, " "), err, stderr)
+	}
+	if err := json.Unmarshal(bs, v); err != nil {
+		return fmt.Errorf("decoding the output of `%s %s`: %w", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// parseRemoteURL returns the host and the repository path (e.g., owner/repo) of
+// a remote URL, which is either a URL (e.g., https://github.com/owner/repo.git)
+// or an scp-like address (e.g., git@github.com:owner/repo.git).
+func parseRemoteURL(rawURL string) (host, repo string, err error) {
+	if !strings.Contains(rawURL, "://") {
+		userHost, path, ok := strings.Cut(rawURL, ":")
+		if !ok {
+			return "", "", fmt.Errorf("expected a URL or an address of the form [user@]host:path; given %q", rawURL)
+		}
+		_, host, _ = strings.Cut(userHost, "@")
+		if host == "" {
+			host = userHost
+		}
+		rawURL = "ssh://" + host + "/" + path
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	repo = strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	if u.Hostname() == "" || repo == "" {
+		return "", "", fmt.Errorf("expected a URL with a host and a repository path; given %q", rawURL)
+	}
+	return u.Hostname(), repo, nil
+}
@@ -0,0 +1,2846 @@
+// Package rebaseall rebases all of the branches across all of the worktrees of a
+// git repository onto a target branch, preserving the structure of stacked
+// branches with git rebase --update-refs.
+//
+// Plan computes what a run would do without mutating anything; Execute
+// performs a run; Run does whatever the options ask, as the git-rebase-all
+// command does. Every git command is run through Options.Runner; the hooks and
+// the gh and glab commands of OnlyOpenPRs aren't git's, and are run directly.
+package rebaseall
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MinGitMajorVersion and MinGitMinorVersion give the minimum version of git,
+// which is the first to support git rebase --update-refs.
+const MinGitMajorVersion, MinGitMinorVersion = 2, 38
+
+// TargetMapping is an entry of Options.TargetMap: the branches matching Pattern
+// are rebased onto Target.
+type TargetMapping struct {
+	Pattern, Target string
+}
+
+// worktree is a worktree and what it has checked out: a branch or, if its HEAD
+// is detached, the commit head. Either way, sha is the commit at its HEAD. A
+// locked worktree was locked by git worktree lock; a prunable one's directory
+// is gone, so git worktree prune would remove it.
+type worktree struct {
+	dir, branch, head, sha string
+	locked, prunable       bool
+}
+
+// checkedOut returns what the worktree has checked out.
+func (w worktree) checkedOut() string {
+	if w.branch == "" {
+		return w.head
+	}
+	return w.branch
+}
+
+// state returns whether the worktree is locked or prunable, or "-" if it's
+// neither.
+func (w worktree) state() string {
+	switch {
+	case w.prunable:
+		return "prunable"
+	case w.locked:
+		return "locked"
+	}
+	return "-"
+}
+
+// These classify each branch when constructing the branches to rebase.
+const (
+	actionLeaf        = "leaf"
+	actionFastForward = "fast-forward"
+	actionSkip        = "skip"
+	// actionStacked is for a branch with children that's rebased with
+	// --stack-aware.
+	actionStacked = "stacked"
+)
+
+// Options holds the settings of a run. Each corresponds to a flag of
+// git-rebase-all; the zero value of a field denotes its flag's default.
+type Options struct {
+	// TargetBranch may also be a remote-tracking branch, a tag, or a commit,
+	// none of which is updated. It defaults to the branch to which a remote's
+	// HEAD points (see defaultTarget), then to main, then to master.
+	TargetBranch string
+	PruneRemote  bool
+	// Sort is the key by which the branches to rebase are ordered: "alpha" for
+	// their names, "commits" for the fewest commits ahead of the target first,
+	// or "recent" for the most recently committed first. Order is the
+	// direction, "asc" or "desc", which reverses it.
+	Sort, Order string
+	// DumpPlan and LoadPlan are paths to which to write and from which to read
+	// the plan, respectively.
+	DumpPlan, LoadPlan string
+	OntoUpstream       bool
+	// Restore is how each worktree that had a branch checked out is restored
+	// after the run: "branch" checks out the branch, wherever it now points;
+	// "sha" detaches its HEAD at the commit it had checked out if the branch was
+	// rewritten; and "ask" asks which of the two to do for each such worktree.
+	Restore string
+	// Strategy is either "rebase" or "merge". With "merge", the base is merged
+	// into each branch rather than each branch being rebased onto the base; as
+	// with StackAware, a branch's base is its parent, if it has one.
+	Strategy string
+	// Merges is what to do with a branch whose own history has merge commits,
+	// which a plain rebase flattens: "preserve" (the default) rebases it with
+	// --rebase-merges, "flatten" rebases it as any other, and "skip" skips it.
+	// It's moot with the merge strategy.
+	Merges string
+	// PreBranchCmd and PostBranchCmd are shell commands to run in the directory
+	// in which each branch is checked out, before it's rebased and after it's
+	// rebased successfully, respectively. A failure fails the run. See runHook
+	// for the environment that they're given.
+	PreBranchCmd, PostBranchCmd string
+	// Verify is a shell command to run, in a temporary worktree, against each
+	// branch after it's rebased. If it fails, then the branches moved by the
+	// rebase are reset and the run fails with ErrVerificationFailed once the
+	// other branches have been rebased.
+	Verify string
+	// RebaseArgs are extra arguments to pass to each `git rebase` (e.g.,
+	// --rebase-merges). Those that would make the rebase interactive or change
+	// what's rebased are rejected by Validate.
+	RebaseArgs []string
+	// NoHooks denotes that git's hooks (e.g., post-checkout or
+	// reference-transaction) shouldn't be run by the checkouts, rebases, and
+	// merges, which can otherwise make a run take many minutes.
+	NoHooks bool
+	// GPGSign denotes that the rebased commits, and the merge commits of the
+	// merge strategy, should be signed: with GPGKeyID if it's given, and with
+	// the committer's default key otherwise. Without it, git signs them anyway
+	// if commit.gpgSign is set. Either way, the summary counts the commits that
+	// were left unsigned.
+	GPGSign  bool
+	GPGKeyID string
+	// CopyNotes denotes that the notes (see git notes) attached to the rebased
+	// commits, in any notes ref, should be copied to the rewritten commits.
+	CopyNotes bool
+	// Rerere denotes that rebases and merges should record conflict
+	// resolutions and reuse them (see git rerere), so that the conflicts that
+	// were resolved before are resolved again without stopping.
+	Rerere bool
+	// ProgressBar denotes that the progress of the rebases should be drawn as a
+	// single, updating line if it's written to a terminal.
+	ProgressBar bool
+	// StackAware denotes that the stacks of branches should be rebased parents
+	// before children, each branch onto its parent, so that a failure leaves
+	// the branches beneath it untouched.
+	StackAware bool
+	// RespectUpstream denotes that each branch should be rebased onto its own
+	// upstream, if it has one other than its remote counterpart, rather than
+	// onto the target.
+	RespectUpstream bool
+	Health          bool
+	// Unshallow denotes that a shallow clone should be made complete before
+	// rebasing; Deepen, if positive, is the number of commits by which to
+	// deepen it, as many times as it takes, instead (see ensureHistory).
+	Unshallow bool
+	Deepen    int
+	// PredictConflicts denotes that, before anything is rebased, the branches
+	// that are likely to conflict should be reported, asking whether to proceed
+	// (see predictConflicts).
+	PredictConflicts bool
+	// FetchAll denotes that every remote should be fetched, rather than only
+	// the default one, and that the local tags that are gone from the remotes
+	// should be pruned.
+	FetchAll bool
+	// RecurseSubmodules denotes that the submodules should also be fetched.
+	RecurseSubmodules bool
+	// TolerateFetchFailure denotes that failures to fetch or pull should be
+	// reported as warnings rather than errors.
+	TolerateFetchFailure bool
+	// Offline denotes that nothing should be fetched or pulled: the branches
+	// are rebased onto the target as it is locally, as when there's no network.
+	Offline bool
+	// FetchOnly denotes that the run should stop after fetching and updating
+	// the target branch, without rebasing anything.
+	FetchOnly bool
+	// SkipBusyWorktrees denotes that the worktrees with an operation (e.g., a
+	// rebase or a bisection) in progress should be left alone rather than the
+	// run failing with ErrWorktreeBusy.
+	SkipBusyWorktrees bool
+	// SkipLockedWorktrees denotes that the worktrees locked by git worktree
+	// lock (e.g., as they're on removable media) should be left alone, along
+	// with the branches they have checked out.
+	SkipLockedWorktrees bool
+	// ResetTarget denotes that the target branch should be reset to its
+	// upstream if it has diverged from it rather than the run failing with
+	// ErrTargetDiverged. The target is otherwise only ever fast-forwarded.
+	ResetTarget bool
+	// FetchTarget denotes that the target branch should be fast-forwarded with
+	// `git fetch <remote> <branch>:<target>` rather than by checking it out
+	// and pulling, where it can be: where it isn't checked out, its upstream
+	// is on a remote, and it needn't be reset.
+	FetchTarget bool
+	// PerWorktree denotes that each branch should be rebased in the worktree in
+	// which it's checked out, rather than decapitating every worktree.
+	PerWorktree bool
+	// RebaseCheckedOut lists the patterns of the branches checked out in other
+	// worktrees that may be rebased when working per worktree; "*" allows
+	// every branch.
+	RebaseCheckedOut []string
+	// NoDecapitate denotes that, with a single worktree, its HEAD needn't be
+	// detached.
+	NoDecapitate bool
+	// Strict denotes that the run should be refused, rather than warned about,
+	// if a worktree has sparse-checkout enabled.
+	Strict bool
+	// RepeatUntilStable denotes that the branches should be reconstructed and
+	// rebased until a pass changes nothing, up to MaxPasses passes.
+	RepeatUntilStable bool
+	MaxPasses         int
+	// OnConflict is one of "abort", "abort-all" (which also rolls back every
+	// branch; see rollback), "pause", or "skip".
+	OnConflict string
+	// Continue denotes that a paused run should be continued.
+	Continue bool
+	// Jobs is the number of branches to rebase concurrently.
+	Jobs int
+	// Push denotes that the rebased branches should be force-pushed (with a
+	// lease) to Remote. Remote is also the first remote whose HEAD is taken as
+	// the target branch if none is given.
+	Push   bool
+	Remote string
+	// SetUpstream denotes that, after rebasing, the upstream of each rebased
+	// branch should be pointed at its counterpart on Remote if it exists
+	// (unless its upstream is another local branch) and, with Push, that a
+	// branch that isn't on Remote should be pushed to create it.
+	SetUpstream bool
+	// PruneMerged denotes that branches that are merged into the updated target
+	// branch should be deleted.
+	PruneMerged bool
+	// PruneGone denotes that branches whose upstream is gone after fetching
+	// should be deleted.
+	PruneGone bool
+	// Yes denotes that confirmation prompts should be assumed to be answered in
+	// the affirmative.
+	Yes bool
+	// ConfirmOver, if positive, is the number of branches above which a run
+	// prints its plan and asks for confirmation before rewriting them (unless
+	// Yes is set), failing with ErrNotConfirmed if it isn't given.
+	ConfirmOver int
+	// Include and Exclude are glob patterns against which the branches to
+	// rebase are matched.
+	Include, Exclude []string
+	// Groups, if non-empty, restricts the branches to rebase to those in the
+	// named groups, which are prefixes of branch names up to a slash (e.g.,
+	// user/alice), or in groups nested in them.
+	Groups []string
+	// GroupByPrefix denotes that the plan and the summary should list the
+	// branches by group (their names up to their last slashes, e.g.,
+	// feature/), with counts for each.
+	GroupByPrefix bool
+	// TrackRemote are glob patterns matching the branches on Remote (e.g.,
+	// teammates' branches under review) for which local branches tracking them
+	// should be created after fetching, if there are none, so that they're
+	// rebased too. As the local branches are copies, they're rebased even if
+	// they've diverged from their upstreams and they're never pushed; they're
+	// marked as such with the git config key branch.<name>.rebaseAllTracked,
+	// and other branches that match the patterns are treated as any other.
+	TrackRemote []string
+	// TargetMap maps the branches matching each pattern onto a target other
+	// than the run's, which is updated from its upstream up front; the first
+	// pattern that matches a branch wins. The targets themselves aren't
+	// rebased.
+	TargetMap []TargetMapping
+	// Protected are glob patterns matching the branches that are never
+	// rewritten unless AllowProtected is set: they're only fast-forwarded, and
+	// the branches whose rebases would rewrite them aren't rebased. It defaults
+	// to DefaultProtected. The target branch itself is exempt.
+	Protected      []string
+	AllowProtected bool
+	// Mine denotes that only the branches whose tips were authored or committed
+	// by the configured user (user.email) should be rebased; Author is a regular
+	// expression that does the same for any author or committer, matched
+	// against "Name <email>".
+	Mine   bool
+	Author string
+	// MaxAge, if positive, skips the branches whose tip commits were committed
+	// longer ago than it, as stale.
+	MaxAge time.Duration
+	// SyncWithRemote is what to do with a branch whose counterpart on a remote
+	// (its upstream) was force-pushed, as found in the upstream's reflog: one
+	// of "reset" (reset the branch to its upstream, unless it has commits that
+	// weren't pushed), "merge" (merge the upstream into it), or "skip". If
+	// it's empty, such a branch is treated as any other that has diverged from
+	// its upstream (see RebaseDiverged).
+	SyncWithRemote string
+	// RebaseDiverged denotes that the branches that have diverged from their
+	// upstreams (other than the target and its upstream) should be rebased;
+	// otherwise, they're skipped, as others may have pulled them.
+	RebaseDiverged bool
+	// OnlyOpenPRs denotes that only the branches backing open pull (or merge)
+	// requests on Remote's repository should be rebased; see openPRBranches.
+	OnlyOpenPRs bool
+	// RefreshCommitGraph denotes that the commit-graph should be rewritten after
+	// fetching to speed up the ancestry queries.
+	RefreshCommitGraph bool
+	AbortAll           bool
+	// Stats denotes that the statistics of the run (see Stats) should be
+	// included in its summary.
+	Stats bool
+	// Checkpoint denotes that each branch's commit SHA should be tagged under
+	// rebase-all/checkpoint/<time>/ before the run, as a safety net that,
+	// unlike the backups and the reflogs, lasts until it's deleted.
+	// CleanupCheckpoints deletes the tags of every checkpoint other than the
+	// most recent KeepCheckpoints.
+	Checkpoint         bool
+	CleanupCheckpoints bool
+	KeepCheckpoints    int
+	// ForceUnlock denotes that the lock file, which stops runs in the same
+	// repository from overlapping, should be removed first, as one left behind
+	// by a run that was killed would otherwise block every run.
+	ForceUnlock bool
+	// Watch denotes that, after running, the target's upstream should be
+	// fetched every WatchInterval and the run repeated whenever it moves (see
+	// watch).
+	Watch         bool
+	WatchInterval time.Duration
+	// Log denotes that the prior runs should be listed from their journals
+	// (see Journal).
+	Log bool
+	// Status denotes that whether a run is paused or in progress, how the last
+	// run went, and the state of each worktree should be printed (see status).
+	Status bool
+	// Undo denotes that the branches should be reset to where they were before
+	// the last run that rewrote one, and those it created deleted.
+	Undo bool
+	// DryRun denotes that the plan should be printed without anything being
+	// mutated.
+	DryRun bool
+	// Graph is "ascii" or "dot" if the branches' topology should be printed in
+	// that form, against the local state of the repository, rather than
+	// rebasing them (see graph).
+	Graph string
+	// Format is "text", "json", or "github", which is text together with
+	// annotations for GitHub Actions (see printAnnotations).
+	Format string
+	// SelfTest denotes that, rather than running against the repository, the
+	// sanity scenario of SelfTest should be run against a throwaway one.
+	SelfTest bool
+	// SummaryFile, if non-empty, is a path to which to write the summary as
+	// JSON, whatever the Format, for editors and other tools to read.
+	SummaryFile string
+	// Color is one of "auto", "always", or "never" (see useColor).
+	Color string
+	// Interactive denotes that the leaf branches to rebase should be listed so
+	// that some may be deselected before anything is rebased.
+	Interactive bool
+	// MaxOutputLines caps the number of lines of git's output that are included
+	// in errors; 0 denotes no cap.
+	MaxOutputLines int
+	// Verbosity is one of the verbosity constants; git's commands are logged to
+	// Stderr at VerbosityDebug.
+	Verbosity Verbosity
+	// Args holds any positional arguments, none of which are accepted.
+	Args []string
+
+	// Dir is the directory in which to run; it defaults to the current
+	// directory.
+	Dir string
+	// Backend is "exec" or, experimentally, "gogit", which selects the Runner
+	// if it isn't set: ExecRunner or a GoGitRunner that falls back to it.
+	Backend string
+	// Runner runs git; it defaults to ExecRunner.
+	Runner Runner
+	// Stdout, Stderr, and Stdin default to those of the process.
+	Stdout, Stderr io.Writer
+	Stdin          io.Reader
+	// Events, if set, is where the run's progress is written as
+	// newline-delimited JSON (see Event).
+	Events io.Writer
+}
+
+// withDefaults fills in the zero-valued fields that have non-zero defaults.
+func (o Options) withDefaults() Options {
+	if o.Sort == "" {
+		o.Sort = "alpha"
+	}
+	if o.Order == "" {
+		o.Order = "asc"
+	}
+	if o.WatchInterval == 0 {
+		o.WatchInterval = 5 * time.Minute
+	}
+	if o.Color == "" {
+		o.Color = "auto"
+	}
+	if o.Format == "" {
+		o.Format = "text"
+	}
+	if o.Restore == "" {
+		o.Restore = "branch"
+	}
+	if o.Strategy == "" {
+		o.Strategy = "rebase"
+	}
+	if o.Merges == "" {
+		o.Merges = "preserve"
+	}
+	if o.OnConflict == "" {
+		o.OnConflict = "abort"
+	}
+	if o.Jobs == 0 {
+		o.Jobs = 1
+	}
+	if o.MaxPasses == 0 {
+		o.MaxPasses = 5
+	}
+	if o.Remote == "" {
+		o.Remote = "origin"
+	}
+	if o.Protected == nil {
+		o.Protected = DefaultProtected
+	}
+	if o.Backend == "" {
+		o.Backend = "exec"
+	}
+	if o.Runner == nil && o.Backend == "gogit" {
+		o.Runner = &GoGitRunner{Fallback: ExecRunner{}}
+	}
+	if o.Runner == nil {
+		o.Runner = ExecRunner{}
+	}
+	if o.Stdout == nil {
+		o.Stdout = os.Stdout
+	}
+	if o.Stderr == nil {
+		o.Stderr = os.Stderr
+	}
+	if o.Stdin == nil {
+		o.Stdin = os.Stdin
+	}
+	return o
+}
+
+// Validate checks for invalid or contradictory options before anything is run.
+func (o Options) Validate() error {
+	o = o.withDefaults()
+	if len(o.Args) > 0 {
+		return fmt.Errorf("unexpected positional arguments (given: %s); use -b to name the target branch", strings.Join(o.Args, " "))
+	}
+	if !slices.Contains([]string{"alpha", "commits", "recent"}, o.Sort) {
+		return fmt.Errorf(`--sort must be "alpha", "commits", or "recent" (given: %q)`, o.Sort)
+	}
+	if o.Order != "asc" && o.Order != "desc" {
+		return fmt.Errorf(`--order must be "asc" or "desc" (given: %q)`, o.Order)
+	}
+	if o.Color != "auto" && o.Color != "always" && o.Color != "never" {
+		return fmt.Errorf(`--color must be "auto", "always", or "never" (given: %q)`, o.Color)
+	}
+	if o.Backend != "exec" && o.Backend != "gogit" {
+		return fmt.Errorf(`--backend must be "exec" or "gogit" (given: %q)`, o.Backend)
+	}
+	if !slices.Contains([]string{"text", "json", "github"}, o.Format) {
+		return fmt.Errorf(`the format must be "text", "json", or "github" (given: %q)`, o.Format)
+	}
+	if o.Verbosity < VerbosityQuiet || o.Verbosity > VerbosityDebug {
+		return fmt.Errorf("the verbosity must be between %d and %d (given: %d)", VerbosityQuiet, VerbosityDebug, o.Verbosity)
+	}
+	if o.MaxOutputLines < 0 {
+		return fmt.Errorf("--max-output-lines must be non-negative (given: %d)", o.MaxOutputLines)
+	}
+	if o.Graph != "" && o.Graph != "ascii" && o.Graph != "dot" {
+		return fmt.Errorf(`--graph must be "ascii" or "dot" (given: %q)`, o.Graph)
+	}
+	if o.Watch && (o.DryRun || o.Graph != "" || o.DumpPlan != "" || o.LoadPlan != "" || o.Continue || o.Undo || o.AbortAll || o.Health || o.Log || o.Status || o.CleanupCheckpoints) {
+		return errors.New("--watch cannot be used with --dry-run, --graph, --dump-plan, --load-plan, --continue, --undo, --abort-all, --health, log, status, or cleanup-checkpoints")
+	}
+	if o.Offline && (o.FetchOnly || o.Watch || o.Push || o.PruneRemote || o.FetchTarget || o.Unshallow || o.Deepen > 0 || o.OnlyOpenPRs) {
+		return errors.New("--offline cannot be used with --fetch-only, --watch, --push, --prune-remote, --fetch-target, --unshallow, --deepen, or --only-open-prs, which need the network")
+	}
+	if o.FetchOnly && (o.DryRun || o.Graph != "" || o.DumpPlan != "" || o.LoadPlan != "" || o.Health || o.Push) {
+		return errors.New("--fetch-only cannot be used with --dry-run, --graph, --dump-plan, --load-plan, --health, or --push")
+	}
+	if o.WatchInterval < 0 {
+		return fmt.Errorf("--watch-interval must be positive (given: %s)", o.WatchInterval)
+	}
+	if o.Deepen < 0 {
+		return fmt.Errorf("--deepen must be positive (given: %d)", o.Deepen)
+	}
+	if o.Unshallow && o.Deepen > 0 {
+		return errors.New("--unshallow and --deepen are mutually exclusive")
+	}
+	if o.Restore != "branch" && o.Restore != "sha" && o.Restore != "ask" {
+		return fmt.Errorf(`--restore must be "branch", "sha", or "ask" (given: %q)`, o.Restore)
+	}
+	if o.Strategy != "rebase" && o.Strategy != "merge" {
+		return fmt.Errorf(`the strategy must be "rebase" or "merge" (given: %q)`, o.Strategy)
+	}
+	if o.SyncWithRemote != "" && !slices.Contains([]string{"reset", "merge", "skip"}, o.SyncWithRemote) {
+		return fmt.Errorf(`--sync-with-remote must be "reset", "merge", or "skip" (given: %q)`, o.SyncWithRemote)
+	}
+	if !slices.Contains([]string{"preserve", "flatten", "skip"}, o.Merges) {
+		return fmt.Errorf(`--merges must be "preserve", "flatten", or "skip" (given: %q)`, o.Merges)
+	}
+	if !slices.Contains([]string{"abort", "abort-all", "pause", "skip"}, o.OnConflict) {
+		return fmt.Errorf(`the conflict policy must be "abort", "abort-all", "pause", or "skip" (given: %q)`, o.OnConflict)
+	}
+	if o.Continue && (o.DryRun || o.DumpPlan != "" || o.LoadPlan != "") {
+		return errors.New("--continue cannot be used with --dry-run, --dump-plan, or --load-plan")
+	}
+	if o.Jobs < 1 {
+		return fmt.Errorf("--jobs must be positive (given: %d)", o.Jobs)
+	}
+	if o.Jobs > 1 && (o.PerWorktree || o.NoDecapitate || o.OnConflict == "pause" || o.StackAware || o.Strategy == "merge" || o.Verify != "") {
+		return errors.New("--jobs cannot be used with --per-worktree, --no-decapitate, --on-conflict=pause, --stack-aware, --strategy=merge, or --verify")
+	}
+	if o.MaxPasses < 1 {
+		return fmt.Errorf("--max-passes must be positive (given: %d)", o.MaxPasses)
+	}
+	if o.DumpPlan != "" && o.LoadPlan != "" {
+		return errors.New("--dump-plan and --load-plan cannot be used together")
+	}
+	if o.LoadPlan != "" && (o.PruneMerged || o.PruneGone || len(o.TrackRemote) > 0 || o.SyncWithRemote != "" || o.RepeatUntilStable) {
+		return errors.New("--load-plan cannot be used with --prune-merged, --prune-gone, --track-remote, --sync-with-remote, or --repeat-until-stable, which would change the branches that the plan records")
+	}
+	if o.Interactive && o.LoadPlan != "" {
+		return errors.New("-i and --load-plan cannot be used together")
+	}
+	for _, g := range o.Groups {
+		if strings.Trim(g, "/") == "" {
+			return fmt.Errorf("--group must name a prefix of branch names (given: %q)", g)
+		}
+	}
+	for _, p := range append(append(append(append(slices.Clone(o.Include), o.Exclude...), o.Protected...), o.TrackRemote...), o.RebaseCheckedOut...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	for _, m := range o.TargetMap {
+		if _, err := path.Match(m.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", m.Pattern, err)
+		}
+		if m.Target == "" {
+			return fmt.Errorf("the pattern %q is mapped to no target", m.Pattern)
+		}
+	}
+	for _, a := range o.RebaseArgs {
+		name, _, _ := strings.Cut(a, "=")
+		if slices.Contains(forbiddenRebaseArgs, name) {
+			return fmt.Errorf("%s cannot be passed to git rebase", name)
+		}
+	}
+	if o.Mine && o.Author != "" {
+		return errors.New("--mine and --author cannot be used together")
+	}
+	if o.KeepCheckpoints < 0 {
+		return fmt.Errorf("the number of checkpoints to keep must not be negative (given: %d)", o.KeepCheckpoints)
+	}
+	if o.MaxAge < 0 {
+		return fmt.Errorf("the maximum age must not be negative (given: %s)", o.MaxAge)
+	}
+	if _, err := regexp.Compile(o.Author); err != nil {
+		return fmt.Errorf("invalid author pattern %q: %w", o.Author, err)
+	}
+	return nil
+}
+
+// DefaultProtected are the default Options.Protected.
+var DefaultProtected = []string{"main", "master", "release/*"}
+
+// forbiddenRebaseArgs are the arguments to git rebase that would make it
+// interactive, change what it rebases, or act on a rebase in progress.
+var forbiddenRebaseArgs = []string{
+	"-i", "--interactive", "--edit-todo", "--onto", "--root", "--keep-base",
+	"--continue", "--abort", "--skip", "--quit", "--show-current-patch",
+	"--no-update-refs",
+}
+
+func (o Options) git(ctx context.Context) *git {
+	g := &git{ctx: ctx, runner: o.Runner, dir: o.Dir, maxOutputLines: o.MaxOutputLines, rebaseArgs: o.RebaseArgs, noHooks: o.NoHooks, signArg: o.signArg(), copyNotes: o.CopyNotes, rerere: o.Rerere, commands: new(atomic.Int64)}
+	if o.Verbosity >= VerbosityDebug {
+		g.log = o.Stderr
+	}
+	return g
+}
+
+// signArg returns the argument with which git rebase and git merge sign their
+// commits, or the empty string if it's left to commit.gpgSign.
+func (o Options) signArg() string {
+	switch {
+	case o.GPGKeyID != "":
+		return "--gpg-sign=" + o.GPGKeyID
+	case o.GPGSign:
+		return "--gpg-sign"
+	}
+	return ""
+}
+
+// workDir returns the absolute path of the directory in which to run.
+func (o Options) workDir() (string, error) {
+	if o.Dir == "" {
+		dir, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("fetching the current directory: %w", err)
+		}
+		return dir, nil
+	}
+	dir, err := filepath.Abs(o.Dir)
+	if err != nil {
+		return "", fmt.Errorf("resolving the directory %q: %w", o.Dir, err)
+	}
+	return dir, nil
+}
+
+// progress returns where progress is written. It's stdout unless stdout is
+// reserved for machine-readable output or the run is quiet.
+func (o Options) progress() io.Writer {
+	if o.Verbosity <= VerbosityQuiet {
+		return io.Discard
+	}
+	if o.Format == "json" {
+		return o.Stderr
+	}
+	return o.Stdout
+}
+
+// check validates the options, the version of git, and that the current
+// directory is in a worktree or a bare repository.
+func (o Options) check(ctx context.Context) error {
+	if err := o.Validate(); err != nil {
+		return fmt.Errorf("validating the options: %w", err)
+	}
+	g := o.git(ctx)
+	if err := g.validateVersion(); err != nil {
+		return fmt.Errorf("validating the version of git: %w", err)
+	}
+	// A bare repository's worktrees are operated on from a worktree (see
+	// newState).
+	bare, err := g.isBare("")
+	if err != nil {
+		return fmt.Errorf("checking whether the program is being run from a git directory: %w", err)
+	}
+	if bare {
+		return nil
+	}
+	if bs, err := g.run("", "rev-parse", "--is-inside-work-tree"); err != nil {
+		return fmt.Errorf("checking whether the program is being run from a git directory: %w (output: %s)", err, trimbs(bs))
+	}
+	return nil
+}
+
+type state struct {
+	worktrees []worktree
+	// branch -> commit SHA
+	branches         map[string]string
+	branchesToRebase []string
+	// branch -> action (one of the action constants)
+	actions map[string]string
+	// branch -> the reason for which the branch was filtered out of
+	// branchesToRebase
+	filtered map[string]string
+	// deselected records the branches deselected with -i, which later passes
+	// leave alone, too.
+	deselected map[string]bool
+	// branch -> the revision onto which to rebase it, if it isn't base() (see
+	// Options.RespectUpstream)
+	bases map[string]string
+	// branch -> its parent and its parent's commit SHA before the run (see
+	// Options.StackAware)
+	parents, parentSHAs map[string]string
+	currentDir          string
+	// topLevel is the top-level directory of the current worktree.
+	topLevel string
+	// bare denotes that the run was started from a bare repository without any
+	// worktrees; tempWorktree is then the worktree added in its place, which is
+	// removed by restore.
+	bare         bool
+	tempWorktree string
+	// busyBranches maps the branches on which the worktrees skipped by
+	// --skip-busy-worktrees are working to those worktrees.
+	busyBranches map[string]string
+	// heldBranches maps the branches checked out in the prunable worktrees and
+	// in the worktrees skipped by --skip-locked-worktrees to why they're left
+	// alone.
+	heldBranches map[string]string
+	// diverged maps the branches that had diverged from their upstreams at the
+	// start of the run to those upstreams; see RebaseDiverged.
+	diverged map[string]string
+	// tracked holds the branches that Options.TrackRemote created, in this run
+	// or an earlier one.
+	tracked map[string]bool
+	// skippedForcePushes maps the branches skipped by --sync-with-remote=skip,
+	// as they or the branches they contain have upstreams that were
+	// force-pushed, to why.
+	skippedForcePushes map[string]string
+	// boundaries maps the branches that the leaves contain that shouldn't be
+	// rebased to why; when working with stacks, they're left alone, and their
+	// children are rebased onto them (see stackBranches).
+	boundaries map[string]string
+	// duplicates maps the leaves that point at the same commit as another, which
+	// is rebased in their place, to that branch (see collapseDuplicates).
+	duplicates map[string]string
+	// sameCommit holds the leaves that point at the same commit as another that
+	// is rebased onto a different base (see restoreSameCommit).
+	sameCommit   map[string]bool
+	targetBranch string
+	// targetUpstream is the upstream of the target branch (e.g., origin/main),
+	// if any.
+	targetUpstream string
+	// originalBranches records each branch's commit SHA at the start of the run.
+	originalBranches map[string]string
+	// branch -> the outcome of rebasing it
+	outcomes map[string]outcome
+	// mu guards outcomes, which may be recorded concurrently, and backedUp.
+	mu sync.Mutex
+	// backedUp denotes that the branches have been backed up (see backup).
+	backedUp bool
+	restored []WorktreeResult
+	// deleted records the branches that were deleted by the run.
+	deleted map[string]bool
+	// skipped collects the conflicts of the branches that were skipped under
+	// --on-conflict=skip.
+	skipped []error
+	// branch -> the result of pushing it
+	pushes map[string]string
+	start  time.Time
+	// phases records how long each phase of the run took, for --stats.
+	phases []PhaseTiming
+	events eventWriter
+	// revTarget denotes that the target isn't a local branch but a
+	// remote-tracking branch, a tag, or a commit, which is resolved from
+	// targetRev. Its commit SHA is revTargetSHA as it isn't in branches.
+	revTarget    bool
+	revTargetSHA string
+	targetRev    string
+	// preserveMerges records the branches whose merge commits are to be
+	// preserved with --rebase-merges (see Options.Merges).
+	preserveMerges map[string]bool
+	// staleTarget denotes that the target branch couldn't be updated from its
+	// remote, and so the branches may be rebased onto a stale target.
+	staleTarget bool
+	opts        Options
+	git         *git
+	// out is where progress is written (see Options.progress).
+	out io.Writer
+}
+
+// Run does what git-rebase-all does with the given options: it aborts the
+// operations in progress, continues a paused run, prints the plan, the graph, or the
+// health of the branches, or performs a run and, with the JSON format, prints its
+// summary.
+func Run(ctx context.Context, opts Options) (err error) {
+	defer func() { err = cancelled(ctx, err) }()
+	opts = opts.withDefaults()
+	if opts.SelfTest {
+		return SelfTest(ctx, opts)
+	}
+	if err := opts.check(ctx); err != nil {
+		return err
+	}
+	if opts.ForceUnlock {
+		removed, err := forceUnlock(opts.git(ctx))
+		if err != nil {
+			return err
+		}
+		if removed {
+			fmt.Fprintln(opts.progress(), "Removed the lock file.")
+		}
+	}
+	if opts.AbortAll {
+		return locked(opts.git(ctx), func() error { return abortAll(ctx, opts) })
+	}
+	if opts.Undo {
+		return locked(opts.git(ctx), func() error { return undo(ctx, opts) })
+	}
+	if opts.Log {
+		return printLog(ctx, opts)
+	}
+	if opts.Status {
+		return status(ctx, opts)
+	}
+	if opts.CleanupCheckpoints {
+		return locked(opts.git(ctx), func() error { return cleanupCheckpoints(ctx, opts) })
+	}
+	if opts.Continue {
+		return locked(opts.git(ctx), func() error { return continueRun(ctx, opts) })
+	}
+	if opts.Watch {
+		return watch(ctx, opts)
+	}
+
+	s, err := newRun(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if opts.DryRun {
+		return s.dryRun()
+	}
+	if opts.DumpPlan != "" {
+		return s.dumpPlan()
+	}
+	if opts.Graph != "" {
+		return s.graph()
+	}
+	if opts.Health {
+		if !opts.Offline {
+			fmt.Fprintln(s.out, "Fetching and pruning...")
+			if err := s.git.fetch(s.currentDir, s.opts.fetchArgs()...); err != nil {
+				return fmt.Errorf("fetching and pruning: %w", err)
+			}
+		}
+		return s.health()
+	}
+	unlock, err := lock(s.git)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.Join(err, unlock()) }()
+	s.git.journal = &commandJournal{}
+	defer func() {
+		sum := s.summary(err)
+		s.printSummary(sum, err)
+		s.writeJournal(sum)
+		if s.opts.SummaryFile != "" {
+			err = errors.Join(err, writeSummaryFile(s.opts.SummaryFile, sum))
+		}
+	}()
+	return s.execute()
+}
+
+// Plan returns what a run with the given options would do against the local
+// state of the repository. Nothing is fetched or mutated.
+func Plan(ctx context.Context, opts Options) (PlanResult, error) {
+	opts = opts.withDefaults()
+	if err := opts.check(ctx); err != nil {
+		return PlanResult{}, err
+	}
+	s, err := newRun(ctx, opts)
+	if err != nil {
+		return PlanResult{}, err
+	}
+	if err := s.buildPlan(); err != nil {
+		return PlanResult{}, err
+	}
+	return s.plan(), nil
+}
+
+// Execute performs a run with the given options and returns its summary, which
+// is returned alongside any error once the run has started.
+func Execute(ctx context.Context, opts Options) (Summary, error) {
+	opts = opts.withDefaults()
+	if err := opts.check(ctx); err != nil {
+		return Summary{}, err
+	}
+	s, err := newRun(ctx, opts)
+	if err != nil {
+		return Summary{}, err
+	}
+	if opts.DumpPlan != "" {
+		return Summary{}, s.dumpPlan()
+	}
+	unlock, err := lock(s.git)
+	if err != nil {
+		return Summary{}, err
+	}
+	err = cancelled(ctx, s.execute())
+	err = errors.Join(err, unlock())
+	return s.summary(err), err
+}
+
+// cancelled attributes the error to the context if the context was cancelled,
+// as the error is then likely just the consequence of a killed command.
+func cancelled(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", context.Cause(ctx), err)
+}
+
+// newRun reads the state of the repository and checks it against the options
+// (and the plan, if one is to be loaded) before anything is mutated.
+func newRun(ctx context.Context, opts Options) (*state, error) {
+	g := opts.git(ctx)
+	if path, err := pausedRunPath(g, ""); err != nil {
+		return nil, err
+	} else if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("a paused run exists (path: %s); run git-rebase-all --continue to finish it", path)
+	}
+
+	var p PlanResult
+	if opts.LoadPlan != "" {
+		var err error
+		if p, err = readPlan(opts.LoadPlan); err != nil {
+			return nil, fmt.Errorf("loading the plan (path: %s): %w", opts.LoadPlan, err)
+		}
+		if opts.TargetBranch == "" {
+			opts.TargetBranch = p.Target
+		}
+	}
+
+	s, err := newState(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("constructing state struct: %w", err)
+	}
+	if opts.OntoUpstream && s.targetUpstream == "" {
+		return nil, fmt.Errorf("--onto-upstream was given, but the target branch %q has no upstream", s.targetBranch)
+	}
+	if err := s.setAsideWorktrees(); err != nil {
+		return nil, err
+	}
+	if opts.NoDecapitate && len(s.worktrees) > 1 {
+		return nil, fmt.Errorf("--no-decapitate requires a single worktree, but there are %d; the HEADs must be detached to rebase branches checked out elsewhere", len(s.worktrees))
+	}
+	s.start = time.Now()
+	s.originalBranches = maps.Clone(s.branches)
+
+	// The plan is checked against the branches before anything is mutated.
+	if opts.LoadPlan != "" {
+		if err := s.loadPlan(p); err != nil {
+			return nil, fmt.Errorf("loading the plan (path: %s): %w", opts.LoadPlan, err)
+		}
+	}
+	return s, nil
+}
+
+// execute performs the run: it fetches, updates the target branch, and rebases
+// the branches onto it before restoring the worktrees.
+func (s *state) execute() (err error) {
+	if err := s.checkBusyWorktrees(); err != nil {
+		return fmt.Errorf("checking for operations in progress: %w", err)
+	}
+
+	if err := s.errIfUncommittedChanges(); err != nil {
+		return fmt.Errorf("verifying that there are no uncommitted changes: %w", err)
+	}
+
+	if err := s.checkSparseCheckouts(); err != nil {
+		return fmt.Errorf("checking for sparse-checkouts: %w", err)
+	}
+
+	if err := s.checkConfig(); err != nil {
+		return fmt.Errorf("checking the git config: %w", err)
+	}
+
+	if s.opts.Checkpoint {
+		if err := s.checkpoint(); err != nil {
+			return fmt.Errorf("checkpointing the branches: %w", err)
+		}
+	}
+
+	if s.opts.PruneRemote {
+		if err := s.pruneRemotes(); err != nil {
+			return fmt.Errorf("pruning the remotes: %w", err)
+		}
+	}
+
+	fetchStart := time.Now()
+	s.timePhase("prepare", s.start)
+	switch {
+	case s.opts.Offline:
+		fmt.Fprintln(s.out, "Offline; not fetching.")
+	case s.opts.LoadPlan != "":
+		// A loaded plan is replayed against the target as it was planned.
+		fmt.Fprintln(s.out, "Replaying the plan; not fetching.")
+	default:
+		fmt.Fprintln(s.out, "Fetching and pruning...")
+		if err := s.git.fetch(s.currentDir, s.opts.fetchArgs()...); err != nil {
+			if !s.opts.TolerateFetchFailure {
+				return fmt.Errorf("fetching and pruning: %w", err)
+			}
+			s.warnf("fetching and pruning failed; continuing: %v", err)
+			s.staleTarget = true
+		}
+		s.verbosef("Fetched in %s.", time.Since(fetchStart).Round(time.Millisecond))
+		s.timePhase("fetch", fetchStart)
+	}
+	targetStart := time.Now()
+	if s.bare {
+		if err := s.addTempWorktree(); err != nil {
+			return fmt.Errorf("adding a worktree to the bare repository: %w", err)
+		}
+	}
+	defer func() {
+		// A paused run leaves the worktrees as they are until it's continued.
+		if !errors.Is(err, ErrPaused) {
+			start := time.Now()
+			err = errors.Join(err, s.restore())
+			s.timePhase("restore", start)
+		}
+	}()
+	// The branches are rolled back before the worktrees are restored.
+	defer func() {
+		var conflict *RebaseConflictError
+		if s.opts.OnConflict == "abort-all" && errors.As(err, &conflict) {
+			err = errors.Join(err, s.rollback())
+		}
+	}()
+
+	if s.opts.RefreshCommitGraph {
+		fmt.Fprintln(s.out, "Refreshing the commit-graph...")
+		start := time.Now()
+		if err := s.git.writeCommitGraph(s.currentDir); err != nil {
+			return fmt.Errorf("refreshing the commit-graph: %w", err)
+		}
+		fmt.Fprintf(s.out, "Refreshed the commit-graph in %s.\n", time.Since(start).Round(time.Millisecond))
+	}
+
+	// git doesn't permit a branch to be checked out in more than one worktree. By
+	// decapitating each worktree, we can work in a single directory (namely, the
+	// current directory). Alternatively, we can work in each branch's worktree.
+	// With a single worktree, restore returns it to its starting branch, so there
+	// is no need to decapitate if asked not to.
+	if s.decapitates() {
+		if err := s.decapitateAll(); err != nil {
+			return fmt.Errorf("failed to detach the HEAD for each worktree: %w", err)
+		}
+	}
+
+	if s.opts.Offline || s.opts.LoadPlan != "" {
+		fmt.Fprintf(s.out, "Rebasing onto %q as it is locally.\n", s.targetBranch)
+	} else {
+		if s.targetUpstream != "" {
+			fmt.Fprintf(s.out, "Updating %q (upstream: %s)...\n", s.targetBranch, s.targetUpstream)
+		} else {
+			fmt.Fprintf(s.out, "Updating %q...\n", s.targetBranch)
+		}
+		if err := s.updateTargetBranch(); err != nil {
+			return fmt.Errorf("updating target branch (%s): %w", s.targetBranch, err)
+		}
+		if err := s.updateMappedTargets(); err != nil {
+			return err
+		}
+	}
+	if s.opts.FetchOnly {
+		s.timePhase("target", targetStart)
+		fmt.Fprintln(s.out, "Stopping without rebasing, as --fetch-only was given.")
+		return nil
+	}
+
+	if s.opts.PruneGone {
+		if err := s.pruneGone(); err != nil {
+			return fmt.Errorf("pruning the branches whose upstream is gone: %w", err)
+		}
+	}
+	if s.opts.PruneMerged {
+		if err := s.pruneMerged(); err != nil {
+			return fmt.Errorf("pruning the merged branches: %w", err)
+		}
+	}
+	if len(s.opts.TrackRemote) > 0 {
+		if err := s.trackRemoteBranches(); err != nil {
+			return fmt.Errorf("tracking the remote's branches: %w", err)
+		}
+	}
+	if s.tracked, err = s.git.trackedBranches(s.currentDir); err != nil {
+		return fmt.Errorf("listing the branches created by --track-remote: %w", err)
+	}
+	if s.opts.SyncWithRemote != "" {
+		if err := s.syncWithRemote(); err != nil {
+			return fmt.Errorf("syncing the force-pushed branches: %w", err)
+		}
+	}
+
+	s.timePhase("target", targetStart)
+
+	planStart := time.Now()
+	if err := s.ensureHistory(); err != nil {
+		return fmt.Errorf("checking the history of the shallow clone: %w", err)
+	}
+
+	if err := s.buildPlan(); err != nil {
+		return err
+	}
+	s.timePhase("plan", planStart)
+	if s.opts.Interactive {
+		if err := s.selectBranches(); err != nil {
+			return fmt.Errorf("selecting the branches to rebase: %w", err)
+		}
+	}
+	for _, b := range sortedKeys(s.filtered) {
+		fmt.Fprintf(s.out, "Skipping %q: %s.\n", b, s.filtered[b])
+	}
+	if s.stackAware() {
+		fmt.Fprintln(s.out, "Stacks:")
+		for _, line := range s.stacks() {
+			fmt.Fprintf(s.out, "  %s\n", line)
+		}
+	}
+	for _, b := range s.branchesToRebase {
+		if a := s.actions[b]; a != "" {
+			s.verbosef("Planned %q: %s onto %s (dir: %s).", b, a, s.baseFor(b), s.dirFor(b))
+		} else {
+			s.verbosef("Planned %q onto %s (dir: %s).", b, s.baseFor(b), s.dirFor(b))
+		}
+	}
+
+	if err := s.prefetch(); err != nil {
+		return fmt.Errorf("prefetching the objects for the rebases: %w", err)
+	}
+
+	if s.opts.PredictConflicts {
+		fmt.Fprintln(s.out, "Predicting conflicts...")
+		if err := s.predictConflicts(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.confirmPlan(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(s.out, "Updating the branches...")
+	rebaseStart := time.Now()
+	if err := s.rebaseBranches(); err != nil {
+		return fmt.Errorf("rebasing the branches: %w", err)
+	}
+	if err := s.moveDuplicates(); err != nil {
+		return fmt.Errorf("moving the duplicate branches: %w", err)
+	}
+
+	if s.opts.RepeatUntilStable {
+		if err := s.repeatUntilStable(); err != nil {
+			return err
+		}
+	}
+	s.timePhase("rebase", rebaseStart)
+
+	if s.opts.Push {
+		fmt.Fprintln(s.out, "Pushing the branches...")
+		pushStart := time.Now()
+		if err := s.pushBranches(); err != nil {
+			return fmt.Errorf("pushing the branches: %w", err)
+		}
+		s.timePhase("push", pushStart)
+	}
+
+	if s.opts.SetUpstream {
+		fmt.Fprintln(s.out, "Setting the upstreams...")
+		if err := s.setUpstreams(); err != nil {
+			return fmt.Errorf("setting the upstreams: %w", err)
+		}
+	}
+
+	if s.staleTarget {
+		fmt.Fprintf(s.out, "Note: fetching failed, so %q may be stale.\n", s.targetBranch)
+	}
+
+	var errs []error
+	if len(s.skipped) > 0 {
+		fmt.Fprintln(s.out, "These branches conflicted and were skipped; they need to be updated manually:")
+		for _, err := range s.skipped {
+			var conflict *RebaseConflictError
+			if errors.As(err, &conflict) {
+				fmt.Fprintf(s.out, "  %s\n", conflict.Branch)
+			}
+		}
+		errs = append(errs, fmt.Errorf("skipped the conflicted branches (count: %d): %w", len(s.skipped), errors.Join(s.skipped...)))
+	}
+	if unverified := s.unverified(); len(unverified) > 0 {
+		fmt.Fprintln(s.out, "These branches failed verification and were rolled back:")
+		for _, b := range unverified {
+			fmt.Fprintf(s.out, "  %s\n", b)
+		}
+		errs = append(errs, fmt.Errorf("%w (branches: %s)", ErrVerificationFailed, strings.Join(unverified, ", ")))
+	}
+	return errors.Join(errs...)
+}
+
+func (g *git) validateVersion() error {
+	bs, err := g.run("", "--version")
+	s := trimbs(bs)
+	if err != nil {
+		return fmt.Errorf("running `git --version`: %w (output: %s)", err, s)
+	}
+
+	var major, minor, patch int
+	if _, err := fmt.Sscanf(s, "git version %d.%d.%d", &major, &minor, &patch); err != nil {
+		return fmt.Errorf(`expected a version string in the form "git version <major>.<minor>.<patch>"; given %q`, s)
+	}
+	if major < MinGitMajorVersion {
+		return fmt.Errorf("%w: the major version is too low (given: %d, minimum: %d)", ErrGitTooOld, major, MinGitMajorVersion)
+	}
+	if major == MinGitMajorVersion && minor < MinGitMinorVersion {
+		return fmt.Errorf("%w: the minor version is too low (given: %d, minimum: %d)", ErrGitTooOld, minor, MinGitMinorVersion)
+	}
+	return nil
+}
+
+// abortAll aborts the operations in progress in each worktree.
+func abortAll(ctx context.Context, opts Options) error {
+	g := opts.git(ctx)
+	dirs, err := g.worktreeDirs()
+	if err != nil {
+		return fmt.Errorf("listing the worktrees: %w", err)
+	}
+
+	for _, dir := range dirs {
+		ops, err := g.inProgress(dir)
+		if err != nil {
+			return fmt.Errorf("detecting the operations in progress (dir: %s): %w", dir, err)
+		}
+		if len(ops) == 0 {
+			fmt.Fprintf(opts.Stdout, "%s: nothing in progress.\n", dir)
+			continue
+		}
+		for _, op := range ops {
+			if err := g.abortOperation(dir, op); err != nil {
+				return fmt.Errorf("aborting the %s in progress: %w", op, err)
+			}
+			fmt.Fprintf(opts.Stdout, "%s: aborted the %s in progress.\n", dir, op)
+		}
+	}
+	return nil
+}
+
+func newState(ctx context.Context, opts Options) (*state, error) {
+	g := opts.git(ctx)
+	targetBranch := opts.TargetBranch
+	currentDir, err := opts.workDir()
+	if err != nil {
+		return nil, err
+	}
+
+	worktrees, err := g.worktrees()
+	if err != nil {
+		return nil, fmt.Errorf("fetching and parsing worktrees: %w", err)
+	}
+
+	// A bare repository has no work tree in which to rebase, so one of its
+	// worktrees stands in for the current directory. If it has none, then a
+	// temporary worktree is added by execute.
+	bare, err := g.isBare(currentDir)
+	if err != nil {
+		return nil, fmt.Errorf("checking whether the repository is bare: %w", err)
+	}
+	live := slices.IndexFunc(worktrees, func(w worktree) bool { return !w.prunable })
+	if bare && live >= 0 {
+		currentDir = worktrees[live].dir
+	}
+
+	var topLevel string
+	if !bare || live >= 0 {
+		if topLevel, err = g.toplevel(currentDir); err != nil {
+			return nil, fmt.Errorf("fetching the top-level directory: %w", err)
+		}
+	}
+
+	branches, err := g.branches(currentDir)
+	if err != nil {
+		return nil, fmt.Errorf("listing the local branches: %w", err)
+	}
+
+	// The target may be a remote-tracking branch (e.g., origin/main), a tag, or
+	// a commit, in which case it's neither checked out nor pulled.
+	branchNames := sortedKeys(branches)
+	var targetRev, revTargetSHA string
+	if targetBranch != "" && !contains(branchNames, targetBranch) {
+		if targetRev, revTargetSHA, err = resolveTarget(g, currentDir, targetBranch); err != nil {
+			return nil, err
+		}
+	}
+	if targetBranch == "" {
+		if targetBranch, revTargetSHA, err = defaultTarget(g, currentDir, opts.Remote, branchNames); err != nil {
+			return nil, err
+		}
+		if revTargetSHA != "" {
+			targetRev = "refs/remotes/" + targetBranch
+		}
+	}
+	if targetBranch == "" && contains(branchNames, "main") {
+		targetBranch = "main"
+	}
+	if targetBranch == "" && contains(branchNames, "master") {
+		targetBranch = "master"
+	}
+	if targetBranch == "" {
+		return nil, fmt.Errorf("%w: no branch was specified, no remote has a HEAD, and main and master could not be found", ErrTargetNotFound)
+	}
+
+	targetUpstream, err := g.upstream(currentDir, targetBranch)
+	if err != nil {
+		return nil, fmt.Errorf("resolving the upstream of the target branch (%s): %w", targetBranch, err)
+	}
+
+	return &state{
+		worktrees:      worktrees,
+		branches:       branches,
+		currentDir:     currentDir,
+		topLevel:       topLevel,
+		bare:           bare && live < 0,
+		targetBranch:   targetBranch,
+		targetUpstream: targetUpstream,
+		revTarget:      revTargetSHA != "",
+		revTargetSHA:   revTargetSHA,
+		targetRev:      targetRev,
+		opts:           opts,
+		git:            g,
+		out:            opts.progress(),
+	}, nil
+}
+
+// resolveTarget resolves a target that isn't a local branch: first as a
+// remote-tracking branch, then as a tag, and then as any revision. It returns
+// what to resolve it from after fetching, which, for a revision other than a
+// branch or a tag, is its SHA, so that it doesn't move during the run.
+func resolveTarget(g *git, dir, target string) (rev, sha string, err error) {
+	for _, ref := range []string{"refs/remotes/" + target, "refs/tags/" + target} {
+		if sha, err = g.resolve(dir, ref); err != nil {
+			return "", "", fmt.Errorf("resolving the target %q: %w", ref, err)
+		}
+		if sha != "" {
+			return ref, sha, nil
+		}
+	}
+	if sha, err = g.resolve(dir, target); err != nil {
+		return "", "", fmt.Errorf("resolving the target %q: %w", target, err)
+	}
+	if sha == "" {
+		return "", "", fmt.Errorf("%w (given: %s)", ErrTargetNotFound, target)
+	}
+	return sha, sha, nil
+}
+
+// defaultTarget returns the branch to which the HEAD of a remote points,
+// looking first at the given remote and then at the others. It's the local
+// branch of the same name if there is one and is otherwise the remote-tracking
+// branch, in which case its SHA is also returned. If no remote has a HEAD, it
+// returns the empty string.
+func defaultTarget(g *git, dir, remote string, branchNames []string) (target, remoteSHA string, err error) {
+	remotes, err := g.remotes(dir)
+	if err != nil {
+		return "", "", err
+	}
+	if i := slices.Index(remotes, remote); i > 0 {
+		remotes = append([]string{remote}, slices.Delete(remotes, i, i+1)...)
+	}
+	for _, r := range remotes {
+		head, err := g.remoteHead(dir, r)
+		if err != nil {
+			return "", "", err
+		}
+		if head == "" {
+			continue
+		}
+		if name := strings.TrimPrefix(head, r+"/"); contains(branchNames, name) {
+			return name, "", nil
+		}
+		if remoteSHA, err = g.resolve(dir, "refs/remotes/"+head); err != nil {
+			return "", "", fmt.Errorf("resolving the remote-tracking branch %q: %w", head, err)
+		}
+		if remoteSHA != "" {
+			return head, remoteSHA, nil
+		}
+	}
+	return "", "", nil
+}
+
+// fetchArgs returns the arguments to pass to `git fetch --prune` under
+// --fetch-all and --recurse-submodules.
+func (o Options) fetchArgs() []string {
+	var args []string
+	if o.FetchAll {
+		args = append(args, "--all", "--prune-tags")
+	}
+	if o.RecurseSubmodules {
+		args = append(args, "--recurse-submodules")
+	}
+	return args
+}
+
+func (s *state) errIfUncommittedChanges() error {
+	for _, w := range s.worktrees {
+		out, err := s.git.status(w.dir)
+		if err != nil {
+			return fmt.Errorf("checking for uncommitted changes (dir: %s): %w", w.dir, err)
+		}
+		if len(out) > 0 {
+			return fmt.Errorf("%w (dir: %s)", ErrUncommittedChanges, w.dir)
+		}
+	}
+	return nil
+}
+
+// checkBusyWorktrees refuses to run if any worktree has an operation in
+// progress, as detaching its HEAD would corrupt it. With --skip-busy-worktrees,
+// those worktrees are instead left alone: they're neither detached nor
+// restored, and the branches on which they're working aren't rebased.
+func (s *state) checkBusyWorktrees() error {
+	var busy []string
+	var idle []worktree
+	s.busyBranches = make(map[string]string)
+	for _, w := range s.worktrees {
+		ops, branch, err := s.git.operations(w.dir)
+		if err != nil {
+			return fmt.Errorf("detecting the operations in progress (dir: %s): %w", w.dir, err)
+		}
+		if len(ops) == 0 {
+			idle = append(idle, w)
+			continue
+		}
+		busy = append(busy, fmt.Sprintf("%s (%s)", w.dir, strings.Join(ops, ", ")))
+		if s.opts.SkipBusyWorktrees && samePath(w.dir, s.topLevel) {
+			return fmt.Errorf("%w in the current worktree, which can't be skipped (dir: %s, operations: %s)", ErrWorktreeBusy, w.dir, strings.Join(ops, ", "))
+		}
+		for _, b := range []string{w.branch, branch} {
+			if b != "" {
+				s.busyBranches[b] = w.dir
+			}
+		}
+	}
+	if len(busy) == 0 {
+		return nil
+	}
+	if !s.opts.SkipBusyWorktrees {
+		return fmt.Errorf("%w (worktrees: %s); finish or abort them, or pass --skip-busy-worktrees", ErrWorktreeBusy, strings.Join(busy, "; "))
+	}
+	s.warnf("skipping the worktrees with operations in progress: %s", strings.Join(busy, "; "))
+	s.worktrees = idle
+	return nil
+}
+
+// setAsideWorktrees leaves alone the prunable worktrees, whose directories are
+// gone, and, with --skip-locked-worktrees, the locked ones, warning about each.
+// The branches they have checked out can't be checked out elsewhere, so they're
+// skipped, too.
+func (s *state) setAsideWorktrees() error {
+	s.heldBranches = make(map[string]string)
+	var kept []worktree
+	for _, w := range s.worktrees {
+		switch {
+		case w.prunable:
+			s.warnf("skipping the worktree at %s, whose directory is missing; run `git worktree prune` to remove it", w.dir)
+			if w.branch != "" {
+				s.heldBranches[w.branch] = "checked out in a prunable worktree (dir: " + w.dir + ")"
+			}
+		case w.locked && s.opts.SkipLockedWorktrees:
+			if samePath(w.dir, s.topLevel) {
+				return fmt.Errorf("the current worktree is locked, so it can't be skipped (dir: %s)", w.dir)
+			}
+			s.warnf("skipping the locked worktree at %s", w.dir)
+			if w.branch != "" {
+				s.heldBranches[w.branch] = "checked out in a locked worktree (dir: " + w.dir + ")"
+			}
+		default:
+			kept = append(kept, w)
+		}
+	}
+	s.worktrees = kept
+	return nil
+}
+
+// checkSparseCheckouts warns about (or, if strict, refuses) worktrees that have
+// sparse-checkout enabled, as rebasing can touch paths outside of the sparse
+// cone.
+func (s *state) checkSparseCheckouts() error {
+	var dirs []string
+	for _, w := range s.worktrees {
+		sparse, err := s.git.configBool(w.dir, "core.sparseCheckout")
+		if err != nil {
+			return fmt.Errorf("reading core.sparseCheckout (dir: %s): %w", w.dir, err)
+		}
+		if sparse {
+			dirs = append(dirs, w.dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil
+	}
+	if s.opts.Strict {
+		return fmt.Errorf("sparse-checkout is enabled (dirs: %s)", strings.Join(dirs, ", "))
+	}
+	s.warnf("sparse-checkout is enabled (dirs: %s); rebasing may touch paths outside of the sparse cone", strings.Join(dirs, ", "))
+	return nil
+}
+
+// checkConfig warns about the user's git config that conflicts with the
+// settings that every rebase and merge is run with (see pinnedSettings), which
+// override it for this run.
+func (s *state) checkConfig() error {
+	for _, p := range pinnedSettings {
+		get := s.git.configValue
+		if p.isBool {
+			get = func(dir, key string) (string, error) { return s.git.getConfig(dir, "--type=bool", "--get", key) }
+		}
+		v, err := get(s.currentDir, p.key)
+		if err != nil {
+			return err
+		}
+		if v != "" && v != p.value {
+			s.warnf("overriding %s=%s with %s for this run, as %s", p.key, v, p.value, p.why)
+		}
+	}
+	return nil
+}
+
+func (s *state) pruneRemotes() error {
+	rs, err := s.git.remotes(s.currentDir)
+	if err != nil {
+		return fmt.Errorf("listing the remotes: %w", err)
+	}
+
+	for _, r := range rs {
+		fmt.Fprintf(s.out, "Pruning %q...\n", r)
+		pruned, err := s.git.pruneRemote(s.currentDir, r)
+		if err != nil {
+			return fmt.Errorf("pruning the remote %q: %w", r, err)
+		}
+		if len(pruned) == 0 {
+			fmt.Fprintln(s.out, "  Nothing to prune.")
+		}
+		for _, ref := range pruned {
+			fmt.Fprintf(s.out, "  Pruned %s.\n", ref)
+		}
+	}
+	return nil
+}
+
+// decapitates reports whether every worktree's HEAD is to be detached.
+func (s *state) decapitates() bool { return !s.opts.PerWorktree && !s.opts.NoDecapitate }
+
+func (s *state) decapitateAll() error {
+	for _, w := range s.worktrees {
+		if err := s.git.decapitate(w.dir); err != nil {
+			return fmt.Errorf("failed to the detach the HEAD (dir: %s): %w", w.dir, err)
+		}
+		s.verbosef("Detached the HEAD (dir: %s).", w.dir)
+	}
+	return nil
+}
+
+// constructBranchesToRebase comprises two types of branch: "leaf" branches and
+// those branches that are "behind" the target branch and so can be
+// fast-forwarded. We'll collapse any distinction between the two categories.
+func (s *state) constructBranchesToRebase() error {
+	s.branchesToRebase = sortedKeys(s.branches)
+	s.actions = make(map[string]string, len(s.branches))
+	targetSHA, ok := s.sha(s.targetBranch)
+	if !ok {
+		return fmt.Errorf("unable to find the branch %q in the state: this should be unreachable", s.targetBranch)
+	}
+
+	// The leaves, the branches that contain the target, and those that it
+	// contains are each found with a single git command, however many branches
+	// there are. The target's commit is included, as it isn't a branch's when
+	// the target is a tag or a commit (see revTarget), so that the branches
+	// behind it aren't taken to be leaves.
+	shas := make([]string, 0, len(s.branches)+1)
+	shas = append(shas, targetSHA)
+	for _, b := range s.branchesToRebase {
+		if !slices.Contains(shas, s.branches[b]) {
+			shas = append(shas, s.branches[b])
+		}
+	}
+	leaves, err := s.git.independent(s.currentDir, shas)
+	if err != nil {
+		return fmt.Errorf("finding the leaf branches: %w", err)
+	}
+	targetChildren, err := s.branchChildren(s.currentDir, s.targetBranch)
+	if err != nil {
+		return err
+	}
+	merged, err := s.git.mergedBranches(s.currentDir, s.targetBranch)
+	if err != nil {
+		return fmt.Errorf("listing the branches merged into %q: %w", s.targetBranch, err)
+	}
+
+	i := 0
+	for _, branch := range s.branchesToRebase {
+		s.actions[branch] = actionSkip
+
+		// A branch that --target-map maps onto another target is classified
+		// against that target rather than the run's.
+		if t := s.mappedTarget(branch); t != "" && t != s.base() && t != branch && branch != s.targetBranch {
+			action, err := s.classifyMapped(branch, t, leaves[s.branches[branch]])
+			if err != nil {
+				return err
+			}
+			if s.actions[branch] = action; action != actionSkip {
+				s.branchesToRebase[i] = branch
+				i++
+			}
+			continue
+		}
+
+		// If the branch is a proper child of the target branch, then there is no
+		// need to rebase it.
+		if slices.Contains(targetChildren, branch) {
+			continue
+		}
+
+		// If no other branch contains the branch's commit, it is a "leaf" branch
+		// and should be rebased.
+		if leaves[s.branches[branch]] {
+			s.actions[branch] = actionLeaf
+			s.branchesToRebase[i] = branch
+			i++
+			continue
+		}
+
+		// If the target branch contains the branch, and if the branch and the
+		// target branch don't point to the same commit, then we should rebase.
+		if slices.Contains(merged, branch) && s.branches[branch] != targetSHA {
+			s.actions[branch] = actionFastForward
+			s.branchesToRebase[i] = branch
+			i++
+		}
+	}
+	s.branchesToRebase = s.branchesToRebase[:i]
+	return nil
+}
+
+// classifyMapped returns the action for the branch, which --target-map maps
+// onto target, as constructBranchesToRebase does for the run's target: it's
+// skipped if it contains the target, rebased if it's a leaf, and fast-forwarded
+// if the target contains it.
+func (s *state) classifyMapped(branch, target string, leaf bool) (string, error) {
+	contains, err := s.git.isAncestor(s.currentDir, target, branch)
+	if err != nil {
+		return "", fmt.Errorf("checking whether %q contains %q: %w", branch, target, err)
+	}
+	if contains {
+		return actionSkip, nil
+	}
+	if leaf {
+		return actionLeaf, nil
+	}
+	merged, err := s.git.isAncestor(s.currentDir, branch, target)
+	if err != nil {
+		return "", fmt.Errorf("checking whether %q is merged into %q: %w", branch, target, err)
+	}
+	if merged {
+		return actionFastForward, nil
+	}
+	return actionSkip, nil
+}
+
+// filterBranches removes from branchesToRebase those branches that shouldn't be
+// rebased, recording why in filtered.
+func (s *state) filterBranches() error {
+	match, err := s.authorMatcher()
+	if err != nil {
+		return err
+	}
+	var signatures map[string][]string
+	if match != nil {
+		if signatures, err = s.git.branchSignatures(s.currentDir); err != nil {
+			return fmt.Errorf("listing the authors of the branches: %w", err)
+		}
+	}
+
+	var times map[string]time.Time
+	if s.opts.MaxAge > 0 {
+		if times, err = s.git.branchCommitTimes(s.currentDir); err != nil {
+			return fmt.Errorf("listing the times of the branches' tip commits: %w", err)
+		}
+	}
+	now := time.Now()
+
+	protected, err := s.unmergedProtected()
+	if err != nil {
+		return err
+	}
+
+	// The branches are checked only once, as those rebased by an earlier pass
+	// of --repeat-until-stable will have diverged.
+	if s.diverged == nil && !s.opts.RebaseDiverged {
+		if s.diverged, err = s.git.divergedBranches(s.currentDir); err != nil {
+			return fmt.Errorf("listing the branches that have diverged from their upstreams: %w", err)
+		}
+	}
+
+	var openPRs map[string]bool
+	if s.opts.OnlyOpenPRs {
+		if openPRs, err = s.openPRBranches(); err != nil {
+			return fmt.Errorf("listing the open pull requests: %w", err)
+		}
+	}
+
+	reason := func(b string) string {
+		if s.deselected[b] {
+			return "deselected with -i"
+		}
+		if len(s.opts.Include) > 0 && matchPattern(s.opts.Include, b) == "" {
+			return "not included by --include"
+		}
+		if len(s.opts.Groups) > 0 && !slices.ContainsFunc(s.opts.Groups, func(g string) bool { return inGroup(g, b) }) {
+			return "not in a group named by --group"
+		}
+		if p := matchPattern(s.opts.Exclude, b); p != "" {
+			return fmt.Sprintf("excluded by %q", p)
+		}
+		if slices.Contains(s.mappedTargets(), b) {
+			return "a target of --target-map"
+		}
+		if t, ok := times[b]; ok && b != s.targetBranch && now.Sub(t) > s.opts.MaxAge {
+			return fmt.Sprintf("stale: its last commit is %s old (see --max-age)", formatAge(now.Sub(t)))
+		}
+		if _, ok := protected[b]; ok {
+			return fmt.Sprintf("protected by %q (see --allow-protected)", matchPattern(s.opts.Protected, b))
+		}
+		for _, p := range sortedKeys(protected) {
+			if slices.Contains(protected[p], b) {
+				return fmt.Sprintf("rebasing it would rewrite the protected branch %s (see --allow-protected)", p)
+			}
+		}
+		if why, ok := s.skippedForcePushes[b]; ok {
+			return why
+		}
+		if up, ok := s.diverged[b]; ok && b != s.targetBranch && up != s.targetBranch && up != s.targetUpstream && !s.tracksRemote(b, up) {
+			return "diverged from its upstream, " + up + ", which others may have pulled (see --rebase-diverged)"
+		}
+		if dir, ok := s.busyBranches[b]; ok {
+			return "being worked on in a busy worktree (dir: " + dir + ")"
+		}
+		if why, ok := s.heldBranches[b]; ok {
+			return why
+		}
+		if openPRs != nil && !openPRs[b] && b != s.targetBranch {
+			return "has no open pull request on " + s.opts.Remote
+		}
+		if match != nil && !slices.ContainsFunc(signatures[b], match) {
+			return "neither authored nor committed by a matching user (author: " + signatures[b][0] + ")"
+		}
+
+		// When working per worktree, branches checked out in other worktrees are
+		// left alone unless they're explicitly allowed.
+		if s.opts.PerWorktree && matchPattern(s.opts.RebaseCheckedOut, b) == "" {
+			for _, w := range s.worktrees {
+				if w.branch == b && !samePath(w.dir, s.topLevel) {
+					return "checked out elsewhere (dir: " + w.dir + ")"
+				}
+			}
+		}
+		return ""
+	}
+	s.filtered = make(map[string]string)
+	s.branchesToRebase = slices.DeleteFunc(s.branchesToRebase, func(b string) bool {
+		if why := reason(b); why != "" {
+			s.filtered[b] = why
+			return true
+		}
+		return false
+	})
+	// The branches that the leaves contain are checked, too, as those that
+	// shouldn't be rebased are the boundaries of the stacks.
+	s.boundaries = make(map[string]string)
+	if s.stackAware() {
+		for _, b := range sortedKeys(s.branches) {
+			if _, ok := s.filtered[b]; ok || b == s.targetBranch || slices.Contains(s.branchesToRebase, b) {
+				continue
+			}
+			if why := reason(b); why != "" {
+				s.boundaries[b] = why
+			}
+		}
+	}
+	// A branch skipped by --sync-with-remote that's contained by another isn't
+	// a leaf, so it's recorded here.
+	for b, why := range s.skippedForcePushes {
+		if _, ok := s.filtered[b]; !ok {
+			s.filtered[b] = why
+		}
+	}
+	return nil
+}
+
+// unmergedProtected returns the protected branches, other than the target,
+// that aren't merged into the target, each mapped to the branches that contain
+// it. Rebasing any of these branches would rewrite a protected branch; the
+// protected branches that are merged can only be fast-forwarded.
+func (s *state) unmergedProtected() (map[string][]string, error) {
+	out := make(map[string][]string)
+	if s.opts.AllowProtected {
+		return out, nil
+	}
+	for _, b := range sortedKeys(s.branches) {
+		if b == s.targetBranch || matchPattern(s.opts.Protected, b) == "" {
+			continue
+		}
+		merged, err := s.git.isAncestor(s.currentDir, b, s.targetBranch)
+		if err != nil {
+			return nil, fmt.Errorf("checking whether %q is merged into %q: %w", b, s.targetBranch, err)
+		}
+		if merged {
+			continue
+		}
+		if out[b], err = s.branchChildren(s.currentDir, b); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// authorMatcher returns a function that reports whether an author or committer,
+// in the form "Name <email>", is matched by --mine or --author, or nil if
+// neither was given.
+func (s *state) authorMatcher() (func(string) bool, error) {
+	switch {
+	case s.opts.Mine:
+		email, err := s.git.configValue(s.currentDir, "user.email")
+		if err != nil {
+			return nil, fmt.Errorf("reading user.email: %w", err)
+		}
+		if email == "" {
+			return nil, errors.New("--mine requires user.email to be set")
+		}
+		suffix := "<" + strings.ToLower(email) + ">"
+		return func(sig string) bool { return strings.HasSuffix(strings.ToLower(sig), suffix) }, nil
+	case s.opts.Author != "":
+		// The pattern was validated by Validate.
+		return regexp.MustCompile(s.opts.Author).MatchString, nil
+	}
+	return nil, nil
+}
+
+// orderBranches sorts the branches to rebase, which are sorted by name, by
+// Options.Sort, then reverses them if Options.Order is "desc". Ties are
+// ordered by name.
+func (s *state) orderBranches() error {
+	keys := make(map[string]int64, len(s.branchesToRebase))
+	switch s.opts.Sort {
+	case "commits":
+		for _, b := range s.branchesToRebase {
+			ahead, _, err := s.git.aheadBehind(s.currentDir, s.targetBranch, b)
+			if err != nil {
+				return fmt.Errorf("counting the commits of %q that aren't in %q: %w", b, s.targetBranch, err)
+			}
+			keys[b] = int64(ahead)
+		}
+	case "recent":
+		for _, b := range s.branchesToRebase {
+			t, err := s.git.commitTime(s.currentDir, b)
+			if err != nil {
+				return fmt.Errorf("finding when %q was last committed to: %w", b, err)
+			}
+			keys[b] = -t.Unix()
+		}
+	}
+	slices.SortStableFunc(s.branchesToRebase, func(a, b string) int { return cmp.Compare(keys[a], keys[b]) })
+	if s.opts.Order == "desc" {
+		slices.Reverse(s.branchesToRebase)
+	}
+	return nil
+}
+
+// dirFor returns the directory in which to operate on the given branch. This is
+// the current directory unless the branch is checked out in a worktree and
+// we're working per worktree.
+func (s *state) dirFor(branch string) string {
+	if s.opts.PerWorktree {
+		for _, w := range s.worktrees {
+			if w.branch == branch {
+				return w.dir
+			}
+		}
+	}
+	return s.currentDir
+}
+
+// sha returns the commit SHA of the branch, which may be a target that isn't a
+// local branch.
+func (s *state) sha(branch string) (string, bool) {
+	if s.revTarget && branch == s.targetBranch {
+		return s.revTargetSHA, true
+	}
+	sha, ok := s.branches[branch]
+	return sha, ok
+}
+
+func (s *state) updateTargetBranch() error {
+	if s.revTarget {
+		sha, err := s.git.resolve(s.currentDir, s.targetRev)
+		if err != nil {
+			return fmt.Errorf("resolving the target %q: %w", s.targetRev, err)
+		}
+		if sha == "" {
+			return fmt.Errorf("%w: %q no longer exists after fetching", ErrTargetNotFound, s.targetRev)
+		}
+		s.revTargetSHA = sha
+		return nil
+	}
+
+	if s.opts.FetchTarget {
+		fetched, err := s.fetchTarget()
+		if err != nil {
+			if errors.Is(err, ErrTargetDiverged) || !s.opts.TolerateFetchFailure {
+				return err
+			}
+			s.warnf("fetching %q failed; continuing with the local branch: %v", s.targetBranch, err)
+			s.staleTarget = true
+			fetched = true
+		}
+		if fetched {
+			return nil
+		}
+	}
+
+	dir := s.dirFor(s.targetBranch)
+	if err := s.git.checkout(dir, s.targetBranch); err != nil {
+		return fmt.Errorf("checking out the target branch (dir: %s, branch: %s): %w", dir, s.targetBranch, err)
+	}
+	if err := s.pullTarget(dir); err != nil {
+		if errors.Is(err, ErrTargetDiverged) || !s.opts.TolerateFetchFailure {
+			return fmt.Errorf("pulling (dir: %s, branch: %s): %w", dir, s.targetBranch, err)
+		}
+		s.warnf("pulling %q failed; continuing with the local branch: %v", s.targetBranch, err)
+		s.staleTarget = true
+	}
+
+	newSHA, err := s.git.branchToSHA(dir, s.targetBranch)
+	if err != nil {
+		return fmt.Errorf("updating the target branch (%s) commit SHA: %w", s.targetBranch, err)
+	}
+	s.branches[s.targetBranch] = newSHA
+	return nil
+}
+
+// mappedTargets returns the targets of Options.TargetMap other than the run's.
+func (s *state) mappedTargets() []string {
+	var targets []string
+	for _, m := range s.opts.TargetMap {
+		if m.Target != s.targetBranch && !slices.Contains(targets, m.Target) {
+			targets = append(targets, m.Target)
+		}
+	}
+	return targets
+}
+
+// mappedTarget returns the target of Options.TargetMap onto which the branch is
+// to be rebased, or the empty string if there's none.
+func (s *state) mappedTarget(branch string) string {
+	for _, m := range s.opts.TargetMap {
+		if ok, _ := path.Match(m.Pattern, branch); ok {
+			return m.Target
+		}
+	}
+	return ""
+}
+
+// updateMappedTargets fast-forwards each target of Options.TargetMap to its
+// upstream, if it has one. A target that has diverged from its upstream, or is
+// checked out in a worktree that wasn't detached, is warned about and left as
+// it is.
+func (s *state) updateMappedTargets() error {
+	for _, t := range s.mappedTargets() {
+		if _, ok := s.branches[t]; !ok {
+			return fmt.Errorf("%w: %q, a target of --target-map", ErrTargetNotFound, t)
+		}
+		up, err := s.git.upstream(s.currentDir, t)
+		if err != nil {
+			return fmt.Errorf("resolving the upstream of %q: %w", t, err)
+		}
+		if up == "" {
+			continue
+		}
+		fmt.Fprintf(s.out, "Updating %q (upstream: %s)...\n", t, up)
+		ahead, behind, err := s.git.aheadBehind(s.currentDir, up, t)
+		if err != nil {
+			return fmt.Errorf("comparing %q with its upstream (%s): %w", t, up, err)
+		}
+		checkedOut := !s.decapitates() && slices.ContainsFunc(s.worktrees, func(w worktree) bool { return w.branch == t })
+		switch {
+		case behind == 0:
+			continue
+		case ahead > 0:
+			s.warnf("%q has diverged from its upstream, %s (ahead: %d, behind: %d); rebasing onto it as it is", t, up, ahead, behind)
+			continue
+		case checkedOut:
+			s.warnf("%q is checked out in another worktree, so it can't be updated; rebasing onto it as it is", t)
+			continue
+		}
+		sha, err := s.git.resolve(s.currentDir, up)
+		if err != nil {
+			return fmt.Errorf("resolving the upstream of %q (upstream: %s): %w", t, up, err)
+		}
+		if err := s.backup(); err != nil {
+			return err
+		}
+		if err := s.git.updateRef(s.currentDir, "refs/heads/"+t, sha); err != nil {
+			return fmt.Errorf("updating %q: %w", t, err)
+		}
+		s.branches[t] = sha
+	}
+	return nil
+}
+
+// mapTargets records the target of Options.TargetMap onto which each branch to
+// rebase is to be rebased, other than those already recorded (e.g., by a loaded
+// plan).
+func (s *state) mapTargets() {
+	if s.bases == nil {
+		s.bases = make(map[string]string)
+	}
+	for _, b := range s.branchesToRebase {
+		if _, ok := s.bases[b]; ok {
+			continue
+		}
+		if t := s.mappedTarget(b); t != "" && t != s.base() {
+			s.bases[b] = t
+		}
+	}
+}
+
+// fetchTarget fast-forwards the target branch to its upstream without checking
+// it out (see Options.FetchTarget). It returns false, having done nothing, if
+// the target has to be checked out to be updated.
+func (s *state) fetchTarget() (bool, error) {
+	remote, merge, err := s.git.upstreamConfig(s.currentDir, s.targetBranch)
+	if err != nil {
+		return false, err
+	}
+	checkedOut := !s.decapitates() && slices.ContainsFunc(s.worktrees, func(w worktree) bool { return w.branch == s.targetBranch })
+	if remote == "" || remote == "." || merge == "" || checkedOut {
+		s.verbosef("%q can't be fetched into; checking it out to update it.", s.targetBranch)
+		return false, nil
+	}
+
+	ahead, behind, err := s.git.aheadBehind(s.currentDir, s.targetUpstream, s.targetBranch)
+	if err != nil {
+		return false, fmt.Errorf("comparing %q with its upstream (%s): %w", s.targetBranch, s.targetUpstream, err)
+	}
+	switch {
+	case behind == 0:
+		return true, nil
+	case ahead > 0 && !s.opts.ResetTarget:
+		return false, fmt.Errorf("%w (branch: %s, upstream: %s, ahead: %d, behind: %d); reconcile them or pass --reset-target", ErrTargetDiverged, s.targetBranch, s.targetUpstream, ahead, behind)
+	case ahead > 0:
+		// Resetting is left to pullTarget.
+		return false, nil
+	}
+	if err := s.backup(); err != nil {
+		return false, err
+	}
+	if err := s.git.fetchInto(s.currentDir, remote, merge, s.targetBranch); err != nil {
+		return false, err
+	}
+	sha, err := s.git.branchToSHA(s.currentDir, s.targetBranch)
+	if err != nil {
+		return false, fmt.Errorf("updating the target branch (%s) commit SHA: %w", s.targetBranch, err)
+	}
+	s.branches[s.targetBranch] = sha
+	return true, nil
+}
+
+// base returns the revision onto which the branches are rebased.
+func (s *state) base() string {
+	if s.opts.OntoUpstream {
+		return s.targetUpstream
+	}
+	return s.targetBranch
+}
+
+// baseFor returns the revision onto which the branch is rebased.
+func (s *state) baseFor(branch string) string {
+	if p, ok := s.parents[branch]; ok {
+		return p
+	}
+	if base, ok := s.bases[branch]; ok {
+		return base
+	}
+	return s.base()
+}
+
+// checkMerges looks for merge commits in the history of each branch to rebase
+// that isn't in its base, and either skips the branch or records that they're
+// to be preserved, as Options.Merges says.
+func (s *state) checkMerges() error {
+	s.preserveMerges = make(map[string]bool)
+	var errs []error
+	s.branchesToRebase = slices.DeleteFunc(s.branchesToRebase, func(b string) bool {
+		if b == s.targetBranch || s.actions[b] == actionFastForward || len(errs) > 0 {
+			return false
+		}
+		n, err := s.git.mergeCommits(s.currentDir, s.baseFor(b), b)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("counting the merge commits of %q: %w", b, err))
+			return false
+		}
+		switch {
+		case n == 0:
+			return false
+		case s.opts.Merges == "skip":
+			s.filtered[b] = fmt.Sprintf("has %d merge %s, which rebasing would flatten (see --merges)", n, plural(n, "commit", "commits"))
+			return true
+		}
+		s.verbosef("Preserving the %d merge %s of %q with --rebase-merges.", n, plural(n, "commit", "commits"), b)
+		s.preserveMerges[b] = true
+		return false
+	})
+	return errors.Join(errs...)
+}
+
+// checkPinnedBranches skips each branch to rebase that contains a branch that's
+// checked out in a worktree other than the one in which it's rebased, which can
+// happen when working per worktree. --update-refs doesn't move such a branch,
+// so rebasing would leave it behind, split from the branches stacked on it.
+func (s *state) checkPinnedBranches() error {
+	var errs []error
+	s.branchesToRebase = slices.DeleteFunc(s.branchesToRebase, func(b string) bool {
+		if b == s.targetBranch || s.actions[b] == actionFastForward || len(errs) > 0 {
+			return false
+		}
+		from := s.baseFor(b)
+		if sha, ok := s.parentSHAs[b]; ok {
+			from = sha
+		}
+		between, err := s.git.branchesBetween(s.currentDir, from, b)
+		if err != nil {
+			errs = append(errs, err)
+			return false
+		}
+		dir := s.dirFor(b)
+		for _, x := range between {
+			for _, w := range s.worktrees {
+				if x != b && w.branch == x && !samePath(w.dir, dir) {
+					s.filtered[b] = fmt.Sprintf("contains %s, which is checked out in another worktree (dir: %s), where --update-refs can't move it", x, w.dir)
+					return true
+				}
+			}
+		}
+		return false
+	})
+	return errors.Join(errs...)
+}
+
+// rebaseArgsFor returns the arguments particular to the branch to pass to its
+// rebase, in addition to Options.RebaseArgs.
+func (s *state) rebaseArgsFor(branch string) []string {
+	if s.preserveMerges[branch] {
+		return []string{"--rebase-merges"}
+	}
+	return nil
+}
+
+// resolveBases records the upstream of each branch to rebase that has one. An
+// upstream that's the branch's counterpart on a remote (e.g., origin/foo for
+// foo) is ignored, as rebasing onto it would leave the target out, as is one
+// that doesn't exist.
+func (s *state) resolveBases() error {
+	if s.bases == nil {
+		s.bases = make(map[string]string)
+	}
+	for _, b := range s.branchesToRebase {
+		if _, ok := s.bases[b]; ok {
+			continue
+		}
+		u, err := s.git.upstream(s.currentDir, b)
+		if err != nil {
+			return fmt.Errorf("resolving the upstream of %q: %w", b, err)
+		}
+		if u == "" || u == b || strings.HasSuffix(u, "/"+b) || u == s.base() {
+			continue
+		}
+		sha, err := s.git.resolve(s.currentDir, u)
+		if err != nil {
+			return fmt.Errorf("resolving the upstream of %q (upstream: %s): %w", b, u, err)
+		}
+		if sha == "" {
+			s.warnf("the upstream of %q (%s) doesn't exist; rebasing onto %q", b, u, s.base())
+			continue
+		}
+		s.bases[b] = u
+	}
+
+	// A branch whose upstream is another branch to rebase is rebased after it.
+	ordered := make([]string, 0, len(s.branchesToRebase))
+	visited := make(map[string]bool)
+	var visit func(string)
+	visit = func(b string) {
+		if visited[b] {
+			return
+		}
+		visited[b] = true
+		if base, ok := s.bases[b]; ok && slices.Contains(s.branchesToRebase, base) {
+			visit(base)
+		}
+		ordered = append(ordered, b)
+	}
+	for _, b := range s.branchesToRebase {
+		visit(b)
+	}
+	s.branchesToRebase = ordered
+	return nil
+}
+
+func (s *state) rebaseBranches() error {
+	if s.opts.Jobs > 1 {
+		return s.rebaseBranchesInParallel()
+	}
+
+	p := s.newProgress()
+	defer p.clear()
+	for i, b := range s.branchesToRebase {
+		base := s.baseFor(b)
+		p.begin(b, i+1)
+		s.emit(Event{Event: EventStarted, Branch: b, Index: i + 1, Total: p.total, Onto: base, Dir: s.dirFor(b)})
+		if reason := s.stackFailure(b); reason != "" {
+			p.colorf(colorYellow, "  %s: skipping as %s.", b, reason)
+			p.skip()
+			s.filtered[b] = reason
+			s.emit(Event{Event: EventSkipped, Branch: b, Index: i + 1, Total: p.total, Reason: reason})
+			continue
+		}
+		if err := s.restoreSameCommit(b); err != nil {
+			return err
+		}
+		upToDate, err := s.upToDate(b, base)
+		if err != nil {
+			return err
+		}
+		if upToDate {
+			p.printf("  %s: up to date.", b)
+			p.skip()
+			s.emit(Event{Event: EventSkipped, Branch: b, Index: i + 1, Total: p.total, Reason: "up to date"})
+			continue
+		}
+		ff, err := s.fastForwardable(b, base)
+		if err != nil {
+			return err
+		}
+		if ff {
+			commits, err := s.fastForwardRef(b, base)
+			if err != nil {
+				return err
+			}
+			p.finishAs(StatusFastForwarded, b, commits, s.outcomes[b].duration)
+			s.emit(Event{Event: EventFinished, Branch: b, Index: i + 1, Total: p.total, Onto: base, Dir: s.currentDir, Commits: commits, Seconds: s.outcomes[b].duration.Seconds()})
+			continue
+		}
+		dir := s.dirFor(b)
+		commits, err := s.commitsToUpdate(dir, b, base)
+		if err != nil {
+			return err
+		}
+		if err := s.git.checkout(dir, b); err != nil {
+			return fmt.Errorf("checking out a branch (dir: %s, branch: %s): %w", dir, b, err)
+		}
+		if s.opts.PreBranchCmd != "" {
+			p.clear()
+			if err := s.runHook("pre-branch", s.opts.PreBranchCmd, dir, b, base); err != nil {
+				return err
+			}
+		}
+		var before map[string]string
+		if s.opts.Verify != "" {
+			if before, err = s.git.branches(s.currentDir); err != nil {
+				return fmt.Errorf("listing the branches before rebasing %q: %w", b, err)
+			}
+		}
+		if err := s.backup(); err != nil {
+			return err
+		}
+		start := time.Now()
+		abort := s.opts.OnConflict != "pause"
+		if s.opts.Strategy == "merge" {
+			err = s.git.merge(dir, base, abort)
+		} else if _, ok := s.parents[b]; ok {
+			err = s.git.rebaseOnto(dir, base, s.parentSHAs[b], abort, s.rebaseArgsFor(b)...)
+		} else {
+			err = s.git.rebase(dir, base, abort, s.rebaseArgsFor(b)...)
+		}
+		s.record(b, err, time.Since(start))
+		if err != nil && s.git.ctx.Err() != nil {
+			return fmt.Errorf("rebasing %q: %w", b, err)
+		}
+		if err != nil {
+			p.clear()
+			s.emit(Event{Event: EventConflicted, Branch: b, Index: i + 1, Total: p.total, Onto: base, Dir: dir, Error: err.Error()})
+			switch s.opts.OnConflict {
+			case "pause":
+				return s.pause(i, dir, err)
+			case "skip":
+				p.colorf(colorRed, "  %s conflicted; skipping.", b)
+				p.skip()
+				s.skipped = append(s.skipped, &RebaseConflictError{Branch: b, Onto: base, Dir: dir, Err: err})
+				continue
+			}
+			return &RebaseConflictError{Branch: b, Onto: base, Dir: dir, Err: err}
+		}
+		p.finish(b, commits, s.outcomes[b].duration)
+		s.emit(Event{Event: EventFinished, Branch: b, Index: i + 1, Total: p.total, Onto: base, Dir: dir, Commits: commits, Seconds: s.outcomes[b].duration.Seconds()})
+		if s.opts.Verify != "" {
+			p.clear()
+			ok, err := s.verify(dir, b, base, before)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				p.colorf(colorRed, "  %s: verification failed; rolled back.", b)
+				s.emit(Event{Event: EventUnverified, Branch: b, Index: i + 1, Total: p.total, Error: errString(s.outcomes[b].verifyErr)})
+				continue
+			}
+		}
+		if s.opts.PostBranchCmd != "" {
+			p.clear()
+			if err := s.runHook("post-branch", s.opts.PostBranchCmd, dir, b, base); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// commitsToUpdate returns the number of commits that rebasing the branch onto
+// base will replay or, when merging, that merging base will bring in.
+func (s *state) commitsToUpdate(dir, branch, base string) (int, error) {
+	from := base
+	if sha, ok := s.parentSHAs[branch]; ok && s.opts.Strategy == "rebase" {
+		from = sha
+	}
+	ahead, behind, err := s.git.aheadBehind(dir, from, branch)
+	if err != nil {
+		return 0, fmt.Errorf("counting the commits of %q relative to %q: %w", branch, from, err)
+	}
+	if s.opts.Strategy == "merge" {
+		return behind, nil
+	}
+	return ahead, nil
+}
+
+// upToDate reports whether the branch is already based on base, in which case
+// there's nothing to rebase and the branch needn't be checked out. If so, it's
+// recorded as such.
+func (s *state) upToDate(branch, base string) (bool, error) {
+	ok, err := s.git.isAncestor(s.currentDir, base, branch)
+	if err != nil {
+		return false, fmt.Errorf("checking whether %q is based on %q: %w", branch, base, err)
+	}
+	if ok {
+		s.recordUpToDate(branch)
+	}
+	return ok, nil
+}
+
+// fastForwardable reports whether the branch, which isn't based on base, can
+// instead be fast-forwarded to it with git update-ref, without a checkout or a
+// rebase: whether it's behind base, no worktree has it checked out, and there
+// are no hooks or --verify to run with it checked out.
+func (s *state) fastForwardable(branch, base string) (bool, error) {
+	if !s.decapitates() || s.opts.PreBranchCmd != "" || s.opts.PostBranchCmd != "" || s.opts.Verify != "" {
+		return false, nil
+	}
+	ok, err := s.git.isAncestor(s.currentDir, branch, base)
+	if err != nil {
+		return false, fmt.Errorf("checking whether %q is behind %q: %w", branch, base, err)
+	}
+	return ok, nil
+}
+
+// fastForwardRef fast-forwards the branch to base with git update-ref and
+// records it as such, returning the number of commits that it gained. It's safe
+// to call concurrently.
+func (s *state) fastForwardRef(branch, base string) (int, error) {
+	_, commits, err := s.git.aheadBehind(s.currentDir, base, branch)
+	if err != nil {
+		return 0, fmt.Errorf("counting the commits of %q relative to %q: %w", branch, base, err)
+	}
+	sha, err := s.git.resolve(s.currentDir, base)
+	if err != nil {
+		return 0, fmt.Errorf("resolving %q: %w", base, err)
+	}
+	if err := s.backup(); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	err = s.git.updateRef(s.currentDir, "refs/heads/"+branch, sha)
+	s.record(branch, err, time.Since(start))
+	if err != nil {
+		return 0, fmt.Errorf("fast-forwarding %q to %q: %w", branch, base, err)
+	}
+	s.recordFastForwarded(branch)
+	return commits, nil
+}
+
+// repeatUntilStable reconstructs and rebases the branches until a pass leaves
+// every branch where it was. The first pass is presumed to have been run.
+func (s *state) repeatUntilStable() error {
+	for pass := 1; ; pass++ {
+		before := s.branches
+		var err error
+		if s.branches, err = s.git.branches(s.currentDir); err != nil {
+			return fmt.Errorf("listing the local branches after pass %d: %w", pass, err)
+		}
+		if maps.Equal(before, s.branches) {
+			fmt.Fprintf(s.out, "Stable after %d %s.\n", pass, plural(pass, "pass", "passes"))
+			return nil
+		}
+		if pass == s.opts.MaxPasses {
+			s.warnf("the branches were still changing after %d %s", pass, plural(pass, "pass", "passes"))
+			return nil
+		}
+
+		fmt.Fprintf(s.out, "Updating the branches (pass %d)...\n", pass+1)
+		if err := s.constructBranchesToRebase(); err != nil {
+			return fmt.Errorf("constructing the list of branches to rebase (pass %d): %w", pass+1, err)
+		}
+		s.bases, s.parents, s.parentSHAs = nil, nil, nil
+		if err := s.arrangeBranches(); err != nil {
+			return fmt.Errorf("arranging the branches to rebase (pass %d): %w", pass+1, err)
+		}
+		if err := s.rebaseBranches(); err != nil {
+			return fmt.Errorf("rebasing the branches (pass %d): %w", pass+1, err)
+		}
+		if err := s.moveDuplicates(); err != nil {
+			return fmt.Errorf("moving the duplicate branches (pass %d): %w", pass+1, err)
+		}
+	}
+}
+
+// pullTarget fast-forwards the target branch, which is checked out in dir, to
+// its upstream, which has been fetched, if it has one. If the target has diverged from its
+// upstream, then it's reset to it with ResetTarget and otherwise left alone.
+func (s *state) pullTarget(dir string) error {
+	if s.targetUpstream == "" {
+		s.verbosef("%q has no upstream, so there's nothing to pull.", s.targetBranch)
+		return nil
+	}
+	ahead, behind, err := s.git.aheadBehind(dir, s.targetUpstream, s.targetBranch)
+	if err != nil {
+		return fmt.Errorf("comparing %q with its upstream (%s): %w", s.targetBranch, s.targetUpstream, err)
+	}
+	switch {
+	case behind == 0:
+		return nil
+	case ahead > 0 && !s.opts.ResetTarget:
+		return fmt.Errorf("%w (branch: %s, upstream: %s, ahead: %d, behind: %d); reconcile them or pass --reset-target", ErrTargetDiverged, s.targetBranch, s.targetUpstream, ahead, behind)
+	}
+	if err := s.backup(); err != nil {
+		return err
+	}
+	if ahead > 0 {
+		s.warnf("resetting %q to %q, discarding %d %s (see --undo)", s.targetBranch, s.targetUpstream, ahead, plural(ahead, "commit", "commits"))
+		return s.git.resetHard(dir, s.targetUpstream)
+	}
+	return s.git.fastForward(dir, s.targetUpstream)
+}
+
+// pruneMerged deletes the branches that are merged into the target branch,
+// other than those that worktrees had checked out, after confirmation.
+func (s *state) pruneMerged() error {
+	merged, err := s.git.mergedBranches(s.currentDir, s.targetBranch)
+	if err != nil {
+		return fmt.Errorf("listing the merged branches: %w", err)
+	}
+	return s.pruneBranches(merged, fmt.Sprintf("merged into %q", s.targetBranch))
+}
+
+// pruneGone deletes the branches whose upstream is gone (typically as their
+// pull requests were merged and their remote branches deleted), other than
+// those that worktrees had checked out, after confirmation.
+func (s *state) pruneGone() error {
+	gone, err := s.git.goneBranches(s.currentDir)
+	if err != nil {
+		return fmt.Errorf("listing the branches whose upstream is gone: %w", err)
+	}
+	return s.pruneBranches(sortedKeys(gone), "tracking an upstream that's gone")
+}
+
+// trackRemoteBranches creates a local branch tracking each of the remote's
+// branches that match Options.TrackRemote and have none, other than those
+// merged into the target, which there's no need to rebase.
+func (s *state) trackRemoteBranches() error {
+	remote, err := s.git.remoteBranches(s.currentDir, s.opts.Remote)
+	if err != nil {
+		return err
+	}
+	for _, b := range sortedKeys(remote) {
+		if _, ok := s.branches[b]; ok || matchPattern(s.opts.TrackRemote, b) == "" {
+			continue
+		}
+		merged, err := s.git.isAncestor(s.currentDir, remote[b], s.targetBranch)
+		if err != nil {
+			return fmt.Errorf("checking whether %s/%s is merged into %q: %w", s.opts.Remote, b, s.targetBranch, err)
+		}
+		if merged {
+			s.verbosef("Not tracking %s/%s: it's merged into %q.", s.opts.Remote, b, s.targetBranch)
+			continue
+		}
+		if err := s.backup(); err != nil {
+			return err
+		}
+		if err := s.git.trackBranch(s.currentDir, s.opts.Remote, b); err != nil {
+			return err
+		}
+		if err := s.backupCreation(b, remote[b]); err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "Tracking %q from %s.\n", b, s.opts.Remote)
+		s.branches[b], s.originalBranches[b] = remote[b], remote[b]
+	}
+	return nil
+}
+
+// tracksRemote reports whether the branch is a local copy of the remote's
+// branch of the same name made by Options.TrackRemote; up is its upstream. A
+// branch of the user's own that merely matches the patterns isn't one.
+func (s *state) tracksRemote(branch, up string) bool {
+	return up == s.opts.Remote+"/"+branch && s.tracked[branch]
+}
+
+// pruneBranches deletes the given branches, other than the target branch and
+// those that worktrees had checked out, after listing them as being what and
+// asking for confirmation.
+func (s *state) pruneBranches(branches []string, what string) error {
+	branches = slices.DeleteFunc(branches, func(b string) bool {
+		return b == s.targetBranch || slices.ContainsFunc(s.worktrees, func(w worktree) bool { return w.branch == b })
+	})
+	if len(branches) == 0 {
+		fmt.Fprintf(s.out, "No branches are %s.\n", what)
+		return nil
+	}
+
+	fmt.Fprintf(s.out, "These branches are %s:\n", what)
+	for _, b := range branches {
+		fmt.Fprintf(s.out, "  %s\n", b)
+	}
+	ok, err := s.confirm("Delete them?")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Fprintln(s.out, "Leaving them alone.")
+		return nil
+	}
+
+	if err := s.backup(); err != nil {
+		return err
+	}
+	if s.deleted == nil {
+		s.deleted = make(map[string]bool)
+	}
+	for _, b := range branches {
+		if err := s.git.deleteBranch(s.currentDir, b); err != nil {
+			return fmt.Errorf("deleting %q: %w", b, err)
+		}
+		delete(s.branches, b)
+		s.deleted[b] = true
+		fmt.Fprintf(s.out, "  Deleted %s.\n", b)
+	}
+	return nil
+}
+
+// confirm asks a yes/no question on stdin, defaulting to no. It returns true
+// without asking if --yes was given.
+func (s *state) confirm(question string) (bool, error) {
+	if s.opts.Yes {
+		return true, nil
+	}
+	fmt.Fprintf(s.out, "%s [y/N] ", question)
+	line, err := bufio.NewReader(s.opts.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("reading the answer: %w", err)
+	}
+	if err != nil {
+		// Without an answer, the prompt's line is left unfinished.
+		fmt.Fprintln(s.out)
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes", nil
+}
+
+// pushBranches force-pushes each branch that was moved by the run, other than
+// the target branch, provided that the branch exists on the remote. The lease
+// is the remote-tracking branch as of the fetch, so a branch that was pushed to
+// since is left alone.
+func (s *state) pushBranches() error {
+	final, err := s.git.branches(s.currentDir)
+	if err != nil {
+		return fmt.Errorf("listing the local branches: %w", err)
+	}
+
+	s.pushes = make(map[string]string)
+	var errs []error
+	for _, b := range sortedKeys(final) {
+		if b == s.targetBranch || final[b] == s.originalBranches[b] {
+			continue
+		}
+		if o, ok := s.outcomes[b]; ok && o.err != nil {
+			continue
+		}
+
+		if s.tracked[b] {
+			s.pushes[b] = "tracked by --track-remote"
+			fmt.Fprintf(s.out, "  %s: tracked from %s by --track-remote; skipped.\n", b, s.opts.Remote)
+			continue
+		}
+
+		remoteSHA, err := s.git.resolve(s.currentDir, "refs/remotes/"+s.opts.Remote+"/"+b)
+		if err != nil {
+			return fmt.Errorf("resolving the remote-tracking branch (remote: %s, branch: %s): %w", s.opts.Remote, b, err)
+		}
+		if remoteSHA == "" && s.opts.SetUpstream {
+			if err := s.git.pushNew(s.currentDir, s.opts.Remote, b); err != nil {
+				s.pushes[b] = "failed"
+				fmt.Fprintf(s.out, "  %s: failed.\n", b)
+				errs = append(errs, fmt.Errorf("pushing %q: %w", b, err))
+				continue
+			}
+			s.pushes[b] = "created"
+			fmt.Fprintf(s.out, "  %s: created on %s.\n", b, s.opts.Remote)
+			continue
+		}
+		if remoteSHA == "" {
+			s.pushes[b] = "not on the remote"
+			fmt.Fprintf(s.out, "  %s: not on %s; skipped.\n", b, s.opts.Remote)
+			continue
+		}
+		if err := s.git.push(s.currentDir, s.opts.Remote, b, remoteSHA); err != nil {
+			s.pushes[b] = "failed"
+			fmt.Fprintf(s.out, "  %s: failed.\n", b)
+			errs = append(errs, fmt.Errorf("pushing %q: %w", b, err))
+			continue
+		}
+		s.pushes[b] = "pushed"
+		fmt.Fprintf(s.out, "  %s: pushed.\n", b)
+	}
+	return errors.Join(errs...)
+}
+
+// setUpstreams points the upstream of each rebased branch at its counterpart on
+// the remote, if it exists, so that git status compares them. A branch whose
+// upstream is another local branch (e.g., as it's stacked on it) is left
+// alone.
+func (s *state) setUpstreams() error {
+	final, err := s.git.branches(s.currentDir)
+	if err != nil {
+		return fmt.Errorf("listing the local branches: %w", err)
+	}
+	for _, b := range sortedKeys(final) {
+		if b == s.targetBranch || final[b] == s.originalBranches[b] {
+			continue
+		}
+		if o, ok := s.outcomes[b]; ok && o.err != nil {
+			continue
+		}
+		up := s.opts.Remote + "/" + b
+		sha, err := s.git.resolve(s.currentDir, "refs/remotes/"+up)
+		if err != nil {
+			return fmt.Errorf("resolving the remote-tracking branch (remote: %s, branch: %s): %w", s.opts.Remote, b, err)
+		}
+		if sha == "" {
+			s.verbosef("Not setting the upstream of %q: it's not on %s.", b, s.opts.Remote)
+			continue
+		}
+		remote, merge, err := s.git.upstreamConfig(s.currentDir, b)
+		if err != nil {
+			return fmt.Errorf("resolving the upstream of %q: %w", b, err)
+		}
+		switch {
+		case remote == s.opts.Remote && merge == "refs/heads/"+b:
+			continue
+		case remote == ".":
+			s.verbosef("Not setting the upstream of %q: it's the local branch %q.", b, strings.TrimPrefix(merge, "refs/heads/"))
+			continue
+		}
+		if err := s.git.setUpstream(s.currentDir, b, up); err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "  %s: upstream set to %s.\n", b, up)
+	}
+	return nil
+}
+
+// restoreAttempts is the number of times that checking out a worktree's branch
+// is attempted when it fails as a lock file is held (e.g., by an editor's git
+// integration).
+const restoreAttempts = 3
+
+// restore checks out each worktree's original branch (or, if it was detached,
+// commit), recording the results in s.restored. A branch can't be checked out
+// in one worktree while it's checked out in another, so a worktree that has
+// another's branch checked out (e.g., after working per worktree) is restored
+// first, and, if two have each other's, one is detached first. It carries on
+// past failures so that as many worktrees as possible are restored, and says
+// how to restore those that weren't.
+func (s *state) restore() error {
+	// The worktrees are restored even if the run was cancelled.
+	g := s.git.detached()
+	var errs []error
+	fail := func(w worktree, rev string, err error) {
+		r := WorktreeResult{Dir: w.dir, Branch: w.branch, Head: w.head, Remedy: fmt.Sprintf("git -C %s checkout %s", shellQuote(w.dir), shellQuote(w.checkedOut()))}
+		err = fmt.Errorf("restoring the worktree (dir: %s, checked out: %s): %w; to restore it, run `%s`", w.dir, w.checkedOut(), err, r.Remedy)
+		r.Error = err.Error()
+		errs = append(errs, err)
+		s.restored = append(s.restored, r)
+		s.emit(Event{Event: EventRestored, Branch: rev, Dir: w.dir, Error: r.Error})
+	}
+
+	// dir -> the branch that it has checked out now
+	current := make(map[string]string)
+	if ws, err := g.worktrees(); err == nil {
+		for _, w := range ws {
+			current[w.dir] = w.branch
+		}
+	}
+	type pending struct {
+		w   worktree
+		rev string
+	}
+	var queue []pending
+	for _, w := range s.worktrees {
+		rev, err := s.restoreRev(g, w)
+		if err != nil {
+			fail(w, rev, err)
+			continue
+		}
+		queue = append(queue, pending{w: w, rev: rev})
+	}
+	// blocked reports whether the revision is a branch that's checked out in
+	// another worktree that's yet to be restored.
+	blocked := func(p pending, queue []pending) bool {
+		return slices.ContainsFunc(queue, func(q pending) bool {
+			return !samePath(q.w.dir, p.w.dir) && current[q.w.dir] == p.rev
+		})
+	}
+
+	for len(queue) > 0 {
+		var waiting []pending
+		for _, p := range queue {
+			if blocked(p, queue) {
+				waiting = append(waiting, p)
+				continue
+			}
+			if err := s.checkoutRetrying(g, p.w.dir, p.rev); err != nil {
+				fail(p.w, p.rev, fmt.Errorf("checking out: %w", err))
+				continue
+			}
+			current[p.w.dir] = p.rev
+			r := WorktreeResult{Dir: p.w.dir, Branch: p.w.branch, Head: p.w.head, Restored: true}
+			if p.rev != p.w.checkedOut() {
+				r.Head = p.rev
+			}
+			s.verbosef("Restored %q (dir: %s).", p.rev, p.w.dir)
+			s.restored = append(s.restored, r)
+			s.emit(Event{Event: EventRestored, Branch: p.rev, Dir: p.w.dir})
+		}
+		if len(waiting) == len(queue) {
+			// The worktrees have each other's branches checked out.
+			p := waiting[0]
+			if err := g.decapitate(p.w.dir); err != nil {
+				fail(p.w, p.rev, err)
+				waiting = waiting[1:]
+			} else {
+				current[p.w.dir] = ""
+			}
+		}
+		queue = waiting
+	}
+
+	if s.tempWorktree != "" {
+		if err := g.removeWorktree(s.currentDir, s.tempWorktree); err != nil {
+			errs = append(errs, fmt.Errorf("removing the temporary worktree (dir: %s): %w", s.tempWorktree, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkoutRetrying checks out rev in dir, trying again after a pause if a lock
+// file is held.
+func (s *state) checkoutRetrying(g *git, dir, rev string) error {
+	for attempt := 1; ; attempt++ {
+		err := g.checkout(dir, rev)
+		if err == nil || attempt == restoreAttempts || !strings.Contains(err.Error(), ".lock") {
+			return err
+		}
+		s.verbosef("Checking out %q (dir: %s) failed as a lock file is held; trying again.", rev, dir)
+		time.Sleep(time.Duration(attempt) * 250 * time.Millisecond)
+	}
+}
+
+// shellQuote quotes the argument for a POSIX shell if it needs quoting.
+func shellQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`!*?[]{}()<>|&;#~") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// restoreRev returns what to check out to restore the worktree under
+// Options.Restore: its branch or, if the branch was rewritten (that is, moved
+// other than by a fast-forward) and the policy says so, the commit that it had
+// checked out.
+func (s *state) restoreRev(g *git, w worktree) (string, error) {
+	if w.branch == "" || w.sha == "" || s.opts.Restore == "branch" {
+		return w.checkedOut(), nil
+	}
+	sha, err := g.resolve(w.dir, "refs/heads/"+w.branch)
+	if err != nil {
+		return "", err
+	}
+	if sha != "" {
+		// A branch that was fast-forwarded wasn't rewritten.
+		ff, err := g.isAncestor(w.dir, w.sha, sha)
+		if err != nil || ff {
+			return w.branch, err
+		}
+	}
+	if s.opts.Restore == "ask" {
+		ok, err := s.confirm(fmt.Sprintf("%q, checked out in %s, was rewritten. Detach its HEAD at the commit it had checked out, %s, rather than checking it out?", w.branch, w.dir, shortSHA(w.sha)))
+		if err != nil || !ok {
+			return w.branch, err
+		}
+	}
+	return w.sha, nil
+}
+
+// addTempWorktree adds a temporary worktree, with a detached HEAD, in which to
+// work in a bare repository.
+func (s *state) addTempWorktree() error {
+	dir, err := os.MkdirTemp("", "git-rebase-all-")
+	if err != nil {
+		return fmt.Errorf("creating a temporary directory: %w", err)
+	}
+	if err := s.git.addWorktree(s.currentDir, dir, s.base()); err != nil {
+		return errors.Join(fmt.Errorf("adding a temporary worktree: %w", err), os.Remove(dir))
+	}
+	s.verbosef("Working in a temporary worktree (dir: %s).", dir)
+	s.currentDir, s.topLevel, s.tempWorktree = dir, dir, dir
+	return nil
+}
+
+// matchPattern returns the first of the glob patterns that matches the branch,
+// or the empty string if none does.
+func matchPattern(patterns []string, branch string) string {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, branch); ok {
+			return p
+		}
+	}
+	return ""
+}
+
+func (s *state) warnf(format string, args ...any) {
+	if s.opts.Verbosity <= VerbosityQuiet {
+		return
+	}
+	fmt.Fprintf(s.opts.Stderr, "Warning: "+format+".\n", args...)
+}
+
+func trimbs(bs []byte) string { return strings.TrimSpace(string(bs)) }
+
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	ks := make([]K, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	slices.Sort(ks)
+	return ks
+}
+
+// contains presupposes that xs is sorted.
+func contains[K cmp.Ordered](xs []K, x K) bool {
+	_, ok := slices.BinarySearch(xs, x)
+	return ok
+}
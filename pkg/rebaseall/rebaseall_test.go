@@ -0,0 +1,105 @@
+package rebaseall
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(o *Options)
+		// want is a substring of the error, or empty if there should be none.
+		want string
+	}{
+		{"the defaults", func(o *Options) {}, ""},
+		{"a positional argument", func(o *Options) { o.Args = []string{"main"} }, "unexpected positional arguments"},
+		{"--watch and --dry-run", func(o *Options) { o.Watch, o.DryRun = true, true }, "--watch cannot be used with"},
+		{"--watch and --continue", func(o *Options) { o.Watch, o.Continue = true, true }, "--watch cannot be used with"},
+		{"--offline and --push", func(o *Options) { o.Offline, o.Push = true, true }, "--offline cannot be used with"},
+		{"--offline and --deepen", func(o *Options) { o.Offline, o.Deepen = true, 1 }, "--offline cannot be used with"},
+		{"--fetch-only and --dry-run", func(o *Options) { o.FetchOnly, o.DryRun = true, true }, "--fetch-only cannot be used with"},
+		{"--unshallow and --deepen", func(o *Options) { o.Unshallow, o.Deepen = true, 1 }, "mutually exclusive"},
+		{"--continue and --load-plan", func(o *Options) { o.Continue, o.LoadPlan = true, "plan.json" }, "--continue cannot be used with"},
+		{"--jobs and --stack-aware", func(o *Options) { o.Jobs, o.StackAware = 2, true }, "--jobs cannot be used with"},
+		{"--jobs and --on-conflict=pause", func(o *Options) { o.Jobs, o.OnConflict = 2, "pause" }, "--jobs cannot be used with"},
+		{"--jobs and --strategy=merge", func(o *Options) { o.Jobs, o.Strategy = 2, "merge" }, "--jobs cannot be used with"},
+		{"--dump-plan and --load-plan", func(o *Options) { o.DumpPlan, o.LoadPlan = "a.json", "b.json" }, "cannot be used together"},
+		{"-i and --load-plan", func(o *Options) { o.Interactive, o.LoadPlan = true, "plan.json" }, "cannot be used together"},
+		{"--mine and --author", func(o *Options) { o.Mine, o.Author = true, "alice" }, "cannot be used together"},
+		{"--onto passed to git rebase", func(o *Options) { o.RebaseArgs = []string{"--onto=main"} }, "--onto cannot be passed"},
+		{"an empty --group", func(o *Options) { o.Groups = []string{"/"} }, "--group must name a prefix"},
+		{"a --target-map pattern without a target", func(o *Options) { o.TargetMap = []TargetMapping{{Pattern: "release/*"}} }, "mapped to no target"},
+		{"an unknown sort", func(o *Options) { o.Sort = "random" }, "--sort must be"},
+		{"an unknown order", func(o *Options) { o.Order = "commits" }, "--order must be"},
+		{"no jobs", func(o *Options) { o.Jobs = -1 }, "--jobs must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var o Options
+			tt.opts(&o)
+			err := o.withDefaults().Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Fatalf("expected no error, got %v", err)
+			case tt.want != "" && err == nil:
+				t.Fatalf("expected an error containing %q, got none", tt.want)
+			case tt.want != "" && !strings.Contains(err.Error(), tt.want):
+				t.Fatalf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestNoDecapitate(t *testing.T) {
+	t.Run("a single worktree", func(t *testing.T) {
+		f := newTestFixture(t)
+		if err := errors.Join(
+			f.branch("a", "main", "a"),
+			f.branch("b", "main", "b"),
+			f.git(f.work, "checkout", "--quiet", "a"),
+			f.advance("upstream", "upstream\n"),
+		); err != nil {
+			t.Fatalf("creating the branches: %v", err)
+		}
+		sum, err := Execute(context.Background(), Options{Dir: f.work, Runner: f.runner, NoDecapitate: true, Stdout: io.Discard, Stderr: io.Discard, Yes: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wantStatuses(sum, map[string]string{"main": StatusFastForwarded, "a": StatusRebased, "b": StatusRebased}); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.checkedOut(f.work); got != "a" {
+			t.Fatalf("expected to be returned to a, the starting branch, but %q is checked out", got)
+		}
+	})
+
+	t.Run("several worktrees", func(t *testing.T) {
+		f := newTestFixture(t)
+		if err := errors.Join(
+			f.branch("a", "main", "a"),
+			f.branch("c", "main", "c"),
+			f.worktree("c"),
+			f.advance("upstream", "upstream\n"),
+		); err != nil {
+			t.Fatalf("creating the branches: %v", err)
+		}
+		before, err := f.output(f.work, "rev-parse", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Execute(context.Background(), Options{Dir: f.work, Runner: f.runner, NoDecapitate: true, Stdout: io.Discard, Stderr: io.Discard, Yes: true})
+		if err == nil || !strings.Contains(err.Error(), "--no-decapitate requires a single worktree") {
+			t.Fatalf("expected --no-decapitate to be refused, but the run returned %v", err)
+		}
+		if after, _ := f.output(f.work, "rev-parse", "a"); after != before {
+			t.Fatalf("a was rewritten (before: %s, after: %s)", before, after)
+		}
+		if err := f.restored(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package rebaseall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrPaused is returned when a run is paused on a conflict.
+var ErrPaused = errors.New("paused on a conflict")
+
+// pausedRun records a run that was paused on a conflict so that it can be
+// continued with --continue.
+type pausedRun struct {
+	Target       string           `json:"target"`
+	Upstream     string           `json:"upstream,omitempty"`
+	OntoUpstream bool             `json:"onto_upstream,omitempty"`
+	PerWorktree  bool             `json:"per_worktree,omitempty"`
+	CurrentDir   string           `json:"current_dir"`
+	Branch       string           `json:"branch"`
+	Dir          string           `json:"dir"`
+	Remaining    []string         `json:"remaining"`
+	Worktrees    []pausedWorktree `json:"worktrees"`
+	// Bases maps the remaining branches to their upstreams under
+	// --respect-upstream.
+	Bases map[string]string `json:"bases,omitempty"`
+	// Parents and ParentSHAs record the stacks under --stack-aware.
+	Parents    map[string]string `json:"parents,omitempty"`
+	ParentSHAs map[string]string `json:"parent_shas,omitempty"`
+	Strategy   string            `json:"strategy,omitempty"`
+	// TempWorktree is the worktree added to work in a bare repository, if any.
+	TempWorktree string `json:"temp_worktree,omitempty"`
+}
+
+type pausedWorktree struct {
+	Dir    string `json:"dir"`
+	Branch string `json:"branch"`
+	Head   string `json:"head,omitempty"`
+	SHA    string `json:"sha,omitempty"`
+}
+
+// pause records the run's progress after the rebase of the i'th branch
+// conflicted in dir, leaving the conflicted rebase in place.
+func (s *state) pause(i int, dir string, err error) error {
+	b := s.branchesToRebase[i]
+	p := pausedRun{
+		Target:       s.targetBranch,
+		Upstream:     s.targetUpstream,
+		OntoUpstream: s.opts.OntoUpstream,
+		PerWorktree:  s.opts.PerWorktree,
+		CurrentDir:   s.currentDir,
+		Branch:       b,
+		Dir:          dir,
+		Remaining:    s.branchesToRebase[i+1:],
+		Bases:        s.bases,
+		Strategy:     s.opts.Strategy,
+		TempWorktree: s.tempWorktree,
+		Parents:      s.parents,
+		ParentSHAs:   s.parentSHAs,
+	}
+	for _, w := range s.worktrees {
+		p.Worktrees = append(p.Worktrees, pausedWorktree{Dir: w.dir, Branch: w.branch, Head: w.head, SHA: w.sha})
+	}
+
+	path, pathErr := pausedRunPath(s.git, s.currentDir)
+	if pathErr != nil {
+		return errors.Join(&RebaseConflictError{Branch: b, Onto: s.baseFor(b), Dir: dir, Err: err}, pathErr)
+	}
+	bs, jsonErr := json.MarshalIndent(p, "", "  ")
+	if jsonErr != nil {
+		return errors.Join(&RebaseConflictError{Branch: b, Onto: s.baseFor(b), Dir: dir, Err: err}, fmt.Errorf("encoding the paused run: %w", jsonErr))
+	}
+	if writeErr := os.WriteFile(path, append(bs, '\n'), 0o644); writeErr != nil {
+		return errors.Join(&RebaseConflictError{Branch: b, Onto: s.baseFor(b), Dir: dir, Err: err}, fmt.Errorf("writing the paused run: %w", writeErr))
+	}
+
+	if s.opts.Strategy == "merge" {
+		fmt.Fprintf(s.out, "Merging %q into %q conflicted. Resolve the conflicts in %s and run `git merge --continue`, then run `git-rebase-all --continue`.\n", s.baseFor(b), b, dir)
+	} else {
+		fmt.Fprintf(s.out, "Rebasing %q onto %q conflicted. Resolve the conflicts in %s and run `git rebase --continue`, then run `git-rebase-all --continue`.\n", b, s.baseFor(b), dir)
+	}
+	return fmt.Errorf("%w (branch: %s, dir: %s)", ErrPaused, b, dir)
+}
+
+// continueRun continues a paused run by rebasing the remaining branches and then
+// restoring the worktrees.
+func continueRun(ctx context.Context, opts Options) (err error) {
+	g := opts.git(ctx)
+	currentDir, err := opts.workDir()
+	if err != nil {
+		return err
+	}
+	path, err := pausedRunPath(g, currentDir)
+	if err != nil {
+		return err
+	}
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return errors.New("there is no paused run to continue")
+	}
+	if err != nil {
+		return fmt.Errorf("reading the paused run: %w", err)
+	}
+	var p pausedRun
+	if err := json.Unmarshal(bs, &p); err != nil {
+		return fmt.Errorf("parsing the paused run (path: %s): %w", path, err)
+	}
+
+	ops, err := g.inProgress(p.Dir)
+	if err != nil {
+		return fmt.Errorf("detecting the operations in progress (dir: %s): %w", p.Dir, err)
+	}
+	if len(ops) > 0 {
+		return fmt.Errorf("the %s of %q is still in progress (dir: %s); finish it with `git %s --continue` first", ops[0], p.Branch, p.Dir, ops[0])
+	}
+
+	// The run was backed up before it paused, so its backup is left as it is.
+	s := &state{
+		currentDir:       p.CurrentDir,
+		targetBranch:     p.Target,
+		targetUpstream:   p.Upstream,
+		branchesToRebase: p.Remaining,
+		bases:            p.Bases,
+		parents:          p.Parents,
+		parentSHAs:       p.ParentSHAs,
+		tempWorktree:     p.TempWorktree,
+		filtered:         make(map[string]string),
+		backedUp:         true,
+		opts:             opts,
+		git:              g,
+		out:              opts.progress(),
+	}
+	s.opts.OntoUpstream = p.OntoUpstream
+	s.opts.PerWorktree = p.PerWorktree
+	if p.Strategy != "" {
+		s.opts.Strategy = p.Strategy
+	}
+	for _, w := range p.Worktrees {
+		s.worktrees = append(s.worktrees, worktree{dir: w.Dir, branch: w.Branch, head: w.Head, sha: w.SHA})
+	}
+
+	// If the run pauses again, the file is rewritten.
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("removing the paused run: %w", err)
+	}
+	defer func() {
+		if !errors.Is(err, ErrPaused) {
+			err = errors.Join(err, s.restore())
+		}
+	}()
+
+	fmt.Fprintln(s.out, "Continuing the branches...")
+	if err := s.rebaseBranches(); err != nil {
+		return fmt.Errorf("rebasing the branches: %w", err)
+	}
+	return nil
+}
+
+// pausedRunPath returns the path of the file recording a paused run, which is
+// shared by all of the worktrees.
+func pausedRunPath(g *git, dir string) (string, error) {
+	commonDir, err := g.gitCommonDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("locating the git directory: %w", err)
+	}
+	return filepath.Join(commonDir, "rebase-all-state.json"), nil
+}
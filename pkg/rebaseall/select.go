@@ -0,0 +1,118 @@
+package rebaseall
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// selectBranches lists the leaf branches to rebase, other than the target,
+// each with a checkbox and with how far it's ahead of and behind the base, and
+// reads from stdin which of them to toggle until it's given an empty line. The
+// branches that are deselected are recorded in deselected and filtered.
+func (s *state) selectBranches() error {
+	var leaves []string
+	for _, b := range s.branchesToRebase {
+		if s.actions[b] == actionLeaf && b != s.targetBranch {
+			leaves = append(leaves, b)
+		}
+	}
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	base := s.base()
+	counts := make([]string, len(leaves))
+	for i, b := range leaves {
+		ahead, behind, err := s.git.aheadBehind(s.currentDir, base, b)
+		if err != nil {
+			return fmt.Errorf("counting the commits between %q and %q: %w", base, b, err)
+		}
+		counts[i] = fmt.Sprintf("ahead %d, behind %d", ahead, behind)
+	}
+
+	selected := make([]bool, len(leaves))
+	for i := range selected {
+		selected[i] = true
+	}
+	r := bufio.NewReader(s.opts.Stdin)
+	for {
+		fmt.Fprintf(s.out, "Branches to rebase onto %s:\n", base)
+		for i, b := range leaves {
+			box := "[ ]"
+			if selected[i] {
+				box = "[x]"
+			}
+			fmt.Fprintf(s.out, "  %s %d. %s (%s)\n", box, i+1, b, counts[i])
+		}
+		fmt.Fprint(s.out, "Toggle branches by number (e.g., 1 3-5), 'a' for all, or 'n' for none; press Enter to continue: ")
+		line, err := r.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("reading the selection: %w", err)
+		}
+		if err != nil {
+			// Without an answer, the prompt's line is left unfinished.
+			fmt.Fprintln(s.out)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if err := toggleSelection(selected, line); err != nil {
+			s.warnf("%v", err)
+		}
+	}
+
+	s.deselected = make(map[string]bool)
+	for i, b := range leaves {
+		if !selected[i] {
+			s.deselected[b] = true
+		}
+	}
+	s.branchesToRebase = slices.DeleteFunc(s.branchesToRebase, func(b string) bool {
+		if s.deselected[b] {
+			s.filtered[b] = "deselected with -i"
+			return true
+		}
+		return false
+	})
+	return nil
+}
+
+// toggleSelection applies a line of input to selected: 'a' selects every
+// branch, 'n' deselects every branch, and otherwise the line is a list of
+// 1-based numbers and ranges (e.g., 1 3-5) whose branches are toggled. Nothing
+// is toggled if the line is invalid.
+func toggleSelection(selected []bool, line string) error {
+	switch line {
+	case "a", "n":
+		for i := range selected {
+			selected[i] = line == "a"
+		}
+		return nil
+	}
+
+	var toggle []int
+	for _, field := range strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == ',' }) {
+		lo, hi, isRange := strings.Cut(field, "-")
+		if !isRange {
+			hi = lo
+		}
+		from, err1 := strconv.Atoi(lo)
+		to, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || from < 1 || to > len(selected) || from > to {
+			return fmt.Errorf("invalid selection %q: expected numbers from 1 to %d", field, len(selected))
+		}
+		for i := from; i <= to; i++ {
+			toggle = append(toggle, i-1)
+		}
+	}
+	for _, i := range toggle {
+		selected[i] = !selected[i]
+	}
+	return nil
+}
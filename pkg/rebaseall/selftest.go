@@ -0,0 +1,133 @@
+package rebaseall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// selfTestConfig is the git config with which the self-test's commands run, so
+// that they don't depend on the user's (e.g., their hooks or signing).
+var selfTestConfig = []string{
+	"-c", "user.name=git-rebase-all",
+	"-c", "user.email=self-test@git-rebase-all.invalid",
+	"-c", "commit.gpgSign=false",
+	"-c", "core.hooksPath=" + os.DevNull,
+	"-c", "init.defaultBranch=main",
+	"-c", "advice.detachedHead=false",
+}
+
+// selfTestRunner is the Runner of the self-test, which runs git with
+// selfTestConfig.
+type selfTestRunner struct{ Runner }
+
+func (r selfTestRunner) Run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	return r.Runner.Run(ctx, dir, append(append([]string{}, selfTestConfig...), args...)...)
+}
+
+// selfTestName describes the scenario that SelfTest runs.
+const selfTestName = "a stack and a branch checked out in another worktree"
+
+// SelfTest runs a sanity scenario against a throwaway repository in a
+// temporary directory, as a check that runs work with the installed git (and
+// the given Options.Runner or Options.Backend) before they touch a real
+// repository. It writes whether the scenario passed to opts.Stdout. The
+// scenarios that cover conflicts, diverged branches, and failures are run by
+// go test.
+func SelfTest(ctx context.Context, opts Options) error {
+	opts = opts.withDefaults()
+	if err := opts.git(ctx).validateVersion(); err != nil {
+		return fmt.Errorf("validating the version of git: %w", err)
+	}
+
+	start := time.Now()
+	err := selfTest(ctx, selfTestRunner{Runner: opts.Runner})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	result := "ok"
+	if err != nil {
+		result = "FAILED: " + err.Error()
+	}
+	fmt.Fprintf(opts.Stdout, "%s: %s (%s)\n", selfTestName, result, time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		return fmt.Errorf("the self-test failed: %w", err)
+	}
+	return nil
+}
+
+// selfTest creates a repository with a stack of two branches and a third
+// branch checked out in another worktree, all behind main, runs against it, and
+// checks that the branches were rebased onto main and the worktrees restored.
+func selfTest(ctx context.Context, runner Runner) (err error) {
+	root, err := os.MkdirTemp("", "git-rebase-all-self-test-")
+	if err != nil {
+		return fmt.Errorf("creating a temporary directory: %w", err)
+	}
+	defer func() { err = errors.Join(err, os.RemoveAll(root)) }()
+	// The temporary directory may be behind a symbolic link (e.g., on macOS).
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return fmt.Errorf("resolving the temporary directory: %w", err)
+	}
+
+	work, wt := filepath.Join(root, "work"), filepath.Join(root, "work-c")
+	run := func(dir string, args ...string) (string, error) {
+		bs, err := runner.Run(ctx, dir, args...)
+		if err != nil {
+			return "", fmt.Errorf("running `git %s`: %w (output: %s)", strings.Join(args, " "), err, trimbs(bs))
+		}
+		return trimbs(bs), nil
+	}
+	commit := func(file string) error {
+		if err := os.WriteFile(filepath.Join(work, file), []byte(file+"\n"), 0o644); err != nil {
+			return fmt.Errorf("writing %s: %w", file, err)
+		}
+		if _, err := run(work, "add", file); err != nil {
+			return err
+		}
+		_, err := run(work, "commit", "--quiet", "-m", "Change "+file)
+		return err
+	}
+
+	if _, err := run(root, "init", "--quiet", work); err != nil {
+		return err
+	}
+	steps := []func() error{
+		func() error { return commit("README") },
+		func() error { _, err := run(work, "checkout", "--quiet", "-b", "a"); return err },
+		func() error { return commit("a") },
+		func() error { _, err := run(work, "checkout", "--quiet", "-b", "b"); return err },
+		func() error { return commit("b") },
+		func() error { _, err := run(work, "checkout", "--quiet", "-b", "c", "main"); return err },
+		func() error { return commit("c") },
+		func() error { _, err := run(work, "checkout", "--quiet", "main"); return err },
+		func() error { _, err := run(work, "worktree", "add", "--quiet", wt, "c"); return err },
+		func() error { return commit("upstream") },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return fmt.Errorf("creating the branches: %w", err)
+		}
+	}
+
+	o := Options{Dir: work, Runner: runner, Offline: true, Stdout: io.Discard, Stderr: io.Discard, Yes: true}
+	if _, err := Execute(ctx, o); err != nil {
+		return err
+	}
+	for _, pair := range [][2]string{{"main", "a"}, {"a", "b"}, {"main", "c"}} {
+		if _, err := run(work, "merge-base", "--is-ancestor", pair[0], pair[1]); err != nil {
+			return fmt.Errorf("%q wasn't rebased onto %q", pair[1], pair[0])
+		}
+	}
+	for dir, want := range map[string]string{work: "main", wt: "c"} {
+		if got, _ := run(dir, "symbolic-ref", "--quiet", "--short", "HEAD"); got != want {
+			return fmt.Errorf("the worktree at %s wasn't restored to %q (checked out: %q)", dir, want, got)
+		}
+	}
+	return nil
+}
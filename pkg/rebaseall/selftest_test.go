@@ -0,0 +1,632 @@
+package rebaseall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// faultyRunner is the Runner of the scenarios. It runs git with
+// selfTestConfig and, to inject failures, fails the commands for which fail
+// (if it's non-nil) reports true, without running them.
+type faultyRunner struct {
+	Runner
+	fail func(args []string) bool
+}
+
+func (r faultyRunner) Run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	if r.fail != nil && r.fail(stripConfig(args)) {
+		return []byte("injected failure"), errInjected{}
+	}
+	return selfTestRunner{Runner: r.Runner}.Run(ctx, dir, args...)
+}
+
+// errInjected is the failure of a command failed by faultyRunner.
+type errInjected struct{}
+
+func (errInjected) Error() string { return "injected failure" }
+
+func (errInjected) ExitCode() int { return 128 }
+
+// fixture is a throwaway set of repositories for a scenario: origin, a bare
+// repository; work, a clone of it in which a run happens; and mate, another
+// clone from which origin is updated, as by a teammate.
+type fixture struct {
+	ctx                context.Context
+	runner             Runner
+	origin, work, mate string
+	worktrees          map[string]string
+}
+
+// newFixture creates the repositories in root, with a commit on main that's
+// been cloned into work.
+func newFixture(ctx context.Context, runner Runner, root string) (*fixture, error) {
+	f := &fixture{
+		ctx:       ctx,
+		runner:    runner,
+		origin:    filepath.Join(root, "origin.git"),
+		work:      filepath.Join(root, "work"),
+		mate:      filepath.Join(root, "mate"),
+		worktrees: make(map[string]string),
+	}
+	if err := f.git(root, "init", "--quiet", "--bare", f.origin); err != nil {
+		return nil, err
+	}
+	if err := f.git(root, "init", "--quiet", f.mate); err != nil {
+		return nil, err
+	}
+	if err := f.git(f.mate, "remote", "add", "origin", f.origin); err != nil {
+		return nil, err
+	}
+	if err := f.commit(f.mate, "README", "self-test\n"); err != nil {
+		return nil, err
+	}
+	if err := f.git(f.mate, "push", "--quiet", "--set-upstream", "origin", "main"); err != nil {
+		return nil, err
+	}
+	if err := f.git(root, "clone", "--quiet", f.origin, f.work); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// git runs git in dir.
+func (f *fixture) git(dir string, args ...string) error {
+	if bs, err := f.runner.Run(f.ctx, dir, args...); err != nil {
+		return fmt.Errorf("running `git %s`: %w (output: %s)", strings.Join(args, " "), err, trimbs(bs))
+	}
+	return nil
+}
+
+// output runs git in dir and returns its output.
+func (f *fixture) output(dir string, args ...string) (string, error) {
+	bs, err := f.runner.Run(f.ctx, dir, args...)
+	if err != nil {
+		return "", fmt.Errorf("running `git %s`: %w (output: %s)", strings.Join(args, " "), err, trimbs(bs))
+	}
+	return trimbs(bs), nil
+}
+
+// commit writes the file in dir and commits it.
+func (f *fixture) commit(dir, file, content string) error {
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", file, err)
+	}
+	if err := f.git(dir, "add", file); err != nil {
+		return err
+	}
+	return f.git(dir, "commit", "--quiet", "-m", "Change "+file)
+}
+
+// branch creates the branch in work from from, with a commit that writes each
+// file, and then checks out main again.
+func (f *fixture) branch(name, from string, files ...string) error {
+	if err := f.git(f.work, "checkout", "--quiet", "-b", name, from); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := f.commit(f.work, file, name+"\n"); err != nil {
+			return err
+		}
+	}
+	return f.git(f.work, "checkout", "--quiet", "main")
+}
+
+// worktree checks out the branch in a worktree of work.
+func (f *fixture) worktree(branch string) error {
+	dir := f.work + "-" + branch
+	if err := f.git(f.work, "worktree", "add", "--quiet", dir, branch); err != nil {
+		return err
+	}
+	f.worktrees[branch] = dir
+	return nil
+}
+
+// advance commits the file to main in mate and pushes it to origin.
+func (f *fixture) advance(file, content string) error {
+	if err := f.commit(f.mate, file, content); err != nil {
+		return err
+	}
+	return f.git(f.mate, "push", "--quiet", "origin", "main")
+}
+
+// forcePush has mate rewrite the last commit of the branch, which is on origin,
+// and force-push it, as a teammate might.
+func (f *fixture) forcePush(branch string) error {
+	return errors.Join(
+		f.git(f.mate, "fetch", "--quiet", "origin"),
+		f.git(f.mate, "checkout", "--quiet", branch),
+		f.git(f.mate, "commit", "--quiet", "--amend", "-m", "Rewrite "+branch),
+		f.git(f.mate, "push", "--quiet", "--force", "origin", branch),
+		f.git(f.mate, "checkout", "--quiet", "main"),
+	)
+}
+
+// checkedOut returns the branch checked out in dir, or the empty string if its
+// HEAD is detached.
+func (f *fixture) checkedOut(dir string) string {
+	ref, err := f.output(dir, "symbolic-ref", "--quiet", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(ref, "refs/heads/")
+}
+
+// contains reports whether descendant contains ancestor.
+func (f *fixture) contains(descendant, ancestor string) bool {
+	return f.git(f.work, "merge-base", "--is-ancestor", ancestor, descendant) == nil
+}
+
+// restored checks that each worktree has its branch checked out again and no
+// operation in progress.
+func (f *fixture) restored() error {
+	dirs := map[string]string{"main": f.work}
+	for b, dir := range f.worktrees {
+		dirs[b] = dir
+	}
+	g := &git{ctx: f.ctx, runner: f.runner}
+	for _, b := range sortedKeys(dirs) {
+		if got := f.checkedOut(dirs[b]); got != b {
+			return fmt.Errorf("the worktree at %s wasn't restored to %q (checked out: %q)", dirs[b], b, got)
+		}
+		ops, _, err := g.operations(dirs[b])
+		if err != nil {
+			return err
+		}
+		if len(ops) > 0 {
+			return fmt.Errorf("the worktree at %s was left with an operation in progress (%s)", dirs[b], strings.Join(ops, ", "))
+		}
+	}
+	return nil
+}
+
+// statusOf returns the status of the branch in the summary.
+func statusOf(sum Summary, branch string) string {
+	for _, r := range sum.Branches {
+		if r.Branch == branch {
+			return r.Status
+		}
+	}
+	return ""
+}
+
+// wantStatuses checks the statuses of the branches in the summary.
+func wantStatuses(sum Summary, want map[string]string) error {
+	var errs []error
+	for _, b := range sortedKeys(want) {
+		if got := statusOf(sum, b); got != want[b] {
+			errs = append(errs, fmt.Errorf("%q was %s, not %s", b, got, want[b]))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// scenario is a topology of branches and worktrees against which a run
+// is checked.
+type scenario struct {
+	name  string
+	build func(f *fixture) error
+	// opts, if non-nil, adjusts the options of the run.
+	opts func(o *Options)
+	// fail, if non-nil, selects the commands that fail (see faultyRunner).
+	fail  func(args []string) bool
+	check func(f *fixture, sum Summary, err error) error
+}
+
+// scenarios are the scenarios run by TestScenarios.
+var scenarios = []scenario{
+	{
+		name: "a stack and a branch checked out in another worktree",
+		build: func(f *fixture) error {
+			return errors.Join(
+				f.branch("a", "main", "a"),
+				f.branch("b", "a", "b"),
+				f.branch("c", "main", "c"),
+				f.worktree("c"),
+				f.advance("upstream", "upstream\n"),
+			)
+		},
+		check: func(f *fixture, sum Summary, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := wantStatuses(sum, map[string]string{"main": StatusFastForwarded, "a": StatusRebased, "b": StatusRebased, "c": StatusRebased}); err != nil {
+				return err
+			}
+			if !f.contains("b", "a") || !f.contains("a", "main") || !f.contains("c", "main") {
+				return errors.New("the branches weren't rebased onto main, with b on a")
+			}
+			return f.restored()
+		},
+	},
+	{
+		name: "a conflict, skipped",
+		build: func(f *fixture) error {
+			return errors.Join(
+				f.branch("a", "main", "a"),
+				f.branch("c", "main", "upstream"),
+				f.advance("upstream", "upstream\n"),
+			)
+		},
+		opts: func(o *Options) { o.OnConflict = "skip" },
+		check: func(f *fixture, sum Summary, err error) error {
+			var conflict *RebaseConflictError
+			if !errors.As(err, &conflict) || conflict.Branch != "c" {
+				return fmt.Errorf("expected c to conflict, but the run returned %v", err)
+			}
+			if err := wantStatuses(sum, map[string]string{"a": StatusRebased, "c": StatusConflicted}); err != nil {
+				return err
+			}
+			return f.restored()
+		},
+	},
+	{
+		name: "a branch that has diverged from its upstream",
+		build: func(f *fixture) error {
+			return errors.Join(
+				f.branch("a", "main", "a"),
+				f.git(f.work, "push", "--quiet", "--set-upstream", "origin", "a"),
+				f.git(f.work, "checkout", "--quiet", "a"),
+				f.git(f.work, "commit", "--quiet", "--amend", "-m", "Amend a"),
+				f.git(f.work, "checkout", "--quiet", "main"),
+				f.advance("upstream", "upstream\n"),
+			)
+		},
+		check: func(f *fixture, sum Summary, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := wantStatuses(sum, map[string]string{"a": StatusSkipped}); err != nil {
+				return err
+			}
+			return f.restored()
+		},
+	},
+	{
+		name: "a rebase that fails for a reason other than a conflict",
+		build: func(f *fixture) error {
+			return errors.Join(
+				f.branch("a", "main", "a"),
+				f.worktree("a"),
+				f.advance("upstream", "upstream\n"),
+			)
+		},
+		fail: func(args []string) bool {
+			return len(args) > 0 && args[0] == "rebase" && !slices.Contains(args, "--abort")
+		},
+		check: func(f *fixture, sum Summary, err error) error {
+			if !errors.Is(err, errInjected{}) {
+				return fmt.Errorf("expected the injected failure, but the run returned %v", err)
+			}
+			if err := wantStatuses(sum, map[string]string{"a": StatusConflicted}); err != nil {
+				return err
+			}
+			return f.restored()
+		},
+	},
+	{
+		name: "a conflict, paused and continued",
+		build: func(f *fixture) error {
+			return errors.Join(
+				f.branch("a", "main", "a"),
+				f.branch("c", "main", "upstream"),
+				f.branch("d", "main", "d"),
+				f.advance("upstream", "upstream\n"),
+			)
+		},
+		opts: func(o *Options) { o.OnConflict = "pause" },
+		check: func(f *fixture, sum Summary, err error) error {
+			if !errors.Is(err, ErrPaused) {
+				return fmt.Errorf("expected the run to pause, but it returned %v", err)
+			}
+			if !f.contains("a", "main") || f.contains("d", "main") {
+				return errors.New("expected a to have been rebased and d to be left for --continue")
+			}
+			// The conflict is resolved as it would be by hand, and the run
+			// continued.
+			if err := errors.Join(
+				os.WriteFile(filepath.Join(f.work, "upstream"), []byte("resolved\n"), 0o644),
+				f.git(f.work, "add", "upstream"),
+				f.git(f.work, "-c", "core.editor=true", "rebase", "--continue"),
+			); err != nil {
+				return fmt.Errorf("resolving the conflict: %w", err)
+			}
+			if err := Run(f.ctx, Options{Dir: f.work, Runner: f.runner, Continue: true, Stdout: io.Discard, Stderr: io.Discard, Yes: true}); err != nil {
+				return fmt.Errorf("continuing: %w", err)
+			}
+			if !f.contains("c", "main") || !f.contains("d", "main") {
+				return errors.New("c and d weren't rebased onto main by --continue")
+			}
+			return f.restored()
+		},
+	},
+	{
+		name: "a conflict under abort-all, rolled back",
+		build: func(f *fixture) error {
+			return errors.Join(
+				f.branch("a", "main", "a"),
+				f.branch("c", "main", "upstream"),
+				f.branch("d", "main", "d"),
+				f.worktree("d"),
+				// The branches' starting points are tagged to be checked against.
+				f.git(f.work, "tag", "main-before", "main"),
+				f.git(f.work, "tag", "a-before", "a"),
+				f.git(f.work, "tag", "c-before", "c"),
+				f.git(f.work, "tag", "d-before", "d"),
+				f.advance("upstream", "upstream\n"),
+			)
+		},
+		opts: func(o *Options) { o.OnConflict = "abort-all" },
+		check: func(f *fixture, sum Summary, err error) error {
+			var conflict *RebaseConflictError
+			if !errors.As(err, &conflict) || conflict.Branch != "c" {
+				return fmt.Errorf("expected c to conflict, but the run returned %v", err)
+			}
+			for _, b := range []string{"main", "a", "c", "d"} {
+				got, err := f.output(f.work, "rev-parse", b)
+				if err != nil {
+					return err
+				}
+				want, err := f.output(f.work, "rev-parse", b+"-before^{commit}")
+				if err != nil {
+					return err
+				}
+				if got != want {
+					return fmt.Errorf("%q wasn't rolled back (want: %s, got: %s)", b, want, got)
+				}
+			}
+			return f.restored()
+		},
+	},
+	{
+		name: "a stack and a branch behind main, with the go-git backend",
+		build: func(f *fixture) error {
+			return errors.Join(
+				f.branch("a", "main", "a"),
+				f.branch("b", "a", "b"),
+				f.branch("c", "main", "c"),
+				f.worktree("c"),
+				f.git(f.work, "branch", "behind"),
+				f.advance("upstream", "upstream\n"),
+			)
+		},
+		opts: func(o *Options) { o.Runner = &GoGitRunner{Fallback: o.Runner} },
+		// The commands that go-git answers fail if they're passed to git.
+		fail: func(args []string) bool {
+			switch {
+			case len(args) == 4 && args[0] == "merge-base" && args[1] == "--is-ancestor":
+				return true
+			case len(args) == 4 && args[0] == "branch" && (args[1] == "--contains" || args[1] == "--merged"):
+				return true
+			}
+			return false
+		},
+		check: func(f *fixture, sum Summary, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := wantStatuses(sum, map[string]string{"main": StatusFastForwarded, "a": StatusRebased, "b": StatusRebased, "c": StatusRebased, "behind": StatusFastForwarded}); err != nil {
+				return err
+			}
+			if !f.contains("b", "a") || !f.contains("a", "main") || !f.contains("c", "main") || !f.contains("behind", "main") {
+				return errors.New("the branches weren't rebased onto main, with b on a")
+			}
+			return f.restored()
+		},
+	},
+	{
+		name: "a stack and branches behind a tag",
+		build: func(f *fixture) error {
+			return errors.Join(
+				f.branch("a", "main", "a"),
+				f.branch("b", "a", "b"),
+				f.commit(f.work, "behind", "behind\n"),
+				f.git(f.work, "branch", "behind"),
+				f.commit(f.work, "release", "release\n"),
+				f.git(f.work, "tag", "v1"),
+				// No branch is at or ahead of v1, so only the tag contains
+				// behind.
+				f.git(f.work, "reset", "--quiet", "--hard", "HEAD~2"),
+			)
+		},
+		opts: func(o *Options) { o.TargetBranch, o.Offline = "v1", true },
+		check: func(f *fixture, sum Summary, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := wantStatuses(sum, map[string]string{"a": StatusRebased, "b": StatusRebased, "behind": StatusFastForwarded, "main": StatusFastForwarded}); err != nil {
+				return err
+			}
+			if !f.contains("a", "v1") || !f.contains("b", "a") {
+				return errors.New("the stack wasn't rebased onto v1, with b on a")
+			}
+			tag, err := f.output(f.work, "rev-parse", "v1^{commit}")
+			if err != nil {
+				return err
+			}
+			for _, b := range []string{"behind", "main"} {
+				if got, _ := f.output(f.work, "rev-parse", b); got != tag {
+					return fmt.Errorf("%q isn't at v1 (want: %s, got: %s)", b, tag, got)
+				}
+			}
+			return f.restored()
+		},
+	},
+	{
+		name: "branches behind main, fast-forwarded without a rebase",
+		build: func(f *fixture) error {
+			return errors.Join(
+				f.git(f.work, "branch", "x"),
+				f.git(f.work, "branch", "y"),
+				f.worktree("y"),
+				f.advance("upstream", "upstream\n"),
+			)
+		},
+		// Nothing may be rebased, nor x, which no worktree has, checked out.
+		fail: func(args []string) bool {
+			return len(args) > 0 && args[0] == "rebase" || slices.Equal(args, []string{"checkout", "x"})
+		},
+		check: func(f *fixture, sum Summary, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := wantStatuses(sum, map[string]string{"main": StatusFastForwarded, "x": StatusFastForwarded, "y": StatusFastForwarded}); err != nil {
+				return err
+			}
+			main, err := f.output(f.work, "rev-parse", "main")
+			if err != nil {
+				return err
+			}
+			for _, b := range []string{"x", "y"} {
+				if got, _ := f.output(f.work, "rev-parse", b); got != main {
+					return fmt.Errorf("%q wasn't fast-forwarded to main (want: %s, got: %s)", b, main, got)
+				}
+			}
+			return f.restored()
+		},
+	},
+	{
+		name: "force-pushed branches, reset to their upstreams",
+		build: func(f *fixture) error {
+			return errors.Join(
+				f.branch("a", "main", "a"),
+				f.branch("b", "main", "b"),
+				f.git(f.work, "push", "--quiet", "--set-upstream", "origin", "a", "b"),
+				f.forcePush("a"),
+				f.forcePush("b"),
+				// b has a commit that wasn't pushed, so it isn't reset.
+				f.git(f.work, "checkout", "--quiet", "b"),
+				f.commit(f.work, "unpushed", "unpushed\n"),
+				f.git(f.work, "checkout", "--quiet", "main"),
+				f.advance("upstream", "upstream\n"),
+			)
+		},
+		opts: func(o *Options) { o.SyncWithRemote = "reset" },
+		check: func(f *fixture, sum Summary, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := wantStatuses(sum, map[string]string{"a": StatusRebased, "b": StatusSkipped}); err != nil {
+				return err
+			}
+			if got, _ := f.output(f.work, "log", "-1", "--format=%s", "a"); got != "Rewrite a" || !f.contains("a", "main") {
+				return fmt.Errorf("a wasn't reset to origin/a and rebased onto main (its last commit: %q)", got)
+			}
+			if got, _ := f.output(f.work, "log", "-1", "--format=%s", "b~"); got != "Change b" {
+				return fmt.Errorf("b, which had a commit that wasn't pushed, was reset (its last commit but one: %q)", got)
+			}
+			return f.restored()
+		},
+	},
+	{
+		name: "a force-pushed branch and a branch on it, skipped",
+		build: func(f *fixture) error {
+			return errors.Join(
+				f.branch("a", "main", "a"),
+				f.git(f.work, "push", "--quiet", "--set-upstream", "origin", "a"),
+				f.branch("b", "a", "b"),
+				f.branch("c", "main", "c"),
+				f.forcePush("a"),
+				f.advance("upstream", "upstream\n"),
+			)
+		},
+		opts: func(o *Options) { o.SyncWithRemote = "skip" },
+		check: func(f *fixture, sum Summary, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := wantStatuses(sum, map[string]string{"a": StatusSkipped, "b": StatusSkipped, "c": StatusRebased}); err != nil {
+				return err
+			}
+			if f.contains("a", "main") || f.contains("b", "main") {
+				return errors.New("a or b was rebased")
+			}
+			return f.restored()
+		},
+	},
+	{
+		name: "branches at the same commit, rebased once",
+		build: func(f *fixture) error {
+			return errors.Join(
+				f.branch("a", "main", "a"),
+				f.git(f.work, "branch", "a2", "a"),
+				f.git(f.work, "branch", "a3", "a"),
+				f.advance("upstream", "upstream\n"),
+			)
+		},
+		// The duplicates may not be checked out to be rebased.
+		fail: func(args []string) bool {
+			return slices.Equal(args, []string{"checkout", "a2"}) || slices.Equal(args, []string{"checkout", "a3"})
+		},
+		check: func(f *fixture, sum Summary, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := wantStatuses(sum, map[string]string{"a": StatusRebased, "a2": StatusRebased, "a3": StatusRebased}); err != nil {
+				return err
+			}
+			a, err := f.output(f.work, "rev-parse", "a")
+			if err != nil {
+				return err
+			}
+			if !f.contains("a", "main") {
+				return errors.New("a wasn't rebased onto main")
+			}
+			for _, r := range sum.Branches {
+				if r.Branch != "a2" && r.Branch != "a3" {
+					continue
+				}
+				if r.NewSHA != a || r.DuplicateOf != "a" {
+					return fmt.Errorf("%q wasn't moved with a (at: %s, duplicate of: %q)", r.Branch, r.NewSHA, r.DuplicateOf)
+				}
+			}
+			return f.restored()
+		},
+	},
+}
+
+// TestScenarios runs each of the scenarios against throwaway repositories.
+func TestScenarios(t *testing.T) {
+	for _, sc := range scenarios {
+		t.Run(sc.name, func(t *testing.T) {
+			f := newTestFixture(t)
+			if err := sc.build(f); err != nil {
+				t.Fatalf("creating the branches: %v", err)
+			}
+			o := Options{Dir: f.work, Runner: faultyRunner{Runner: ExecRunner{}, fail: sc.fail}, Stdout: io.Discard, Stderr: io.Discard, Yes: true}
+			if sc.opts != nil {
+				sc.opts(&o)
+			}
+			sum, err := Execute(context.Background(), o)
+			if err := sc.check(f, sum, err); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// newTestFixture creates a fixture in a temporary directory that's removed when
+// the test ends, skipping the test if git isn't installed.
+func newTestFixture(t *testing.T) *fixture {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	// The temporary directory may be behind a symbolic link (e.g., on macOS).
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("resolving the temporary directory: %v", err)
+	}
+	f, err := newFixture(context.Background(), faultyRunner{Runner: ExecRunner{}}, root)
+	if err != nil {
+		t.Fatalf("creating the repositories: %v", err)
+	}
+	return f
+}
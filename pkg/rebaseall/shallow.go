@@ -0,0 +1,65 @@
+package rebaseall
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxDeepenings caps the number of times that a shallow clone is deepened by
+// Options.Deepen in search of the history that the branches share with the
+// target.
+const maxDeepenings = 20
+
+// ensureHistory checks, in a shallow clone, that each branch shares history
+// with the target branch, without which neither the branches to rebase can be
+// worked out nor the branches rebased. With --unshallow, the clone is first
+// made complete; with --deepen, it's deepened by that many commits at a time
+// until each branch shares history with the target. Otherwise, the run fails
+// with ErrShallow, listing the branches that don't.
+func (s *state) ensureHistory() error {
+	shallow, err := s.git.isShallow(s.currentDir)
+	if err != nil {
+		return err
+	}
+	if !shallow {
+		return nil
+	}
+	if s.opts.Unshallow {
+		fmt.Fprintln(s.out, "Unshallowing the clone...")
+		return s.git.fetch(s.currentDir, "--unshallow")
+	}
+
+	for i := 0; ; i++ {
+		var missing []string
+		for _, b := range sortedKeys(s.branches) {
+			if b == s.targetBranch {
+				continue
+			}
+			ok, err := s.git.hasMergeBase(s.currentDir, b, s.targetBranch)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				missing = append(missing, b)
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		if s.opts.Deepen <= 0 || i == maxDeepenings {
+			for _, b := range missing {
+				fmt.Fprintf(s.out, "  %s: shares no history with %q in this shallow clone.\n", b, s.targetBranch)
+			}
+			msg := "pass --deepen=<commits> or --unshallow to fetch more history"
+			if s.opts.Deepen > 0 {
+				msg = fmt.Sprintf("deepened %d times by %d commits; pass --unshallow to fetch all of the history", i, s.opts.Deepen)
+			}
+			return fmt.Errorf("%w (branches: %s): %s", ErrShallow, strings.Join(missing, ", "), msg)
+		}
+		fmt.Fprintf(s.out, "Deepening the shallow clone by %d commits...\n", s.opts.Deepen)
+		if err := s.git.fetch(s.currentDir, "--deepen="+strconv.Itoa(s.opts.Deepen)); err != nil {
+			return fmt.Errorf("deepening the clone: %w", err)
+		}
+	}
+}
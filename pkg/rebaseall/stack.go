@@ -0,0 +1,144 @@
+package rebaseall
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// stackAware reports whether the branches are arranged in stacks, which they
+// are when merging as merging into a leaf leaves the branches beneath it alone.
+func (s *state) stackAware() bool { return s.opts.StackAware || s.opts.Strategy == "merge" }
+
+// stackBranches replaces the branches to rebase with the stacks that they
+// head, parents before children. A branch's parent is the nearest branch that
+// it contains that isn't merged into the target; a branch with a parent is
+// rebased onto it, after it, rather than being moved by --update-refs. A parent
+// that was filtered out is a boundary: it's left alone, and the branch is
+// rebased onto its current tip, which keeps the stack intact.
+func (s *state) stackBranches() error {
+	merged := make(map[string]bool, len(s.branches))
+	children := make(map[string][]string, len(s.branches))
+	for _, b := range sortedKeys(s.branches) {
+		if b == s.targetBranch {
+			continue
+		}
+		ok, err := s.git.isAncestor(s.currentDir, b, s.targetBranch)
+		if err != nil {
+			return fmt.Errorf("checking whether %q is merged into %q: %w", b, s.targetBranch, err)
+		}
+		if merged[b] = ok; ok {
+			continue
+		}
+		if children[b], err = s.branchChildren(s.currentDir, b); err != nil {
+			return err
+		}
+	}
+
+	parents := make(map[string]string)
+	for _, b := range sortedKeys(children) {
+		var candidates []string
+		for _, p := range sortedKeys(children) {
+			// A branch at the same commit contains the branch, too, but it's a
+			// duplicate of it (see collapseDuplicates) rather than its parent.
+			if s.branches[p] != s.branches[b] && slices.Contains(children[p], b) {
+				candidates = append(candidates, p)
+			}
+		}
+		// The nearest candidate is the one that contains no other.
+		for _, p := range candidates {
+			if !slices.ContainsFunc(candidates, func(q string) bool { return slices.Contains(children[p], q) }) {
+				parents[b] = p
+				break
+			}
+		}
+	}
+
+	ordered := make([]string, 0, len(s.branchesToRebase))
+	visited := make(map[string]bool)
+	var visit func(string)
+	visit = func(b string) {
+		if visited[b] {
+			return
+		}
+		visited[b] = true
+		if p, ok := parents[b]; ok {
+			if why, ok := s.boundaries[p]; ok {
+				s.filtered[p] = why
+			} else if _, ok := s.filtered[p]; !ok {
+				visit(p)
+			}
+		}
+		ordered = append(ordered, b)
+	}
+	for _, b := range s.branchesToRebase {
+		visit(b)
+	}
+
+	s.parents = make(map[string]string)
+	s.parentSHAs = make(map[string]string)
+	for _, b := range ordered {
+		if p, ok := parents[b]; ok {
+			s.parents[b] = p
+			s.parentSHAs[b] = s.branches[p]
+		}
+		if a := s.actions[b]; a == "" || a == actionSkip {
+			s.actions[b] = actionStacked
+		}
+	}
+	s.branchesToRebase = ordered
+	return nil
+}
+
+// stacks returns the lines that depict the stacks of the branches to rebase,
+// each branch indented beneath its parent. A branch whose parent is a boundary
+// (see stackBranches) heads a stack of its own and is marked as such.
+func (s *state) stacks() []string {
+	var roots []string
+	kids := make(map[string][]string)
+	for _, b := range s.branchesToRebase {
+		if p, ok := s.parents[b]; ok && slices.Contains(s.branchesToRebase, p) {
+			kids[p] = append(kids[p], b)
+		} else {
+			roots = append(roots, b)
+		}
+	}
+
+	var lines []string
+	var walk func(string, int)
+	walk = func(b string, depth int) {
+		line := strings.Repeat("  ", depth) + b
+		if p, ok := s.parents[b]; ok && depth == 0 {
+			line += fmt.Sprintf(" (on %s, which is left alone)", p)
+		}
+		lines = append(lines, line)
+		for _, c := range kids[b] {
+			walk(c, depth+1)
+		}
+	}
+	for _, r := range roots {
+		walk(r, 0)
+	}
+	return lines
+}
+
+// stackFailure returns the reason for which the branch can't be rebased onto
+// its parent, which is that the parent failed to rebase or was itself skipped
+// while rebasing, or the empty string if it can be. A parent that was filtered
+// out up front is a boundary, onto which the branch is rebased as it is.
+func (s *state) stackFailure(branch string) string {
+	p, ok := s.parents[branch]
+	if !ok {
+		return ""
+	}
+	if o, ok := s.outcomes[p]; ok && o.err != nil {
+		return fmt.Sprintf("its parent, %s, failed to rebase", p)
+	}
+	if o, ok := s.outcomes[p]; ok && o.verifyErr != nil {
+		return fmt.Sprintf("its parent, %s, failed verification", p)
+	}
+	if _, ok := s.filtered[p]; ok && slices.Contains(s.branchesToRebase, p) {
+		return fmt.Sprintf("its parent, %s, was skipped", p)
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+package rebaseall
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// slowestBranches is the number of the slowest branches listed by --stats.
+const slowestBranches = 5
+
+// Stats are the statistics of a run that --stats reports, to help find out why
+// a run is slow.
+type Stats struct {
+	// Commands is the number of git commands that were run.
+	Commands int64         `json:"commands"`
+	Phases   []PhaseTiming `json:"phases"`
+	// Slowest are the branches that took the longest to update, slowest
+	// first.
+	Slowest []BranchTiming `json:"slowest,omitempty"`
+	// Commits is the number of commits that were replayed by the rebases.
+	Commits int `json:"commits"`
+}
+
+// PhaseTiming is how long a phase of the run (e.g., fetch or rebase) took.
+type PhaseTiming struct {
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+}
+
+// BranchTiming is how long a branch took to update.
+type BranchTiming struct {
+	Branch  string  `json:"branch"`
+	Seconds float64 `json:"seconds"`
+}
+
+// timePhase records that the phase, which started at start, has finished.
+func (s *state) timePhase(phase string, start time.Time) {
+	s.phases = append(s.phases, PhaseTiming{Phase: phase, Seconds: time.Since(start).Seconds()})
+}
+
+// stats returns the statistics of the run, whose summary is sum.
+func (s *state) stats(sum Summary) *Stats {
+	st := &Stats{Commands: s.git.commands.Load(), Phases: s.phases}
+	for _, r := range sum.Branches {
+		if r.Status == StatusRebased {
+			st.Commits += r.Commits
+		}
+		if r.Seconds > 0 {
+			st.Slowest = append(st.Slowest, BranchTiming{Branch: r.Branch, Seconds: r.Seconds})
+		}
+	}
+	slices.SortStableFunc(st.Slowest, func(a, b BranchTiming) int { return cmp.Compare(b.Seconds, a.Seconds) })
+	st.Slowest = st.Slowest[:min(len(st.Slowest), slowestBranches)]
+	return st
+}
+
+// printStats prints the statistics of the run.
+func printStats(w io.Writer, st *Stats) {
+	fmt.Fprintln(w, "Stats:")
+	fmt.Fprintf(w, "  git commands: %d\n", st.Commands)
+	fmt.Fprintf(w, "  commits replayed: %d\n", st.Commits)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  phases:")
+	for _, p := range st.Phases {
+		fmt.Fprintf(tw, "    %s\t%s\n", p.Phase, seconds(p.Seconds))
+	}
+	if len(st.Slowest) > 0 {
+		fmt.Fprintln(tw, "  slowest branches:")
+	}
+	for _, b := range st.Slowest {
+		fmt.Fprintf(tw, "    %s\t%s\n", b.Branch, seconds(b.Seconds))
+	}
+	tw.Flush()
+}
+
+// seconds formats a number of seconds as a duration to the millisecond.
+func seconds(secs float64) string {
+	return time.Duration(secs * float64(time.Second)).Round(time.Millisecond).String()
+}
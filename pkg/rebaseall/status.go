@@ -0,0 +1,97 @@
+package rebaseall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// status prints whether a run is paused, whether one holds the lock file, how
+// the last run went, and what each worktree has checked out, with any
+// operation in progress. Unlike --health, it neither fetches nor compares the
+// branches, and so it's quick.
+func status(ctx context.Context, opts Options) error {
+	g := opts.git(ctx)
+	currentDir, err := opts.workDir()
+	if err != nil {
+		return err
+	}
+	w := opts.Stdout
+
+	path, err := pausedRunPath(g, currentDir)
+	if err != nil {
+		return err
+	}
+	bs, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		fmt.Fprintln(w, "No run is paused.")
+	case err != nil:
+		return fmt.Errorf("reading the paused run: %w", err)
+	default:
+		var p pausedRun
+		if err := json.Unmarshal(bs, &p); err != nil {
+			return fmt.Errorf("parsing the paused run (path: %s): %w", path, err)
+		}
+		fmt.Fprintf(w, "A run onto %s is paused on %q (dir: %s) with %d more %s to update; resolve the conflict and run `git-rebase-all continue`.\n", p.Target, p.Branch, p.Dir, len(p.Remaining), plural(len(p.Remaining), "branch", "branches"))
+	}
+
+	dir, err := journalDir(g, currentDir)
+	if err != nil {
+		return err
+	}
+	if h, err := readLock(filepath.Join(dir, lockFileName)); err == nil {
+		if h.stale() {
+			fmt.Fprintf(w, "A run that has exited left the lock file behind (%s); clear it with --force-unlock.\n", h)
+		} else {
+			fmt.Fprintf(w, "A run holds the lock file (%s).\n", h)
+		}
+	}
+
+	last, err := lastJournal(dir)
+	if err != nil {
+		return err
+	}
+	if last == nil {
+		fmt.Fprintln(w, "No run has been journalled.")
+	} else {
+		result := "succeeded"
+		if last.Summary.Error != "" {
+			result = "failed"
+		}
+		fmt.Fprintf(w, "The last run, at %s, onto %s, %s (%s).\n", last.Start.Local().Format(time.DateTime), last.Summary.Target, result, statusCounts(last.Summary))
+	}
+
+	worktrees, err := g.worktrees()
+	if err != nil {
+		return fmt.Errorf("fetching and parsing worktrees: %w", err)
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKTREE\tCHECKED OUT\tIN PROGRESS\tSTATE")
+	for _, wt := range worktrees {
+		var ops []string
+		if !wt.prunable {
+			if ops, _, err = g.operations(wt.dir); err != nil {
+				return fmt.Errorf("detecting the operations in progress (dir: %s): %w", wt.dir, err)
+			}
+		}
+		checkedOut := wt.branch
+		if checkedOut == "" {
+			checkedOut = "(detached at " + shortSHA(wt.head) + ")"
+		}
+		inProgress := strings.Join(ops, ", ")
+		if inProgress == "" {
+			inProgress = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", wt.dir, checkedOut, inProgress, wt.state())
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,369 @@
+package rebaseall
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// These are the statuses of the branches in the summary of a run.
+const (
+	StatusRebased       = "rebased"
+	StatusMerged        = "merged"
+	StatusFastForwarded = "fast-forwarded"
+	StatusSkipped       = "skipped"
+	StatusConflicted    = "conflicted"
+	// StatusUnverified is for a branch that was rolled back as it failed
+	// --verify.
+	StatusUnverified = "verification-failed"
+	StatusUnchanged  = "unchanged"
+	StatusUpToDate   = "up-to-date"
+	StatusDeleted    = "deleted"
+)
+
+// outcome records the result of rebasing a branch.
+type outcome struct {
+	err      error
+	duration time.Duration
+	// upToDate denotes that the branch was already based on its base and so
+	// wasn't rebased.
+	upToDate bool
+	// verifyErr is the failure of the --verify command, if any.
+	verifyErr error
+	// fastForwarded denotes that the branch was behind its base and so was
+	// moved with git update-ref rather than rebased.
+	fastForwarded bool
+}
+
+// Summary records the result of a run for each branch and worktree.
+type Summary struct {
+	Target    string           `json:"target"`
+	Onto      string           `json:"onto"`
+	Branches  []BranchResult   `json:"branches"`
+	Worktrees []WorktreeResult `json:"worktrees"`
+	Seconds   float64          `json:"seconds"`
+	Error     string           `json:"error,omitempty"`
+	// Stats are only gathered with Options.Stats.
+	Stats *Stats `json:"stats,omitempty"`
+	// Groups are only counted with Options.GroupByPrefix.
+	Groups []GroupResult `json:"groups,omitempty"`
+}
+
+// BranchResult is the result of a run for a branch; Status is one of the
+// status constants.
+type BranchResult struct {
+	Branch  string  `json:"branch"`
+	Status  string  `json:"status"`
+	OldSHA  string  `json:"old_sha"`
+	NewSHA  string  `json:"new_sha"`
+	Reason  string  `json:"reason,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	Seconds float64 `json:"seconds,omitempty"`
+	// Commits is the number of commits by which the branch moved: those
+	// replayed by a rebase or gained by a fast-forward or merge.
+	Commits int    `json:"commits,omitempty"`
+	Push    string `json:"push,omitempty"`
+	// Parent is the branch onto which the branch was rebased with
+	// --stack-aware, if any.
+	Parent string `json:"parent,omitempty"`
+	// Unsigned is the number of the branch's new commits that have no
+	// signature. It's only counted if the commits were to be signed (see
+	// Options.GPGSign).
+	Unsigned int `json:"unsigned,omitempty"`
+	// DuplicateOf is the branch that pointed at the same commit as the branch
+	// and was rebased in its place, if any.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+// WorktreeResult records whether a worktree was restored to its original
+// branch or, if its HEAD was detached (or was detached by --restore), to its
+// original commit, Head.
+type WorktreeResult struct {
+	Dir      string `json:"dir"`
+	Branch   string `json:"branch"`
+	Head     string `json:"head,omitempty"`
+	Restored bool   `json:"restored"`
+	Error    string `json:"error,omitempty"`
+	// Remedy is the command that restores the worktree if it wasn't.
+	Remedy string `json:"remedy,omitempty"`
+}
+
+// record records the outcome of rebasing the branch. It's safe to call
+// concurrently.
+func (s *state) record(branch string, err error, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.outcomes == nil {
+		s.outcomes = make(map[string]outcome)
+	}
+	s.outcomes[branch] = outcome{err: err, duration: d}
+}
+
+// recordUnverified records that the branch failed verification.
+func (s *state) recordUnverified(branch string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.outcomes[branch]
+	o.verifyErr = err
+	s.outcomes[branch] = o
+}
+
+// recordFastForwarded records that the branch was fast-forwarded. It's safe to
+// call concurrently.
+func (s *state) recordFastForwarded(branch string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.outcomes[branch]
+	o.fastForwarded = true
+	s.outcomes[branch] = o
+}
+
+// unverified returns the branches that failed verification.
+func (s *state) unverified() []string {
+	var out []string
+	for _, b := range sortedKeys(s.outcomes) {
+		if s.outcomes[b].verifyErr != nil {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// recordUpToDate records that the branch was already based on its base. It's
+// safe to call concurrently.
+func (s *state) recordUpToDate(branch string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.outcomes == nil {
+		s.outcomes = make(map[string]outcome)
+	}
+	s.outcomes[branch] = outcome{upToDate: true}
+}
+
+// summary compares the branches as they are now with how they were at the start
+// of the run.
+func (s *state) summary(runErr error) Summary {
+	final, err := s.git.branches(s.currentDir)
+	if err != nil {
+		final = s.branches
+	}
+
+	sum := Summary{Target: s.targetBranch, Onto: s.base(), Worktrees: s.restored, Seconds: time.Since(s.start).Seconds()}
+	if runErr != nil {
+		sum.Error = runErr.Error()
+	}
+
+	// The branches created during the run follow those that existed at its
+	// start.
+	names := sortedKeys(s.originalBranches)
+	for _, b := range sortedKeys(final) {
+		if _, ok := s.originalBranches[b]; !ok {
+			names = append(names, b)
+		}
+	}
+	signing := s.signing()
+	for _, b := range names {
+		r := BranchResult{Branch: b, OldSHA: s.originalBranches[b], NewSHA: final[b]}
+		o, attempted := s.outcomes[b]
+		switch {
+		case s.deleted[b]:
+			r.Status = StatusDeleted
+		case attempted && o.err != nil:
+			r.Status, r.Error = StatusConflicted, o.err.Error()
+		case attempted && o.verifyErr != nil:
+			r.Status, r.Error = StatusUnverified, o.verifyErr.Error()
+		case attempted && o.upToDate && r.OldSHA == r.NewSHA:
+			r.Status = StatusUpToDate
+		case attempted && r.OldSHA == r.NewSHA:
+			r.Status = StatusUnchanged
+		case r.OldSHA != r.NewSHA && (s.actions[b] == actionFastForward || o.fastForwarded || b == s.targetBranch || slices.Contains(s.mappedTargets(), b)):
+			r.Status = StatusFastForwarded
+		case r.OldSHA != r.NewSHA && s.opts.Strategy == "merge":
+			r.Status = StatusMerged
+		case r.OldSHA != r.NewSHA:
+			// This includes the branches that were moved by --update-refs.
+			r.Status = StatusRebased
+		default:
+			r.Status, r.Reason = StatusSkipped, s.filtered[b]
+		}
+		if attempted {
+			r.Seconds = o.duration.Seconds()
+		}
+		r.Commits = s.commitsMoved(b, r)
+		r.Push = s.pushes[b]
+		r.Parent = s.parents[b]
+		if rep, ok := s.duplicates[b]; ok {
+			r.DuplicateOf = rep
+			if r.Status == StatusRebased {
+				r.Reason = fmt.Sprintf("moved with %q, which pointed at the same commit", rep)
+			}
+		}
+		if signing {
+			r.Unsigned = s.unsignedCommits(b, r)
+		}
+		sum.Branches = append(sum.Branches, r)
+	}
+	if s.opts.Stats {
+		sum.Stats = s.stats(sum)
+	}
+	if s.opts.GroupByPrefix {
+		sum.Groups = groupResults(sum.Branches)
+	}
+	return sum
+}
+
+// commitsMoved returns the number of commits by which the branch moved (see
+// BranchResult.Commits), or 0 if they can't be counted.
+func (s *state) commitsMoved(branch string, r BranchResult) int {
+	from := r.OldSHA
+	switch r.Status {
+	case StatusRebased:
+		from = s.baseFor(branch)
+	case StatusFastForwarded, StatusMerged:
+	default:
+		return 0
+	}
+	n, _, err := s.git.aheadBehind(s.currentDir, from, r.NewSHA)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// signing reports whether the rebased and merged commits were to be signed,
+// by --gpg-sign or commit.gpgSign.
+func (s *state) signing() bool {
+	if s.opts.GPGSign {
+		return true
+	}
+	ok, err := s.git.configBool(s.currentDir, "commit.gpgSign")
+	if err != nil {
+		s.warnf("%v", err)
+	}
+	return ok
+}
+
+// unsignedCommits returns the number of the branch's new commits that have no
+// signature (see BranchResult.Unsigned): those replayed by a rebase or the merge
+// commit of a merge. It returns 0 if they can't be counted.
+func (s *state) unsignedCommits(branch string, r BranchResult) int {
+	var args []string
+	switch r.Status {
+	case StatusRebased:
+		args = []string{s.baseFor(branch) + ".." + r.NewSHA}
+	case StatusMerged:
+		args = []string{"-1", r.NewSHA}
+	default:
+		return 0
+	}
+	n, err := s.git.unsignedCommits(s.currentDir, args...)
+	if err != nil {
+		s.warnf("counting the unsigned commits of %q: %v", branch, err)
+		return 0
+	}
+	return n
+}
+
+// printSummary prints the summary, sum, of the run to stdout, as a table (and,
+// with the github format, as annotations; see printAnnotations) or as JSON.
+func (s *state) printSummary(sum Summary, runErr error) {
+	if s.opts.Format == "github" {
+		defer printAnnotations(s.opts.Stdout, sum)
+	}
+	if s.opts.Format != "json" {
+		// A run that failed before touching anything has nothing to tabulate.
+		untouched := !slices.ContainsFunc(sum.Branches, func(r BranchResult) bool { return r.Status != StatusSkipped || r.Reason != "" })
+		if runErr == nil || !untouched {
+			printSummaryTable(s.opts.Stdout, sum, s.opts.useColor(s.opts.Stdout))
+		}
+		if sum.Stats != nil {
+			printStats(s.opts.Stdout, sum.Stats)
+		}
+		return
+	}
+	bs, err := json.MarshalIndent(sum, "", "  ")
+	if err != nil {
+		s.warnf("encoding the summary: %v", err)
+		return
+	}
+	fmt.Fprintln(s.opts.Stdout, string(bs))
+}
+
+// writeSummaryFile writes the summary, sum, to path as JSON (see
+// Options.SummaryFile).
+func writeSummaryFile(path string, sum Summary) error {
+	bs, err := json.MarshalIndent(sum, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding the summary: %w", err)
+	}
+	if err := os.WriteFile(path, append(bs, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing the summary file: %w", err)
+	}
+	return nil
+}
+
+// printSummaryTable prints a line for each branch with its status, its old and
+// new commit SHAs, the number of commits by which it moved, and any reason or
+// error, followed by the branches with unsigned commits, if any. With color,
+// each status is coloured (see statusColor). If the branches were grouped (see
+// Options.GroupByPrefix), then they're listed group by group, followed by the
+// counts of each group.
+func printSummaryTable(w io.Writer, sum Summary, color bool) {
+	branches := sum.Branches
+	if sum.Groups != nil {
+		prefixes, grouped := groupBy(branches, func(r BranchResult) string { return r.Branch })
+		branches = nil
+		for _, p := range prefixes {
+			branches = append(branches, grouped[p]...)
+		}
+	}
+
+	fmt.Fprintln(w, "Summary:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	// The header is painted, too, so that the escape sequences, which tabwriter
+	// counts, pad every row alike.
+	fmt.Fprintf(tw, "  BRANCH\t%s\tOLD\tNEW\tCOMMITS\tDETAIL\n", paint(color, colorDefault, "STATUS"))
+	for _, r := range branches {
+		detail := r.Reason
+		if r.Error != "" {
+			detail, _, _ = strings.Cut(r.Error, "\n")
+		}
+		commits := "-"
+		if r.Commits > 0 {
+			commits = strconv.Itoa(r.Commits)
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%s\n", r.Branch, paint(color, statusColor(r.Status), r.Status), shortSHA(r.OldSHA), shortSHA(r.NewSHA), commits, detail)
+	}
+	tw.Flush()
+
+	if sum.Groups != nil {
+		fmt.Fprintln(w, "Groups:")
+		for _, g := range sum.Groups {
+			printGroupHeader(w, g.Prefix, g.Branches, g.Statuses)
+		}
+	}
+
+	var unsigned []string
+	for _, r := range sum.Branches {
+		if r.Unsigned > 0 {
+			unsigned = append(unsigned, fmt.Sprintf("%s (%d)", r.Branch, r.Unsigned))
+		}
+	}
+	if len(unsigned) > 0 {
+		fmt.Fprintf(w, "These branches have unsigned commits: %s.\n", strings.Join(unsigned, ", "))
+	}
+}
+
+// shortSHA abbreviates a commit SHA for display, or returns "-" if it's empty.
+func shortSHA(sha string) string {
+	if sha == "" {
+		return "-"
+	}
+	return sha[:min(len(sha), 7)]
+}
@@ -0,0 +1,180 @@
+package rebaseall
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// syncWithRemote handles the branches whose counterparts on a remote (their
+// upstreams, e.g., origin/foo for foo) were force-pushed since they were last
+// fetched, as Options.SyncWithRemote says: by resetting them to their
+// upstreams, by merging their upstreams into them, or by skipping them. A
+// branch with commits that were never pushed isn't reset, as they'd be lost.
+func (s *state) syncWithRemote() error {
+	if s.skippedForcePushes == nil {
+		s.skippedForcePushes = make(map[string]string)
+	}
+	for _, b := range sortedKeys(s.branches) {
+		if b == s.targetBranch || slices.Contains(s.mappedTargets(), b) {
+			continue
+		}
+		up, old, err := s.forcePushed(b)
+		if err != nil {
+			return err
+		}
+		if up == "" {
+			continue
+		}
+
+		switch s.opts.SyncWithRemote {
+		case "skip":
+			if err := s.skipForcePushed(b, up); err != nil {
+				return err
+			}
+			continue
+		case "reset":
+			pushed, err := s.git.isAncestor(s.currentDir, b, old)
+			if err != nil {
+				return fmt.Errorf("checking whether %q was pushed: %w", b, err)
+			}
+			if !pushed {
+				s.warnf("%q has commits that weren't pushed before %s was force-pushed, so it isn't reset", b, up)
+				continue
+			}
+			if err := s.resetBranch(b, up); err != nil {
+				return err
+			}
+			fmt.Fprintf(s.out, "Reset %q to %s, which was force-pushed.\n", b, up)
+		case "merge":
+			if err := s.mergeUpstream(b, up); err != nil {
+				if s.git.ctx.Err() != nil {
+					return err
+				}
+				s.warnf("%v; skipping it", err)
+				if err := s.skipForcePushed(b, up); err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Fprintf(s.out, "Merged %s, which was force-pushed, into %q.\n", up, b)
+		}
+
+		sha, err := s.git.branchToSHA(s.currentDir, b)
+		if err != nil {
+			return fmt.Errorf("resolving %q: %w", b, err)
+		}
+		s.branches[b] = sha
+	}
+	return nil
+}
+
+// forcePushed returns the upstream of the branch and the upstream's commit SHA
+// before it was last fetched if the upstream is the branch's counterpart on a
+// remote, it has diverged from the branch, and it was force-pushed. Otherwise,
+// it returns empty strings. Force-pushes are found in the upstream's reflog, so
+// they can't be found without one.
+func (s *state) forcePushed(branch string) (up, old string, err error) {
+	if up, err = s.git.upstream(s.currentDir, branch); err != nil {
+		return "", "", fmt.Errorf("resolving the upstream of %q: %w", branch, err)
+	}
+	if up == "" || !strings.HasSuffix(up, "/"+branch) {
+		return "", "", nil
+	}
+	ahead, behind, err := s.git.aheadBehind(s.currentDir, up, branch)
+	if err != nil {
+		return "", "", fmt.Errorf("comparing %q with its upstream (%s): %w", branch, up, err)
+	}
+	if ahead == 0 || behind == 0 {
+		return "", "", nil
+	}
+	if old, err = s.git.resolve(s.currentDir, "refs/remotes/"+up+"@{1}"); err != nil || old == "" {
+		return "", "", err
+	}
+	fastForward, err := s.git.isAncestor(s.currentDir, old, up)
+	if err != nil {
+		return "", "", fmt.Errorf("checking whether %s was force-pushed: %w", up, err)
+	}
+	if fastForward {
+		return "", "", nil
+	}
+	return up, old, nil
+}
+
+// skipForcePushed records that the branch, whose upstream was force-pushed, is
+// to be skipped, as are the branches that contain it, as rebasing them would
+// rewrite it, too.
+func (s *state) skipForcePushed(branch, up string) error {
+	s.skippedForcePushes[branch] = "its upstream, " + up + ", was force-pushed (see --sync-with-remote)"
+	children, err := s.branchChildren(s.currentDir, branch)
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		if _, ok := s.skippedForcePushes[c]; !ok {
+			s.skippedForcePushes[c] = "rebasing it would rewrite " + branch + ", whose upstream, " + up + ", was force-pushed (see --sync-with-remote)"
+		}
+	}
+	return nil
+}
+
+// resetBranch resets the branch to rev: in the worktree that has it checked out,
+// if there's one that wasn't detached, and otherwise by updating the reference.
+func (s *state) resetBranch(branch, rev string) error {
+	if err := s.backup(); err != nil {
+		return err
+	}
+	if dir := s.checkedOutIn(branch); dir != "" {
+		if err := s.git.resetHard(dir, rev); err != nil {
+			return fmt.Errorf("resetting %q to %s (dir: %s): %w", branch, rev, dir, err)
+		}
+		return nil
+	}
+	sha, err := s.git.resolve(s.currentDir, rev)
+	if err != nil {
+		return fmt.Errorf("resolving %s: %w", rev, err)
+	}
+	if err := s.git.updateRef(s.currentDir, "refs/heads/"+branch, sha); err != nil {
+		return fmt.Errorf("resetting %q to %s: %w", branch, rev, err)
+	}
+	return nil
+}
+
+// mergeUpstream merges the upstream into the branch, in the worktree that has it
+// checked out, if there's one that wasn't detached, and otherwise in the current
+// directory, which is then detached again if it was. A merge that conflicts is
+// aborted.
+func (s *state) mergeUpstream(branch, up string) (err error) {
+	if err := s.backup(); err != nil {
+		return err
+	}
+	dir := s.checkedOutIn(branch)
+	if dir == "" {
+		dir = s.currentDir
+		if err := s.git.checkout(dir, branch); err != nil {
+			return fmt.Errorf("checking out a branch (dir: %s, branch: %s): %w", dir, branch, err)
+		}
+		if s.decapitates() {
+			defer func() { err = errors.Join(err, s.git.decapitate(dir)) }()
+		}
+	}
+	if err := s.git.merge(dir, up, true); err != nil {
+		return fmt.Errorf("merging %s into %q (dir: %s): %w", up, branch, dir, err)
+	}
+	return nil
+}
+
+// checkedOutIn returns the worktree that has the branch checked out, if its
+// HEAD wasn't detached, or the empty string.
+func (s *state) checkedOutIn(branch string) string {
+	if s.decapitates() {
+		return ""
+	}
+	for _, w := range s.worktrees {
+		if w.branch == branch {
+			return w.dir
+		}
+	}
+	return ""
+}
@@ -0,0 +1,176 @@
+package rebaseall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+)
+
+// backupPrefix is the namespace of the references that back up the last run
+// that rewrote a branch: each branch's commit SHA before the run is recorded
+// under backupHeads, and each branch that the run created (e.g., with
+// --track-remote) under backupCreated.
+const (
+	backupPrefix  = "refs/rebase-all/backup/"
+	backupHeads   = backupPrefix + "heads/"
+	backupCreated = backupPrefix + "created/"
+)
+
+// backup records each branch's commit SHA under backupHeads, replacing the
+// backup of the previous run. It's called just before the run first rewrites,
+// creates, or deletes a branch, and does nothing after the first call, so a run
+// that fails beforehand or has nothing to do leaves the previous run's backup
+// in place. It's safe to call concurrently.
+func (s *state) backup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.backedUp {
+		return nil
+	}
+	old, err := s.git.refs(s.currentDir, backupPrefix)
+	if err != nil {
+		return fmt.Errorf("listing the backups: %w", err)
+	}
+	for _, ref := range sortedKeys(old) {
+		b, ok := strings.CutPrefix(ref, "heads/")
+		if _, kept := s.originalBranches[b]; ok && kept {
+			continue
+		}
+		if err := s.git.deleteRef(s.currentDir, backupPrefix+ref); err != nil {
+			return err
+		}
+	}
+	for _, b := range sortedKeys(s.originalBranches) {
+		if err := s.git.updateRef(s.currentDir, backupHeads+b, s.originalBranches[b]); err != nil {
+			return err
+		}
+	}
+	s.backedUp = true
+	s.verbosef("Backed up %d %s to %s.", len(s.originalBranches), plural(len(s.originalBranches), "branch", "branches"), backupHeads)
+	return nil
+}
+
+// backupCreation records that the run created the branch at the given commit
+// SHA, so that undo deletes it. The backup must have been made.
+func (s *state) backupCreation(branch, sha string) error {
+	return s.git.updateRef(s.currentDir, backupCreated+branch, sha)
+}
+
+// undo resets each branch to its backup, recreating any that were deleted and
+// deleting any that the run created, and leaves the backups in place. As with a
+// run, the worktrees' HEADs are detached so that the branches can be moved, and
+// then the worktrees are restored.
+func undo(ctx context.Context, opts Options) (err error) {
+	g := opts.git(ctx)
+	currentDir, err := opts.workDir()
+	if err != nil {
+		return err
+	}
+	backups, err := g.refs(currentDir, backupHeads)
+	if err != nil {
+		return fmt.Errorf("listing the backups: %w", err)
+	}
+	created, err := g.refs(currentDir, backupCreated)
+	if err != nil {
+		return fmt.Errorf("listing the branches created by the run: %w", err)
+	}
+	if len(backups) == 0 {
+		return errors.New("there are no backups to restore; they're made by each run that rewrites a branch")
+	}
+	worktrees, err := g.worktrees()
+	if err != nil {
+		return fmt.Errorf("fetching and parsing worktrees: %w", err)
+	}
+	branches, err := g.branches(currentDir)
+	if err != nil {
+		return fmt.Errorf("listing the local branches: %w", err)
+	}
+
+	// The prunable worktrees' directories are gone, so they can't be detached.
+	worktrees = slices.DeleteFunc(worktrees, func(w worktree) bool { return w.prunable })
+	s := &state{worktrees: worktrees, currentDir: currentDir, opts: opts, git: g, out: opts.progress()}
+	if err := s.errIfUncommittedChanges(); err != nil {
+		return fmt.Errorf("verifying that there are no uncommitted changes: %w", err)
+	}
+	if err := s.decapitateAll(); err != nil {
+		return fmt.Errorf("failed to detach the HEAD for each worktree: %w", err)
+	}
+	defer func() { err = errors.Join(err, s.restore()) }()
+
+	for _, b := range sortedKeys(backups) {
+		sha := backups[b]
+		if branches[b] == sha {
+			continue
+		}
+		if err := g.updateRef(currentDir, "refs/heads/"+b, sha); err != nil {
+			return fmt.Errorf("resetting %q: %w", b, err)
+		}
+		if _, ok := branches[b]; ok {
+			fmt.Fprintf(s.out, "Reset %q to %s.\n", b, sha)
+		} else {
+			fmt.Fprintf(s.out, "Recreated %q at %s.\n", b, sha)
+		}
+	}
+	for _, b := range sortedKeys(created) {
+		if _, ok := branches[b]; !ok {
+			continue
+		}
+		if err := g.deleteBranch(currentDir, b); err != nil {
+			return fmt.Errorf("deleting %q, which the run created: %w", b, err)
+		}
+		fmt.Fprintf(s.out, "Deleted %q, which the run created.\n", b)
+	}
+
+	// The paused run, if any, has been undone too.
+	path, err := pausedRunPath(g, currentDir)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing the paused run: %w", err)
+	}
+	return nil
+}
+
+// rollback resets every branch to where it was at the start of the run,
+// recreating any that were pruned, for --on-conflict=abort-all. A branch that's
+// checked out is reset in its worktree so that the worktree matches it.
+func (s *state) rollback() error {
+	g := s.git.detached()
+	branches, err := g.branches(s.currentDir)
+	if err != nil {
+		return fmt.Errorf("listing the branches to roll back: %w", err)
+	}
+	worktrees, err := g.worktrees()
+	if err != nil {
+		return fmt.Errorf("fetching and parsing worktrees: %w", err)
+	}
+	checkedOut := make(map[string]string, len(worktrees))
+	for _, w := range worktrees {
+		if w.branch != "" && !w.prunable {
+			checkedOut[w.branch] = w.dir
+		}
+	}
+
+	fmt.Fprintln(s.out, "Rolling back the branches...")
+	for _, b := range sortedKeys(s.originalBranches) {
+		sha := s.originalBranches[b]
+		if branches[b] == sha {
+			continue
+		}
+		if dir, ok := checkedOut[b]; ok {
+			err = g.resetHard(dir, sha)
+		} else {
+			err = g.updateRef(s.currentDir, "refs/heads/"+b, sha)
+		}
+		if err != nil {
+			return fmt.Errorf("rolling back %q: %w", b, err)
+		}
+		s.verbosef("Rolled back %q to %s.", b, sha)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package rebaseall
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestUndo(t *testing.T) {
+	f := newTestFixture(t)
+	if err := errors.Join(
+		f.branch("a", "main", "a"),
+		f.branch("b", "a", "b"),
+		f.git(f.work, "branch", "merged"),
+		f.git(f.mate, "checkout", "--quiet", "-b", "remote"),
+		f.commit(f.mate, "remote", "remote\n"),
+		f.git(f.mate, "push", "--quiet", "origin", "remote"),
+		f.git(f.mate, "checkout", "--quiet", "main"),
+		f.advance("upstream", "upstream\n"),
+	); err != nil {
+		t.Fatalf("creating the branches: %v", err)
+	}
+	before, err := f.output(f.work, "for-each-ref", "refs/heads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Dir: f.work, Runner: f.runner, Stdout: io.Discard, Stderr: io.Discard, Yes: true}
+
+	// The run fast-forwards main, deletes merged, creates remote, and rebases
+	// the rest.
+	run := opts
+	run.PruneMerged, run.TrackRemote = true, []string{"remote"}
+	sum, err := Execute(context.Background(), run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wantStatuses(sum, map[string]string{"main": StatusFastForwarded, "a": StatusRebased, "b": StatusRebased, "remote": StatusRebased, "merged": StatusDeleted}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither a plan nor a run with nothing to do replaces the backup.
+	backup, err := f.output(f.work, "for-each-ref", backupPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := opts
+	dump.DumpPlan = filepath.Join(t.TempDir(), "plan.json")
+	if _, err := Execute(context.Background(), dump); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Execute(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := f.output(f.work, "for-each-ref", backupPrefix); got != backup {
+		t.Fatalf("the backup was replaced\nbefore:\n%s\nafter:\n%s", backup, got)
+	}
+
+	undo := opts
+	undo.Undo = true
+	if err := Run(context.Background(), undo); err != nil {
+		t.Fatal(err)
+	}
+	after, err := f.output(f.work, "for-each-ref", "refs/heads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != before {
+		t.Fatalf("the branches weren't restored\nbefore:\n%s\nafter:\n%s", before, after)
+	}
+	if err := f.restored(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,55 @@
+package rebaseall
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// verify runs the --verify command against the branch, which was just rebased
+// in dir onto onto, in a temporary worktree checked out at the branch. If the
+// command fails, then every branch that the rebase moved is reset to where it
+// was before the rebase, as recorded in before, and false is returned.
+func (s *state) verify(dir, branch, onto string, before map[string]string) (ok bool, err error) {
+	tmp, err := os.MkdirTemp("", "git-rebase-all-verify-")
+	if err != nil {
+		return false, fmt.Errorf("creating a temporary directory: %w", err)
+	}
+	if err := s.git.addWorktree(s.currentDir, tmp, branch); err != nil {
+		return false, errors.Join(fmt.Errorf("adding a worktree to verify %q: %w", branch, err), os.Remove(tmp))
+	}
+	defer func() {
+		err = errors.Join(err, s.git.detached().removeWorktree(s.currentDir, tmp))
+	}()
+
+	verifyErr := s.runHook("verify", s.opts.Verify, tmp, branch, onto)
+	if verifyErr == nil {
+		return true, nil
+	}
+	if s.git.ctx.Err() != nil {
+		return false, verifyErr
+	}
+
+	after, err := s.git.branches(s.currentDir)
+	if err != nil {
+		return false, fmt.Errorf("listing the branches to roll back: %w", err)
+	}
+	for _, b := range sortedKeys(after) {
+		old, ok := before[b]
+		if !ok || old == after[b] {
+			continue
+		}
+		// The rebased branch is checked out in dir; the others that it moved
+		// aren't.
+		if b == branch {
+			err = s.git.resetHard(dir, old)
+		} else {
+			err = s.git.updateRef(s.currentDir, "refs/heads/"+b, old)
+		}
+		if err != nil {
+			return false, fmt.Errorf("rolling back %q after its verification failed: %w", b, err)
+		}
+	}
+	s.recordUnverified(branch, verifyErr)
+	return false, nil
+}
@@ -0,0 +1,122 @@
+package rebaseall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// watchDebounce is how long the target's upstream must stay put, once it has
+// moved, before the branches are rebased onto it under --watch. It's capped at
+// Options.WatchInterval.
+const watchDebounce = 30 * time.Second
+
+// watch runs, and then, every Options.WatchInterval, fetches and reruns if the
+// target's upstream (or, for a target that isn't a local branch, the target)
+// has moved, until ctx is cancelled (which isn't an error) or a run is paused.
+// A failed run is reported and the watch goes on. Each run takes the lock file, so a run that
+// would overlap another is skipped.
+func watch(ctx context.Context, opts Options) error {
+	opts.Watch, opts.ForceUnlock = false, false
+	out := opts.progress()
+	g := opts.git(ctx)
+	debounce := min(watchDebounce, opts.WatchInterval)
+	for {
+		err := Run(ctx, opts)
+		if ctx.Err() != nil {
+			return stopWatching(out)
+		}
+		if errors.Is(err, ErrPaused) {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintf(opts.Stderr, "Error: %v.\n", err)
+		}
+
+		ref, sha, err := watchedRef(ctx, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Watching %s for new commits every %s...\n", ref, opts.WatchInterval)
+		for {
+			if !sleep(ctx, opts.WatchInterval) {
+				return stopWatching(out)
+			}
+			moved, err := watchFetch(g, opts, ref, sha)
+			if err != nil {
+				fmt.Fprintf(opts.Stderr, "Error: %v.\n", err)
+				continue
+			}
+			if moved == "" {
+				continue
+			}
+
+			// The upstream may be moving in a burst (e.g., a merge queue), so we
+			// wait for it to settle.
+			for moved != "" {
+				fmt.Fprintf(out, "%s moved to %s; waiting %s for it to settle...\n", ref, shortSHA(moved), debounce)
+				if !sleep(ctx, debounce) {
+					return stopWatching(out)
+				}
+				sha = moved
+				if moved, err = watchFetch(g, opts, ref, sha); err != nil {
+					fmt.Fprintf(opts.Stderr, "Error: %v.\n", err)
+					moved = ""
+				}
+			}
+			break
+		}
+	}
+}
+
+// watchedRef returns the reference that's watched and its commit SHA.
+func watchedRef(ctx context.Context, opts Options) (ref, sha string, err error) {
+	s, err := newState(ctx, opts)
+	if err != nil {
+		return "", "", fmt.Errorf("reading the state to watch: %w", err)
+	}
+	switch {
+	case s.targetUpstream != "":
+		ref = s.targetUpstream
+	case s.revTarget:
+		ref = s.targetRev
+	default:
+		ref = s.targetBranch
+	}
+	if sha, err = s.git.resolve(s.currentDir, ref); err != nil {
+		return "", "", err
+	}
+	return ref, sha, nil
+}
+
+// watchFetch fetches and returns the commit SHA of ref if it's no longer sha,
+// and otherwise the empty string.
+func watchFetch(g *git, opts Options, ref, sha string) (string, error) {
+	if err := g.fetch("", opts.fetchArgs()...); err != nil {
+		return "", err
+	}
+	now, err := g.resolve("", ref)
+	if err != nil || now == sha {
+		return "", err
+	}
+	return now, nil
+}
+
+func stopWatching(out io.Writer) error {
+	fmt.Fprintln(out, "Stopped watching.")
+	return nil
+}
+
+// sleep waits for d, returning false if ctx is cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
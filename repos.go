@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/adamroyjones/git-rebase-all/pkg/rebaseall"
+)
+
+// runRepos runs git-rebase-all in each of the repositories given by roots, one
+// after the other, and then prints whether each succeeded. It fails if any of
+// them did.
+func runRepos(ctx context.Context, opts rebaseall.Options, roots []string) error {
+	dirs, err := expandRepos(roots)
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		return errors.New("--repos matched no repositories")
+	}
+
+	// With JSON, stdout holds a summary per repository.
+	var out io.Writer = os.Stdout
+	if opts.Format == "json" {
+		out = os.Stderr
+	}
+
+	results := make([]error, len(dirs))
+	failed := 0
+	for i, dir := range dirs {
+		if ctx.Err() != nil {
+			results[i] = ctx.Err()
+			failed++
+			continue
+		}
+		fmt.Fprintf(out, "==> %s [%d/%d]\n", dir, i+1, len(dirs))
+		o := opts
+		o.Dir = dir
+		if results[i] = rebaseall.Run(ctx, o); results[i] != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v.\n", results[i])
+			failed++
+		}
+	}
+
+	fmt.Fprintln(out, "Repositories:")
+	for i, dir := range dirs {
+		switch {
+		case results[i] == nil:
+			fmt.Fprintf(out, "  %s: ok\n", dir)
+		case errors.Is(results[i], rebaseall.ErrPaused):
+			fmt.Fprintf(out, "  %s: paused\n", dir)
+		default:
+			fmt.Fprintf(out, "  %s: failed\n", dir)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d repositories failed", failed, len(dirs))
+	}
+	return nil
+}
+
+// expandRepos returns the repositories given by roots, each of which is either
+// a repository (with or without a work tree) or a directory whose immediate
+// subdirectories include repositories. A leading ~ denotes the home directory.
+func expandRepos(roots []string) ([]string, error) {
+	var out []string
+	for _, root := range roots {
+		if rest, ok := strings.CutPrefix(root, "~"); ok && (rest == "" || rest[0] == '/' || rest[0] == filepath.Separator) {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("expanding %q: %w", root, err)
+			}
+			root = filepath.Join(home, rest)
+		}
+		if isRepo(root) {
+			out = append(out, root)
+			continue
+		}
+
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return nil, fmt.Errorf("listing the repositories (dir: %s): %w", root, err)
+		}
+		for _, e := range entries {
+			if dir := filepath.Join(root, e.Name()); e.IsDir() && isRepo(dir) {
+				out = append(out, dir)
+			}
+		}
+	}
+	return out, nil
+}
+
+// isRepo reports whether dir is the top-level directory of a repository or is a
+// bare repository.
+func isRepo(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return true
+	}
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}